@@ -9,6 +9,7 @@ import (
 
 	"github.com/craumix/onionmsg/internal/api"
 	"github.com/craumix/onionmsg/internal/daemon"
+	"github.com/craumix/onionmsg/internal/types"
 )
 
 var (
@@ -21,6 +22,7 @@ var (
 	debug         = false
 	trace         = false
 	torBinary     = ""
+	timeouts      = types.DefaultTimeouts()
 )
 
 func init() {
@@ -50,6 +52,7 @@ func main() {
 		UseControlPass: !noControlPass,
 		AutoAccept:     autoAccept,
 		TorBinary:      torBinary,
+		Timeouts:       timeouts,
 	})
 
 	api.Start(useUnixSocket, portOffset)
@@ -69,4 +72,8 @@ func setupFlags() {
 	flag.BoolVar(&debug, "debug", debug, "Set Log-Level to Debug")
 	flag.BoolVar(&trace, "trace", trace, "Set Log-Level to Trace (includes Debug)")
 	flag.StringVar(&torBinary, "tor-binary", torBinary, "Select the Tor-Binary to be used")
+	flag.DurationVar(&timeouts.Handshake, "handshake-timeout", timeouts.Handshake, "Timeout for each step of the handshake with other daemons")
+	flag.DurationVar(&timeouts.Messages, "message-timeout", timeouts.Messages, "Timeout for each step of the message exchange with other daemons")
+	flag.DurationVar(&timeouts.Blobs, "blob-timeout", timeouts.Blobs, "Timeout for each block of a file transfer with other daemons")
+	flag.DurationVar(&timeouts.Session, "session-timeout", timeouts.Session, "Timeout for a whole exchange with another daemon")
 }
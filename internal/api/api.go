@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"mime"
@@ -81,12 +82,24 @@ func Start(unixSocket bool, portOffset int) {
 	http.HandleFunc("/v1/room/send/message", RouteRoomSendMessage)
 	http.HandleFunc("/v1/room/send/file", RouteRoomSendFile)
 	http.HandleFunc("/v1/room/messages", RouteRoomMessages)
+	http.HandleFunc("/v1/room/read", RouteRoomRead)
+	http.HandleFunc("/v1/room/message/edit", RouteRoomMessageEdit)
+	http.HandleFunc("/v1/room/message/delete", RouteRoomMessageDelete)
+	http.HandleFunc("/v1/room/message/react", RouteRoomMessageReact)
+	http.HandleFunc("/v1/room/message/unreact", RouteRoomMessageUnreact)
+	http.HandleFunc("/v1/room/signal", RouteRoomSignal)
 
 	http.HandleFunc("/v1/room/command/useradd", RouteRoomCommandUseradd)
 	http.HandleFunc("/v1/room/command/nameroom", RouteRoomCommandNameRoom)
 	http.HandleFunc("/v1/room/command/setnick", RouteRoomCommandSetNick)
+	http.HandleFunc("/v1/room/command/settopic", RouteRoomCommandSetTopic)
 	http.HandleFunc("/v1/room/command/promote", RouteRoomCommandPromote)
+	http.HandleFunc("/v1/room/command/demote", RouteRoomCommandDemote)
+	http.HandleFunc("/v1/room/command/setrole", RouteRoomCommandSetRole)
+	http.HandleFunc("/v1/room/command/transferownership", RouteRoomCommandTransferOwnership)
 	http.HandleFunc("/v1/room/command/removepeer", RouteRoomCommandRemovePeer)
+	http.HandleFunc("/v1/room/command/ban", RouteRoomCommandBan)
+	http.HandleFunc("/v1/room/command/unban", RouteRoomCommandUnban)
 
 	err = http.Serve(listener, cors.Default().Handler(http.DefaultServeMux))
 	if err != nil {
@@ -119,6 +132,17 @@ func RouteBlob(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	//Blobs are decrypted with the key of the room they were sent in,
+	//older frontends don't specify it, so every room is searched for the blob
+	roomID := uuid.Nil
+	if room := req.FormValue("room"); room != "" {
+		roomID, err = uuid.Parse(room)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	_, err = blobmngr.StatFromID(id)
 	if os.IsNotExist(err) {
 		http.Error(w, "Blob not found!", http.StatusNotFound)
@@ -131,12 +155,15 @@ func RouteBlob(w http.ResponseWriter, req *http.Request) {
 		w.Header().Add("Content-Disposition", "attachment; filename=\""+respFilname+"\"")
 	}
 
-	//If the blob exists, it will never change
-	w.Header().Add("Cache-Control", "public, max-age=604800, immutable")
+	//If the blob exists, it will never change, but it may only be cached by the frontend itself
+	w.Header().Add("Cache-Control", "private, max-age=604800, immutable")
 	w.Header().Add("Content-Type", "application/octet-stream")
 
-	err = blobmngr.StreamTo(id, w)
-	if err != nil {
+	err = daemon.StreamBlob(roomID, id, w)
+	if errors.Is(err, daemon.ErrBlobNotFound) {
+		http.Error(w, "Blob not found!", http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -248,7 +275,21 @@ func RouteRoomCreate(w http.ResponseWriter, req *http.Request) {
 }
 
 func RouteRoomDelete(w http.ResponseWriter, req *http.Request) {
-	err := daemon.DeleteRoom(req.FormValue("uuid"))
+	var (
+		force = false
+		err   error
+	)
+
+	//With force, the room is deleted without waiting for a peer to learn that it was left
+	if req.FormValue("force") != "" {
+		force, err = strconv.ParseBool(req.FormValue("force"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = daemon.DeleteRoom(req.FormValue("uuid"), force)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -264,6 +305,12 @@ func RouteRoomSendMessage(w http.ResponseWriter, req *http.Request) {
 }
 
 func RouteRoomSendFile(w http.ResponseWriter, req *http.Request) {
+	reply, err := replyFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	id, err := blobmngr.MakeBlob()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -295,15 +342,9 @@ func RouteRoomSendFile(w http.ResponseWriter, req *http.Request) {
 		filesize = int(fileStat.Size())
 	}
 
-	replyto, err := replyFromHeader(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
 	err = daemon.SendMessage(req.FormValue("uuid"), types.MessageContent{
-		Type:    types.ContentTypeFile,
-		ReplyTo: replyto,
+		Type:  types.ContentTypeFile,
+		Reply: reply,
 		Blob: &types.BlobMeta{
 			ID:   id,
 			Name: filename,
@@ -340,6 +381,101 @@ func RouteRoomMessages(w http.ResponseWriter, req *http.Request) {
 	sendSerialized(w, messages)
 }
 
+func RouteRoomRead(w http.ResponseWriter, req *http.Request) {
+	var ids []string
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = json.Unmarshal(body, &ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(ids) == 0 {
+		http.Error(w, "Must provide at least one message id", http.StatusBadRequest)
+		return
+	}
+
+	err = daemon.MarkRead(req.FormValue("uuid"), ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func RouteRoomMessageEdit(w http.ResponseWriter, req *http.Request) {
+	msgID := req.FormValue("message")
+	if msgID == "" {
+		http.Error(w, "Missing parameter \"message\"", http.StatusBadRequest)
+		return
+	}
+
+	content, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(content) > maxMessageSize {
+		http.Error(w, fmt.Sprintf("message too big, cannot be greater %d", maxMessageSize), http.StatusBadRequest)
+		return
+	}
+
+	err = daemon.EditMessage(req.FormValue("uuid"), msgID, content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func RouteRoomMessageDelete(w http.ResponseWriter, req *http.Request) {
+	msgID := req.FormValue("message")
+	if msgID == "" {
+		http.Error(w, "Missing parameter \"message\"", http.StatusBadRequest)
+		return
+	}
+
+	err := daemon.DeleteMessage(req.FormValue("uuid"), msgID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func RouteRoomMessageReact(w http.ResponseWriter, req *http.Request) {
+	errCode, err := sendReaction(req, daemon.React)
+	if err != nil {
+		http.Error(w, err.Error(), errCode)
+	}
+}
+
+func RouteRoomMessageUnreact(w http.ResponseWriter, req *http.Request) {
+	errCode, err := sendReaction(req, daemon.Unreact)
+	if err != nil {
+		http.Error(w, err.Error(), errCode)
+	}
+}
+
+func RouteRoomSignal(w http.ResponseWriter, req *http.Request) {
+	sType := req.FormValue("type")
+	if sType == "" {
+		http.Error(w, "Missing parameter \"type\"", http.StatusBadRequest)
+		return
+	}
+
+	err := daemon.SendSignal(req.FormValue("uuid"), types.SignalType(sType))
+	switch {
+	case errors.Is(err, types.ErrUnknownSignal):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, daemon.ErrRoomNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func RouteRoomCommandUseradd(w http.ResponseWriter, req *http.Request) {
 	roomID, err := uuid.Parse(req.FormValue("uuid"))
 	if err != nil {
@@ -374,6 +510,14 @@ func RouteRoomCommandSetNick(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// RouteRoomCommandSetTopic expects the new topic, an empty body removes it
+func RouteRoomCommandSetTopic(w http.ResponseWriter, req *http.Request) {
+	errCode, err := sendMessage(req, types.RoomCommandTopic)
+	if err != nil {
+		http.Error(w, err.Error(), errCode)
+	}
+}
+
 func RouteRoomCommandPromote(w http.ResponseWriter, req *http.Request) {
 	errCode, err := sendMessage(req, types.RoomCommandPromote)
 	if err != nil {
@@ -381,6 +525,28 @@ func RouteRoomCommandPromote(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func RouteRoomCommandDemote(w http.ResponseWriter, req *http.Request) {
+	errCode, err := sendMessage(req, types.RoomCommandDemote)
+	if err != nil {
+		http.Error(w, err.Error(), errCode)
+	}
+}
+
+// RouteRoomCommandSetRole expects the fingerprint of the peer and the new role, separated by a space
+func RouteRoomCommandSetRole(w http.ResponseWriter, req *http.Request) {
+	errCode, err := sendMessage(req, types.RoomCommandSetRole)
+	if err != nil {
+		http.Error(w, err.Error(), errCode)
+	}
+}
+
+func RouteRoomCommandTransferOwnership(w http.ResponseWriter, req *http.Request) {
+	errCode, err := sendMessage(req, types.RoomCommandTransferOwnership)
+	if err != nil {
+		http.Error(w, err.Error(), errCode)
+	}
+}
+
 func RouteRoomCommandRemovePeer(w http.ResponseWriter, req *http.Request) {
 	errCode, err := sendMessage(req, types.RoomCommandRemovePeer)
 	if err != nil {
@@ -388,6 +554,21 @@ func RouteRoomCommandRemovePeer(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// RouteRoomCommandBan removes the peer with the specified fingerprint, and prevents it from being invited again
+func RouteRoomCommandBan(w http.ResponseWriter, req *http.Request) {
+	errCode, err := sendMessage(req, types.RoomCommandBan)
+	if err != nil {
+		http.Error(w, err.Error(), errCode)
+	}
+}
+
+func RouteRoomCommandUnban(w http.ResponseWriter, req *http.Request) {
+	errCode, err := sendMessage(req, types.RoomCommandUnban)
+	if err != nil {
+		http.Error(w, err.Error(), errCode)
+	}
+}
+
 func sendMessage(req *http.Request, roomCommand types.Command) (int, error) {
 	content, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -398,21 +579,56 @@ func sendMessage(req *http.Request, roomCommand types.Command) (int, error) {
 		return http.StatusBadRequest, fmt.Errorf("message too big, cannot be greater %d", maxMessageSize)
 	}
 
-	msgType := types.ContentTypeText
+	msgContent := types.MessageContent{
+		Type: types.ContentTypeText,
+		Data: content,
+	}
 	if roomCommand != "" {
-		msgType = types.ContentTypeCmd
+		msgContent, err = types.NewTextCommandContent(roomCommand, string(content))
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	msgContent.Reply, err = replyFromRequest(req)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	err = daemon.SendMessage(req.FormValue("uuid"), msgContent)
+	if err != nil {
+		return sendErrorCode(err), err
+	}
+
+	return 0, nil
+}
+
+// sendErrorCode returns the status code for an error of daemon.SendMessage,
+// which is caused by the request if it replies to a message that can't be replied to
+func sendErrorCode(err error) int {
+	var replyErr *types.ReplyTargetError
+	if errors.As(err, &replyErr) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+func sendReaction(req *http.Request, reactionFunc func(string, string, string) error) (int, error) {
+	msgID := req.FormValue("message")
+	if msgID == "" {
+		return http.StatusBadRequest, fmt.Errorf("missing parameter \"message\"")
 	}
 
-	replyto, err := replyFromHeader(req)
+	emoji, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		return http.StatusBadRequest, err
 	}
 
-	err = daemon.SendMessage(req.FormValue("uuid"), types.MessageContent{
-		Type:    msgType,
-		ReplyTo: replyto,
-		Data:    types.ConstructCommand(content, roomCommand),
-	})
+	if len(emoji) == 0 {
+		return http.StatusBadRequest, fmt.Errorf("no reaction provided")
+	}
+
+	err = reactionFunc(req.FormValue("uuid"), msgID, string(emoji))
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
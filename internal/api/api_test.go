@@ -171,7 +171,7 @@ func TestDeleteRoom(t *testing.T) {
 
 	var actual string
 
-	daemon.DeleteRoom = func(uuid string) error {
+	daemon.DeleteRoom = func(uuid string, force bool) error {
 		actual = uuid
 		return nil
 	}
@@ -187,10 +187,40 @@ func TestDeleteRoom(t *testing.T) {
 	assert.Equal(t, expected, actual, "Uuid was modified")
 }
 
+func TestDeleteRoomForce(t *testing.T) {
+	resWriter := mocks.GetMockResponseWriter()
+
+	var actual bool
+
+	daemon.DeleteRoom = func(uuid string, force bool) error {
+		actual = force
+		return nil
+	}
+
+	req := getRequest(nil, false, true)
+	req.Form.Add("force", "true")
+
+	api.RouteRoomDelete(resWriter, req)
+
+	assertZeroStatusCode(t, resWriter)
+	assert.True(t, actual, "Force was not passed on")
+}
+
+func TestDeleteRoomInvalidForce(t *testing.T) {
+	resWriter := mocks.GetMockResponseWriter()
+
+	req := getRequest(nil, false, true)
+	req.Form.Add("force", "maybe")
+
+	api.RouteRoomDelete(resWriter, req)
+
+	assertErrorCode(t, resWriter, http.StatusBadRequest)
+}
+
 func TestDeleteRoomError(t *testing.T) {
 	resWriter := mocks.GetMockResponseWriter()
 
-	daemon.DeleteRoom = func(uuid string) error {
+	daemon.DeleteRoom = func(uuid string, force bool) error {
 		return test.GetTestError()
 	}
 
@@ -514,7 +544,7 @@ func TestRouteRoomMessages(t *testing.T) {
 		resWriter := mocks.GetMockResponseWriter()
 
 		var actualID string
-		daemon.ListMessages = func(uuid string, count int) ([]types.Message, error) {
+		daemon.ListMessages = func(uuid string, count int) ([]types.MessageInfo, error) {
 			actualID = uuid
 			return nil, tc.ListMessagesErr
 		}
@@ -530,12 +560,347 @@ func TestRouteRoomMessages(t *testing.T) {
 	}
 }
 
+func TestRouteRoomRead(t *testing.T) {
+	resWriter := mocks.GetMockResponseWriter()
+
+	var (
+		actualID  string
+		actualIDs []string
+	)
+	daemon.MarkRead = func(uuid string, ids []string) error {
+		actualID = uuid
+		actualIDs = ids
+		return nil
+	}
+
+	expectedIDs := []string{"msg1", "msg2"}
+
+	req := getRequest(expectedIDs, false, true)
+
+	expectedID := "test id"
+	req.Form.Add("uuid", expectedID)
+
+	api.RouteRoomRead(resWriter, req)
+
+	assertZeroStatusCode(t, resWriter)
+	assert.Equal(t, expectedID, actualID, "Uuid was modified")
+	assert.Equal(t, expectedIDs, actualIDs, "Message ids were modified")
+}
+
+func TestRouteRoomReadErrors(t *testing.T) {
+	testcases := []struct {
+		name              string
+		req               *http.Request
+		expectedErrorCode int
+	}{
+		{
+			name:              "ReadAll error",
+			req:               getRequest(nil, true, true),
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "Unmarshal error",
+			req:               getRequest("", false, true),
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "No ids error",
+			req:               getRequest([]string{}, false, true),
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "MarkRead error",
+			req:               getRequest([]string{"msg1"}, false, true),
+			expectedErrorCode: http.StatusInternalServerError,
+		},
+	}
+
+	daemon.MarkRead = func(uuid string, ids []string) error {
+		return test.GetTestError()
+	}
+
+	for _, tc := range testcases {
+		resWriter := mocks.GetMockResponseWriter()
+
+		api.RouteRoomRead(resWriter, tc.req)
+
+		assertErrorCode(t, resWriter, tc.expectedErrorCode, tc.name)
+	}
+}
+
+func TestRouteRoomMessageEdit(t *testing.T) {
+	resWriter := mocks.GetMockResponseWriter()
+
+	var (
+		actualID    string
+		actualMsgID string
+		actualData  []byte
+	)
+	daemon.EditMessage = func(uuid, msgID string, data []byte) error {
+		actualID = uuid
+		actualMsgID = msgID
+		actualData = data
+		return nil
+	}
+
+	req := getRequest("edited", false, false)
+
+	expectedID := "test id"
+	req.Form.Add("uuid", expectedID)
+	req.Form.Add("message", "test message")
+
+	api.RouteRoomMessageEdit(resWriter, req)
+
+	assertZeroStatusCode(t, resWriter)
+	assert.Equal(t, expectedID, actualID, "Uuid was modified")
+	assert.Equal(t, "test message", actualMsgID, "Message id was modified")
+	assert.Equal(t, "edited", string(actualData), "Data was modified")
+}
+
+func TestRouteRoomMessageEditErrors(t *testing.T) {
+	testcases := []struct {
+		name              string
+		msgID             string
+		readShouldError   bool
+		editErr           error
+		expectedErrorCode int
+	}{
+		{
+			name:              "No message id",
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "ReadAll error",
+			msgID:             "test message",
+			readShouldError:   true,
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "EditMessage error",
+			msgID:             "test message",
+			editErr:           test.GetTestError(),
+			expectedErrorCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testcases {
+		resWriter := mocks.GetMockResponseWriter()
+
+		daemon.EditMessage = func(uuid, msgID string, data []byte) error {
+			return tc.editErr
+		}
+
+		req := getRequest("edited", tc.readShouldError, false)
+		req.Form.Add("message", tc.msgID)
+
+		api.RouteRoomMessageEdit(resWriter, req)
+
+		assertErrorCode(t, resWriter, tc.expectedErrorCode, tc.name)
+	}
+}
+
+func TestRouteRoomMessageDelete(t *testing.T) {
+	resWriter := mocks.GetMockResponseWriter()
+
+	var actualMsgID string
+	daemon.DeleteMessage = func(uuid, msgID string) error {
+		actualMsgID = msgID
+		return nil
+	}
+
+	req := getRequest(nil, false, true)
+	req.Form.Add("message", "test message")
+
+	api.RouteRoomMessageDelete(resWriter, req)
+
+	assertZeroStatusCode(t, resWriter)
+	assert.Equal(t, "test message", actualMsgID, "Message id was modified")
+}
+
+func TestRouteRoomMessageDeleteErrors(t *testing.T) {
+	resWriter := mocks.GetMockResponseWriter()
+
+	api.RouteRoomMessageDelete(resWriter, getRequest(nil, false, true))
+
+	assertErrorCode(t, resWriter, http.StatusBadRequest, "No message id")
+
+	resWriter = mocks.GetMockResponseWriter()
+
+	daemon.DeleteMessage = func(uuid, msgID string) error {
+		return test.GetTestError()
+	}
+
+	req := getRequest(nil, false, true)
+	req.Form.Add("message", "test message")
+
+	api.RouteRoomMessageDelete(resWriter, req)
+
+	assertErrorCode(t, resWriter, http.StatusInternalServerError, "DeleteMessage error")
+}
+
+func TestRouteRoomMessageReactions(t *testing.T) {
+	var (
+		actualMsgID string
+		actualEmoji string
+	)
+	reactionFunc := func(uuid, msgID, emoji string) error {
+		actualMsgID = msgID
+		actualEmoji = emoji
+		return nil
+	}
+	daemon.React = reactionFunc
+	daemon.Unreact = reactionFunc
+
+	testcases := []struct {
+		name     string
+		testFunc func(http.ResponseWriter, *http.Request)
+	}{
+		{
+			name:     "RouteRoomMessageReact",
+			testFunc: api.RouteRoomMessageReact,
+		},
+		{
+			name:     "RouteRoomMessageUnreact",
+			testFunc: api.RouteRoomMessageUnreact,
+		},
+	}
+
+	for _, tc := range testcases {
+		resWriter := mocks.GetMockResponseWriter()
+
+		req := getRequest("👍", false, false)
+		req.Form.Add("message", "test message")
+
+		tc.testFunc(resWriter, req)
+
+		assertZeroStatusCode(t, resWriter, tc.name)
+		assert.Equal(t, "test message", actualMsgID, tc.name+": Message id was modified")
+		assert.Equal(t, "👍", actualEmoji, tc.name+": Emoji was modified")
+	}
+}
+
+func TestRouteRoomMessageReactionsErrors(t *testing.T) {
+	testcases := []struct {
+		name              string
+		msgID             string
+		body              string
+		readShouldError   bool
+		reactionErr       error
+		expectedErrorCode int
+	}{
+		{
+			name:              "No message id",
+			body:              "👍",
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "ReadAll error",
+			msgID:             "test message",
+			readShouldError:   true,
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "No reaction",
+			msgID:             "test message",
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "Reaction error",
+			msgID:             "test message",
+			body:              "👍",
+			reactionErr:       test.GetTestError(),
+			expectedErrorCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testcases {
+		resWriter := mocks.GetMockResponseWriter()
+
+		daemon.React = func(uuid, msgID, emoji string) error {
+			return tc.reactionErr
+		}
+
+		req := getRequest(tc.body, tc.readShouldError, false)
+		req.Form.Add("message", tc.msgID)
+
+		api.RouteRoomMessageReact(resWriter, req)
+
+		assertErrorCode(t, resWriter, tc.expectedErrorCode, tc.name)
+	}
+}
+
+func TestRouteRoomSignal(t *testing.T) {
+	resWriter := mocks.GetMockResponseWriter()
+
+	var actual types.SignalType
+	daemon.SendSignal = func(uid string, sType types.SignalType) error {
+		actual = sType
+		return nil
+	}
+
+	req := getRequest("", false, false)
+	req.Form.Add("type", string(types.SignalTyping))
+
+	api.RouteRoomSignal(resWriter, req)
+
+	assertZeroStatusCode(t, resWriter)
+	assert.Equal(t, types.SignalTyping, actual, "Signal type was modified")
+}
+
+func TestRouteRoomSignalErrors(t *testing.T) {
+	testcases := []struct {
+		name              string
+		sType             string
+		signalErr         error
+		expectedErrorCode int
+	}{
+		{
+			name:              "No signal type",
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "Unknown signal type",
+			sType:             "unknown",
+			signalErr:         fmt.Errorf("%w unknown", types.ErrUnknownSignal),
+			expectedErrorCode: http.StatusBadRequest,
+		},
+		{
+			name:              "Unknown room",
+			sType:             string(types.SignalTyping),
+			signalErr:         fmt.Errorf("%w: test id", daemon.ErrRoomNotFound),
+			expectedErrorCode: http.StatusNotFound,
+		},
+		{
+			name:              "Signal error",
+			sType:             string(types.SignalTyping),
+			signalErr:         test.GetTestError(),
+			expectedErrorCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testcases {
+		resWriter := mocks.GetMockResponseWriter()
+
+		daemon.SendSignal = func(uid string, sType types.SignalType) error {
+			return tc.signalErr
+		}
+
+		req := getRequest("", false, false)
+		req.Form.Add("type", tc.sType)
+
+		api.RouteRoomSignal(resWriter, req)
+
+		assertErrorCode(t, resWriter, tc.expectedErrorCode, tc.name)
+	}
+}
+
 func TestRouteBlob(t *testing.T) {
 	resWriter := mocks.GetMockResponseWriter()
 
-	var actualID string
+	var actualID, actualRoom string
 
-	blobmngr.StreamTo = func(id uuid.UUID, w io.Writer) error {
+	daemon.StreamBlob = func(roomID, id uuid.UUID, w io.Writer) error {
+		actualRoom = roomID.String()
 		actualID = id.String()
 		return nil
 	}
@@ -547,30 +912,72 @@ func TestRouteBlob(t *testing.T) {
 	req := getRequest(nil, false, true)
 
 	expectedID := test.GetValidUUID()
+	expectedRoom := test.GetValidUUID()
 	req.Form.Add("uuid", expectedID)
+	req.Form.Add("room", expectedRoom)
 
 	api.RouteBlob(resWriter, req)
 
 	assertZeroStatusCode(t, resWriter)
 	assert.Equal(t, expectedID, actualID, "Uuid was modified")
-	assert.Equal(t, "public, max-age=604800, immutable", resWriter.Head.Get("Cache-Control"))
+	assert.Equal(t, expectedRoom, actualRoom, "Room was modified")
+	assert.Equal(t, "private, max-age=604800, immutable", resWriter.Head.Get("Cache-Control"))
+}
+
+func TestRouteBlobWithoutRoom(t *testing.T) {
+	resWriter := mocks.GetMockResponseWriter()
+
+	actualRoom := test.GetValidUUID()
+
+	daemon.StreamBlob = func(roomID, id uuid.UUID, w io.Writer) error {
+		actualRoom = roomID.String()
+		return nil
+	}
+
+	blobmngr.StatFromID = func(id uuid.UUID) (fs.FileInfo, error) {
+		return nil, nil
+	}
+
+	req := getRequest(nil, false, true)
+	req.Form.Add("uuid", test.GetValidUUID())
+
+	api.RouteBlob(resWriter, req)
+
+	assertZeroStatusCode(t, resWriter)
+	assert.Equal(t, uuid.Nil.String(), actualRoom, "Rooms aren't searched for the blob")
 }
 
 func TestRouteBlobStreamToErrors(t *testing.T) {
 	testcases := []struct {
 		name            string
 		id              string
+		room            string
 		StreamToErr     error
 		expectedErrCode int
 	}{
 		{
 			name:            "Invalid uuid",
 			id:              "invalid",
+			room:            test.GetValidUUID(),
 			expectedErrCode: http.StatusBadRequest,
 		},
+		{
+			name:            "Invalid room",
+			id:              test.GetValidUUID(),
+			room:            "invalid",
+			expectedErrCode: http.StatusBadRequest,
+		},
+		{
+			name:            "Not referenced by room",
+			id:              test.GetValidUUID(),
+			room:            test.GetValidUUID(),
+			expectedErrCode: http.StatusNotFound,
+			StreamToErr:     daemon.ErrBlobNotFound,
+		},
 		{
 			name:            "Stream to error",
 			id:              test.GetValidUUID(),
+			room:            test.GetValidUUID(),
 			expectedErrCode: http.StatusInternalServerError,
 			StreamToErr:     test.GetTestError(),
 		},
@@ -583,12 +990,13 @@ func TestRouteBlobStreamToErrors(t *testing.T) {
 	for _, tc := range testcases {
 		resWriter := mocks.GetMockResponseWriter()
 
-		blobmngr.StreamTo = func(id uuid.UUID, w io.Writer) error {
+		daemon.StreamBlob = func(roomID, id uuid.UUID, w io.Writer) error {
 			return tc.StreamToErr
 		}
 
 		req := getRequest(nil, false, true)
 		req.Form.Add("uuid", tc.id)
+		req.Form.Add("room", tc.room)
 
 		api.RouteBlob(resWriter, req)
 
@@ -600,7 +1008,7 @@ func TestRouteBlobBlobNotFoundError(t *testing.T) {
 	resWriter := mocks.GetMockResponseWriter()
 
 	called := false
-	blobmngr.StreamTo = func(id uuid.UUID, w io.Writer) error {
+	daemon.StreamBlob = func(roomID, id uuid.UUID, w io.Writer) error {
 		called = true
 		return nil
 	}
@@ -613,6 +1021,7 @@ func TestRouteBlobBlobNotFoundError(t *testing.T) {
 
 	expectedID := test.GetValidUUID()
 	req.Form.Add("uuid", expectedID)
+	req.Form.Add("room", test.GetValidUUID())
 
 	api.RouteBlob(resWriter, req)
 
@@ -639,7 +1048,7 @@ func TestRouteBlobContentDisposition(t *testing.T) {
 		},
 	}
 
-	blobmngr.StreamTo = func(id uuid.UUID, w io.Writer) error {
+	daemon.StreamBlob = func(roomID, id uuid.UUID, w io.Writer) error {
 		return nil
 	}
 
@@ -653,12 +1062,13 @@ func TestRouteBlobContentDisposition(t *testing.T) {
 		req := getRequest(nil, false, true)
 
 		req.Form.Add("uuid", test.GetValidUUID())
+		req.Form.Add("room", test.GetValidUUID())
 		req.Form.Add("filename", tc.filename)
 
 		api.RouteBlob(resWriter, req)
 
 		assertZeroStatusCode(t, resWriter)
-		assert.Equal(t, "public, max-age=604800, immutable", resWriter.Head.Get("Cache-Control"))
+		assert.Equal(t, "private, max-age=604800, immutable", resWriter.Head.Get("Cache-Control"))
 		assert.Equal(t, tc.expectedContentDisposition, resWriter.Head.Get("Content-Disposition"), tc.name)
 	}
 }
@@ -682,12 +1092,42 @@ func TestSendTextFunctions(t *testing.T) {
 			command:             types.RoomCommandNameRoom,
 			expectedContentType: types.ContentTypeCmd,
 		},
+		{
+			name:                "RouteRoomCommandSetTopic",
+			testFunc:            api.RouteRoomCommandSetTopic,
+			command:             types.RoomCommandTopic,
+			expectedContentType: types.ContentTypeCmd,
+		},
 		{
 			name:                "RouteRoomCommandPromote",
 			testFunc:            api.RouteRoomCommandPromote,
 			command:             types.RoomCommandPromote,
 			expectedContentType: types.ContentTypeCmd,
 		},
+		{
+			name:                "RouteRoomCommandDemote",
+			testFunc:            api.RouteRoomCommandDemote,
+			command:             types.RoomCommandDemote,
+			expectedContentType: types.ContentTypeCmd,
+		},
+		{
+			name:                "RouteRoomCommandTransferOwnership",
+			testFunc:            api.RouteRoomCommandTransferOwnership,
+			command:             types.RoomCommandTransferOwnership,
+			expectedContentType: types.ContentTypeCmd,
+		},
+		{
+			name:                "RouteRoomCommandBan",
+			testFunc:            api.RouteRoomCommandBan,
+			command:             types.RoomCommandBan,
+			expectedContentType: types.ContentTypeCmd,
+		},
+		{
+			name:                "RouteRoomCommandUnban",
+			testFunc:            api.RouteRoomCommandUnban,
+			command:             types.RoomCommandUnban,
+			expectedContentType: types.ContentTypeCmd,
+		},
 		{
 			name:                "RouteRoomSendMessage",
 			testFunc:            api.RouteRoomSendMessage,
@@ -713,16 +1153,17 @@ func TestSendTextFunctions(t *testing.T) {
 		reader := mocks.MockReadCloser{}
 		reader.ReadReturnError = io.EOF
 
-		expectedContent := "test content"
+		//The fingerprint is a valid argument for every command
+		expectedContent := test.GetTestFingerprint()
 		reader.ReadFrom = []byte(expectedContent)
-		if tc.command != "" {
-			expectedContent = string(tc.command) + " " + expectedContent
-		}
 
 		expectedMsgContent := types.MessageContent{
 			Type: tc.expectedContentType,
 			Data: []byte(expectedContent),
 		}
+		if tc.command != "" {
+			expectedMsgContent, _ = types.NewTextCommandContent(tc.command, expectedContent)
+		}
 
 		req, _ := http.NewRequest("", "", &reader)
 
@@ -739,6 +1180,117 @@ func TestSendTextFunctions(t *testing.T) {
 	}
 }
 
+func TestRouteRoomSendMessageReply(t *testing.T) {
+	var actualMsgContent types.MessageContent
+	daemon.SendMessage = func(uuid string, content types.MessageContent) error {
+		actualMsgContent = content
+		return nil
+	}
+
+	resWriter := mocks.GetMockResponseWriter()
+
+	req := getRequest("test content", false, false)
+	req.Form.Add("uuid", "test id")
+	req.Form.Add(api.ReplyToParam, "test message id")
+
+	api.RouteRoomSendMessage(resWriter, req)
+
+	assertZeroStatusCode(t, resWriter)
+	assert.Equal(t, &types.ReplyRef{ID: "test message id"}, actualMsgContent.Reply)
+}
+
+func TestRouteRoomSendMessageReplyHeader(t *testing.T) {
+	var actualMsgContent types.MessageContent
+	daemon.SendMessage = func(uuid string, content types.MessageContent) error {
+		actualMsgContent = content
+		return nil
+	}
+
+	resWriter := mocks.GetMockResponseWriter()
+
+	req := getRequest("test content", false, false)
+	req.Form.Add("uuid", "test id")
+	req.Header.Set(api.ReplyToHeader, `{"id":"test message id","content":{"type":"mtype.text"}}`)
+
+	api.RouteRoomSendMessage(resWriter, req)
+
+	assertZeroStatusCode(t, resWriter)
+	assert.Equal(t, &types.ReplyRef{ID: "test message id"}, actualMsgContent.Reply)
+}
+
+func TestRouteRoomSendMessageReplyHeaderInvalid(t *testing.T) {
+	for _, header := range []string{"not json", `{"content":{"type":"mtype.text"}}`} {
+		called := false
+		daemon.SendMessage = func(uuid string, content types.MessageContent) error {
+			called = true
+			return nil
+		}
+
+		resWriter := mocks.GetMockResponseWriter()
+
+		req := getRequest("test content", false, false)
+		req.Header.Set(api.ReplyToHeader, header)
+
+		api.RouteRoomSendMessage(resWriter, req)
+
+		assertErrorCode(t, resWriter, http.StatusBadRequest, header)
+		assert.False(t, called)
+	}
+}
+
+func TestRouteRoomSendMessageReplyUnknown(t *testing.T) {
+	daemon.SendMessage = func(uuid string, content types.MessageContent) error {
+		return &types.ReplyTargetError{ID: content.Reply.ID, Reason: "not found"}
+	}
+
+	resWriter := mocks.GetMockResponseWriter()
+
+	req := getRequest("test content", false, false)
+	req.Form.Add(api.ReplyToParam, "test message id")
+
+	api.RouteRoomSendMessage(resWriter, req)
+
+	assertErrorCode(t, resWriter, http.StatusBadRequest)
+}
+
+func TestRouteRoomCommandSetRole(t *testing.T) {
+	var actualMsgContent types.MessageContent
+	daemon.SendMessage = func(uuid string, content types.MessageContent) error {
+		actualMsgContent = content
+		return nil
+	}
+
+	resWriter := mocks.GetMockResponseWriter()
+
+	api.RouteRoomCommandSetRole(resWriter, getRequest(test.GetTestFingerprint()+" readonly", false, false))
+
+	expected, _ := types.NewCommandContent(types.RoomCommandSetRole, &types.SetRoleArgs{
+		Fingerprint: test.GetTestFingerprint(),
+		Role:        types.RoleReadOnly,
+	})
+
+	assertZeroStatusCode(t, resWriter)
+	assert.Equal(t, expected, actualMsgContent)
+
+	resWriter = mocks.GetMockResponseWriter()
+
+	api.RouteRoomCommandSetRole(resWriter, getRequest(test.GetTestFingerprint()+" emperor", false, false))
+
+	assertErrorCode(t, resWriter, http.StatusBadRequest)
+}
+
+func TestSendTextFunctionsInvalidArgs(t *testing.T) {
+	daemon.SendMessage = func(uuid string, content types.MessageContent) error {
+		return nil
+	}
+
+	resWriter := mocks.GetMockResponseWriter()
+
+	api.RouteRoomCommandPromote(resWriter, getRequest("not a fingerprint", false, false))
+
+	assertErrorCode(t, resWriter, http.StatusBadRequest)
+}
+
 func TestSendTextFunctionsErrors(t *testing.T) {
 	testcases := []struct {
 		name     string
@@ -774,7 +1326,7 @@ func TestSendTextFunctionsErrors(t *testing.T) {
 		},
 		{
 			name:              "SendError",
-			req:               getRequest([]string{"test content"}, false, true),
+			req:               getRequest(test.GetTestFingerprint(), false, false),
 			expectedErrorCode: http.StatusInternalServerError,
 		},
 	}
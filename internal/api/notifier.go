@@ -14,6 +14,10 @@ const (
 	NotificationTypeNewRoom    = "NewRoom"
 	NotificationTypeError      = "Error"
 	NotificationTypeNewRequest = "NewRequest"
+	NotificationTypeReceipt    = "Receipt"
+	NotificationTypeUpdate     = "MessageUpdate"
+	NotificationTypeReaction   = "Reaction"
+	NotificationTypeSignal     = "Signal"
 )
 
 var (
@@ -29,6 +33,10 @@ func registerHooks() {
 	daemon.NewRoomHook = NotifyNewRoom
 	daemon.ErrorHook = NotifyError
 	daemon.NewRequestHook = NotifyNewRequest
+	daemon.ReceiptHook = NotifyReceipts
+	daemon.UpdateHook = NotifyMessageUpdates
+	daemon.ReactionHook = NotifyReactions
+	daemon.SignalHook = NotifySignal
 }
 
 func NotifyNewMessage(id uuid.UUID, msg ...types.Message) {
@@ -43,6 +51,56 @@ func NotifyNewMessage(id uuid.UUID, msg ...types.Message) {
 	NotifyObservers(NotificationTypeNewMessage, n)
 }
 
+func NotifyReceipts(id uuid.UUID, receipts map[string]map[string]types.Receipt) {
+	n := struct {
+		RoomID   uuid.UUID                           `json:"uuid"`
+		Receipts map[string]map[string]types.Receipt `json:"receipts"`
+	}{
+		id,
+		receipts,
+	}
+
+	NotifyObservers(NotificationTypeReceipt, n)
+}
+
+func NotifyMessageUpdates(id uuid.UUID, updated []types.MessageInfo, deleted []string) {
+	n := struct {
+		RoomID  uuid.UUID           `json:"uuid"`
+		Updated []types.MessageInfo `json:"updated"`
+		Deleted []string            `json:"deleted"`
+	}{
+		id,
+		updated,
+		deleted,
+	}
+
+	NotifyObservers(NotificationTypeUpdate, n)
+}
+
+func NotifyReactions(id uuid.UUID, reactions map[string]map[string][]string) {
+	n := struct {
+		RoomID    uuid.UUID                      `json:"uuid"`
+		Reactions map[string]map[string][]string `json:"reactions"`
+	}{
+		id,
+		reactions,
+	}
+
+	NotifyObservers(NotificationTypeReaction, n)
+}
+
+func NotifySignal(id uuid.UUID, signal types.Signal) {
+	n := struct {
+		RoomID uuid.UUID    `json:"uuid"`
+		Signal types.Signal `json:"signal"`
+	}{
+		id,
+		signal,
+	}
+
+	NotifyObservers(NotificationTypeSignal, n)
+}
+
 func NotifyNewRoom(info *types.RoomInfo) {
 	NotifyObservers(NotificationTypeNewRoom, info)
 }
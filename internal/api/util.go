@@ -2,11 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/craumix/onionmsg/internal/types"
 )
 
+const (
+	//ReplyToParam is the id of the message that is replied to
+	ReplyToParam = "replyto"
+)
+
 const (
 	//FIX maybe (use appropriate existing headers)
 	//https://datatracker.ietf.org/doc/html/rfc6648
@@ -30,7 +36,14 @@ func sendSerialized(w http.ResponseWriter, v interface{}) {
 	w.Write(raw)
 }
 
-func replyFromHeader(req *http.Request) (*types.Message, error) {
+// replyFromRequest returns a reference to the message that is replied to,
+// the daemon fills in the rest once it looked the message up.
+// Older frontends send the whole message in the ReplyToHeader, of which only the id is used.
+func replyFromRequest(req *http.Request) (*types.ReplyRef, error) {
+	if id := req.FormValue(ReplyToParam); id != "" {
+		return &types.ReplyRef{ID: id}, nil
+	}
+
 	rawReply := req.Header.Get(ReplyToHeader)
 	if rawReply == "" {
 		return nil, nil
@@ -41,6 +54,9 @@ func replyFromHeader(req *http.Request) (*types.Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	if msg.ID == "" {
+		return nil, fmt.Errorf("%s doesn't contain the id of the message", ReplyToHeader)
+	}
 
-	return msg, nil
+	return &types.ReplyRef{ID: msg.ID}, nil
 }
@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/craumix/onionmsg/internal/types"
+	"github.com/craumix/onionmsg/pkg/sio"
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+	"github.com/google/uuid"
+)
+
+var (
+	// maxConns is the number of connections from other daemons that are handled at once, across all listeners
+	maxConns = 128
+	// maxRoomConns is the number of connections that are handled at once for a single room
+	maxRoomConns = 8
+	// peerRate and peerBurst limit how often a single fingerprint may connect
+	peerRate  = time.Second
+	peerBurst = 20
+	// signalRate and signalBurst limit how often a single fingerprint may send signals,
+	// separately from the syncs, so that signals can't delay messages
+	signalRate  = time.Second
+	signalBurst = 5
+
+	// maxRejects is the number of rejected connections that are told about the limit at once,
+	// any further ones are closed right away
+	maxRejects    = 16
+	rejectTimeout = time.Second
+	// maxBuckets is the number of fingerprints a rateLimiter keeps track of
+	maxBuckets = 4096
+
+	connLimit   = sio.NewConnLimit(maxConns)
+	rejectSlots = make(chan struct{}, maxRejects)
+
+	roomConns      = make(map[uuid.UUID]int)
+	roomConnsMutex sync.Mutex
+
+	peerLimiter   = newRateLimiter(peerRate, peerBurst)
+	signalLimiter = newRateLimiter(signalRate, signalBurst)
+)
+
+// rejectConn tells the remote that the daemon is busy, instead of sending the challenge.
+// It is called from the accept loop, so the reply is written in the background,
+// and the connection is closed right away if too many rejects are pending already.
+func rejectConn(c net.Conn) {
+	select {
+	case rejectSlots <- struct{}{}:
+	default:
+		c.Close()
+		log.WithField("remote", c.RemoteAddr()).Debug("closed connection, limit reached")
+		return
+	}
+
+	go func() {
+		defer func() { <-rejectSlots }()
+
+		conn := connection.WrapConnection(c)
+		defer conn.Close()
+		conn.SetTimeout(rejectTimeout)
+
+		raw, _ := json.Marshal(types.NewRejectHello(types.ErrorBusy, "too many connections"))
+		conn.WriteBytes(raw)
+		conn.Flush()
+
+		log.WithField("remote", c.RemoteAddr()).Debug("rejected connection, limit reached")
+	}()
+}
+
+// acquireRoomSlot returns true if another connection for the room may be handled,
+// in which case releaseRoomSlot has to be called once it is done.
+func acquireRoomSlot(id uuid.UUID) bool {
+	roomConnsMutex.Lock()
+	defer roomConnsMutex.Unlock()
+
+	if roomConns[id] >= maxRoomConns {
+		return false
+	}
+
+	roomConns[id]++
+	return true
+}
+
+func releaseRoomSlot(id uuid.UUID) {
+	roomConnsMutex.Lock()
+	defer roomConnsMutex.Unlock()
+
+	roomConns[id]--
+	if roomConns[id] <= 0 {
+		delete(roomConns, id)
+	}
+}
+
+// rateLimiter is a token bucket per key, which refills one token every interval up to burst tokens.
+// At most maxBuckets keys are tracked, further keys are refused until the buckets are swept.
+type rateLimiter struct {
+	interval time.Duration
+	burst    int
+
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(interval time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{
+		interval:  interval,
+		burst:     burst,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of key, and returns false if there is none left
+func (l *rateLimiter) allow(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	full := l.interval * time.Duration(l.burst)
+	if now.Sub(l.lastSweep) >= full || len(l.buckets) >= maxBuckets {
+		l.cleanup(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			return false
+		}
+
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += float64(now.Sub(b.last)) / float64(l.interval)
+	if b.tokens > float64(l.burst) {
+		b.tokens = float64(l.burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// cleanup removes all buckets that are full again, since they are equal to new ones
+func (l *rateLimiter) cleanup(now time.Time) {
+	full := l.interval * time.Duration(l.burst)
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
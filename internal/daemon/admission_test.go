@@ -0,0 +1,34 @@
+package daemon_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/daemon"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := NewRateLimiter(time.Hour, 2)
+
+	assert.True(t, limiter.Allow("a"))
+	assert.True(t, limiter.Allow("a"))
+	assert.False(t, limiter.Allow("a"))
+
+	//Every key has its own bucket
+	assert.True(t, limiter.Allow("b"))
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	defer func(max int) { *MaxBuckets = max }(*MaxBuckets)
+	*MaxBuckets = 2
+
+	limiter := NewRateLimiter(time.Hour, 2)
+	assert.True(t, limiter.Allow("a"))
+	assert.True(t, limiter.Allow("b"))
+
+	//Known keys are still served, new ones are refused until buckets refill
+	assert.False(t, limiter.Allow("c"))
+	assert.True(t, limiter.Allow("a"))
+}
@@ -19,10 +19,12 @@ func contClientHandler(c net.Conn) {
 	dconn := connection.WrapConnection(c)
 	defer dconn.Close()
 
+	types.LimitSession(dconn)
+
 	req := &types.ContactRequest{}
 	err := dconn.ReadStruct(req)
 	if err != nil {
-		log.WithError(err).Debug()
+		logSessionError(err, log.Fields{})
 		return
 	}
 
@@ -32,8 +34,19 @@ func contClientHandler(c net.Conn) {
 		return
 	}
 
+	//The founder is only taken from a founding event that is bound to the room,
+	//the roles follow from the membership log once it is synced
+	var founder string
+	if req.Genesis != nil {
+		founder, err = types.VerifyGenesis(req.ID, *req.Genesis)
+		if err != nil {
+			log.WithError(err).WithField("room", req.ID).Warn("received room request with invalid founding event")
+			return
+		}
+	}
+
 	remoteID, _ := types.NewIdentity(types.Remote, req.LocalFP)
-	remoteID.Meta.Admin = true
+	remoteID.SetRole(types.RoleAdmin)
 
 	convID, _ := types.NewIdentity(types.Self, "")
 
@@ -46,24 +59,60 @@ func contClientHandler(c net.Conn) {
 		Sig:    sig,
 	}
 
+	//Older daemons neither send nor expect a Hello
+	proto := types.LegacyProtocol()
+	if req.Hello != nil {
+		hello := types.NewHello()
+		resp.Hello = &hello
+
+		proto = types.Negotiate(hello, req.Hello)
+		log.WithField("features", proto.Features).Debug("negotiated protocol for contact request")
+	}
+
 	_, err = dconn.WriteStruct(resp)
 	if err != nil {
 		log.WithError(err).Warn()
 		return
 	}
 
-	dconn.Flush()
+	err = dconn.Flush()
+	if err != nil {
+		logSessionError(err, log.Fields{
+			"room": req.ID,
+			"peer": req.LocalFP,
+		})
+		return
+	}
+
+	//Messages are only accepted from members, so everyone
+	//who is already in the room has to be known from the start
+	peers := []*types.MessagingPeer{types.NewMessagingPeer(remoteID)}
+	for _, fp := range req.Members {
+		if fp == req.LocalFP || fp == convID.Fingerprint() {
+			continue
+		}
+
+		memberID, err := types.NewIdentity(types.Remote, fp)
+		if err != nil {
+			log.WithError(err).WithField("room", req.ID).Debug("ignoring invalid member of room request")
+			continue
+		}
+		peers = append(peers, types.NewMessagingPeer(memberID))
+	}
 
 	request := &types.RoomRequest{
 		Room: types.Room{
 			Self:      convID,
-			Peers:     []*types.MessagingPeer{types.NewMessagingPeer(remoteID)},
+			Peers:     peers,
 			ID:        req.ID,
+			Founder:   founder,
+			Genesis:   req.Genesis,
 			SyncState: make(types.SyncMap),
 		},
 		ViaFingerprint: cont.Fingerprint(),
 		ID:             uuid.New(),
 	}
+	request.Room.SetPeerProtocol(req.LocalFP, proto)
 
 	data.Requests = append(data.Requests, request)
 
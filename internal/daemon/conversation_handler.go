@@ -2,10 +2,12 @@ package daemon
 
 import (
 	"crypto/ed25519"
-	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 
 	log "github.com/sirupsen/logrus"
@@ -21,157 +23,587 @@ func convClientHandler(c net.Conn) {
 	conn := connection.WrapConnection(c)
 	defer conn.Close()
 
-	fingerprint, err := readFingerprintWithChallenge(conn)
-	if err != nil {
-		log.WithError(err).Debug()
-		conn.WriteString("auth_failed")
+	types.LimitSession(conn)
+
+	room, fingerprint, proto, ch, ok := authenticatePeer(conn, peerLimiter)
+	if !ok {
 		return
 	}
+	defer releaseRoomSlot(room.ID)
 
-	idRaw, err := conn.ReadBytes()
-	if err != nil {
-		log.WithError(err).Debug()
-		return
+	lf := log.Fields{
+		"room": room.ID,
+		"peer": fingerprint,
 	}
 
-	id, err := uuid.FromBytes(idRaw)
-	if err != nil {
-		log.WithError(err).Debug()
-		conn.WriteString("malformed_uuid")
-		return
+	ch.Send(types.FrameAuthOK, nil)
+	if proto.Supports(types.FeatureSeqSync) {
+		ch.Send(types.FrameSyncState, room.SyncStateCopy())
+	} else {
+		ch.Send(types.FrameSyncState, room.LegacySyncState())
 	}
+	ch.Flush()
 
-	room, ok := GetRoom(id)
-	if !ok {
-		log.WithField("room", id).Debug("unknown room")
-		conn.WriteString("auth_failed")
-		return
+	ch.SetTimeout(types.ConnTimeouts.Messages)
+
+	//Older daemons send all messages in a single batch, which is acknowledged with sync_ok
+	batched := proto.Supports(types.FeatureBatchSync)
+	expected := []types.FrameKind{types.FrameMessages, types.FrameEnvelopes}
+	if batched {
+		expected = append(expected, types.FrameSyncDone)
+	}
+	if batched && proto.Supports(types.FeatureSkippedSeqs) {
+		expected = append(expected, types.FrameSkipped)
 	}
 
-	if _, ok := room.PeerByFingerprint(fingerprint); !ok {
-		df := log.Fields{
-			"peer": fingerprint,
-			"room": id,
+	for {
+		frame, err := ch.Receive(expected...)
+		if err != nil {
+			logSessionError(err, lf)
+			return
 		}
-		log.WithFields(df).Debug("peer is not part of room")
-		conn.WriteString("auth_failed")
-		return
-	}
 
-	conn.WriteString("auth_ok")
-	conn.WriteStruct(room.SyncState)
-	conn.Flush()
+		if frame.Kind == types.FrameSkipped {
+			skipped := make(types.SkippedSeqs)
+			err = frame.Decode(&skipped)
+			if err != nil {
+				logSessionError(err, lf)
+				return
+			}
+
+			room.SkipSeqs(fingerprint, skipped)
+			continue
+		}
 
-	newMsgs := make([]types.Message, 0)
-	conn.ReadStruct(&newMsgs)
+		if frame.Kind == types.FrameSyncDone {
+			ch.Send(types.FrameSyncOK, nil)
+			ch.Flush()
+			return
+		}
+
+		newMsgs, err := receiveBatch(ch, room, fingerprint, proto, frame)
+		if err != nil {
+			//Batches that were already acknowledged are kept,
+			//so the next sync continues after them.
+			logSessionError(err, lf)
+			return
+		}
+
+		if batched {
+			ch.Send(types.FrameBatchOK, nil)
+		} else {
+			ch.Send(types.FrameSyncOK, nil)
+		}
+		ch.Flush()
+
+		handleNewMessages(room, newMsgs)
+
+		if !batched {
+			return
+		}
+	}
+}
+
+// receiveBatch checks the messages contained in frame, receives the blobs they reference,
+// and adds them to the room once everything is complete.
+func receiveBatch(ch types.Channel, room *types.Room, fingerprint string, proto types.Protocol, frame types.Frame) ([]types.Message, error) {
+	newMsgs, err := room.DecodeMessages(fingerprint, frame)
+	if err != nil {
+		ch.SendError(types.ErrorUndecryptable, "")
+		return nil, fmt.Errorf("unable to decode messages: %v", err)
+	}
 
 	for _, msg := range newMsgs {
 		if !msg.SigIsValid() {
 			raw, _ := json.Marshal(msg)
-			log.WithField("message", string(raw)).Debug("signature is not valid")
-			conn.WriteString("message_sig_invalid " + string(raw))
-			return
+			ch.SendError(types.ErrorSignatureInvalid, string(raw))
+			return nil, fmt.Errorf("signature is not valid for message %s", string(raw))
+		}
+
+		//A message signed for another room must not be replayed in this one
+		if !msg.BelongsTo(room.ID) {
+			ch.SendError(types.ErrorSignatureInvalid, msg.ID)
+			return nil, fmt.Errorf("message %s was signed for another room", msg.ID)
 		}
 	}
 
-	conn.WriteString("messages_ok")
-	conn.Flush()
+	ch.Send(types.FrameMessagesOK, nil)
+	ch.Flush()
 
-	err = readBlobs(conn)
+	//The messages are only pushed once all blobs are complete,
+	//so the next sync will offer them again and resume the transfer.
+	ch.SetTimeout(types.ConnTimeouts.Blobs)
+	err = readBlobs(ch, room, newMsgs, proto)
 	if err != nil {
-		log.WithError(err).Debug()
+		return nil, err
 	}
+	ch.SetTimeout(types.ConnTimeouts.Messages)
+
+	added, err := room.AddMessages(newMsgs...)
 
-	room.PushMessages(newMsgs...)
+	var rejected *types.RejectedError
+	if errors.As(err, &rejected) {
+		log.WithError(err).WithField("peer", fingerprint).Info("rejected messages")
+		notifyError(err)
 
-	if len(newMsgs) > 0 {
-		notifyNewMessages(id, newMsgs...)
+		if proto.Supports(types.FeatureRejections) {
+			ch.Send(types.FrameRejected, rejected.Messages)
+		}
 	}
 
-	conn.WriteString("sync_ok")
-	conn.Flush()
+	//Messages that were rejected or already known don't reference their blobs
+	discardBlobs(withoutMessages(newMsgs, added))
+
+	err = acceptBlobs(added)
+	if err != nil {
+		return nil, err
+	}
+
+	return added, nil
 }
 
-func readBlobs(conn connection.ConnWrapper) error {
-	ids := make([]uuid.UUID, 0)
-	conn.ReadStruct(&ids)
+// acceptBlobs references the content of the blobs of the accepted msgs
+func acceptBlobs(msgs []types.Message) error {
+	for _, msg := range msgs {
+		if !msg.ContainsBlob() {
+			continue
+		}
 
-	for _, id := range ids {
-		blockcount, err := conn.ReadInt()
+		err := blobmngr.AcceptBlob(msg.Content.Blob.ID, msg.Content.Blob.Hash)
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// discardBlobs removes the partial blobs of msgs, which weren't added to the room
+func discardBlobs(msgs []types.Message) {
+	for _, msg := range msgs {
+		if msg.ContainsBlob() {
+			blobmngr.DiscardPartial(msg.Content.Blob.ID)
+		}
+	}
+}
+
+// withoutMessages returns all msgs, except those contained in excluded
+func withoutMessages(msgs, excluded []types.Message) []types.Message {
+	ids := make(map[string]struct{}, len(excluded))
+	for _, msg := range excluded {
+		ids[msg.ID] = struct{}{}
+	}
+
+	kept := make([]types.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if _, found := ids[msg.ID]; !found {
+			kept = append(kept, msg)
+		}
+	}
+
+	return kept
+}
+
+// logSessionError logs why the exchange with a peer was aborted
+func logSessionError(err error, lf log.Fields) {
+	if connection.IsTimeout(err) {
+		log.WithError(err).WithFields(lf).Info("peer connection timed out")
+		return
+	}
+
+	log.WithError(err).WithFields(lf).Debug()
+}
+
+// handleNewMessages notifies the frontend about newly received messages, receipts, reactions and revisions,
+// and confirms the delivery of the messages to all peers.
+func handleNewMessages(room *types.Room, msgs []types.Message) {
+	var (
+		chatMsgs     = make([]types.Message, 0)
+		toConfirm    = make([]string, 0)
+		receiptedIDs = make([]string, 0)
+		revisedIDs   = make([]string, 0)
+		reactedIDs   = make([]string, 0)
+	)
+
+	for _, msg := range msgs {
+		switch {
+		case msg.IsReceipt():
+			receiptedIDs = append(receiptedIDs, msg.ReceiptIDs()...)
+		case msg.IsReaction():
+			reactedIDs = append(reactedIDs, msg.Content.Target)
+		case msg.IsAnnotation():
+			revisedIDs = append(revisedIDs, msg.Content.Target)
+		default:
+			chatMsgs = append(chatMsgs, msg)
+		}
+
+		if msg.IsChatMessage() && msg.Meta.Sender != room.Self.Fingerprint() {
+			toConfirm = append(toConfirm, msg.ID)
+		}
+	}
+
+	if len(chatMsgs) > 0 {
+		notifyNewMessages(room.ID, room.DecryptedMessages(chatMsgs...)...)
+	}
+
+	if len(receiptedIDs) > 0 {
+		notifyReceipts(room.ID, room.Receipts(receiptedIDs...))
+	}
+
+	if len(reactedIDs) > 0 {
+		notifyReactions(room.ID, room.Reactions(reactedIDs...))
+	}
+
+	if len(revisedIDs) > 0 {
+		notifyMessageUpdates(room.ID, room.MessageInfosByID(revisedIDs...), room.DeletedIDs(revisedIDs...))
+	}
+
+	room.ConfirmDelivery(toConfirm...)
+}
+
+// readBlobs receives the blobs referenced by msgs in room.
+// If resume is set, the number of bytes that are already present is reported to the sender for every blob,
+// which then only transfers the remaining part.
+func readBlobs(ch types.Channel, room *types.Room, msgs []types.Message, proto types.Protocol) error {
+	ids := make([]uuid.UUID, 0)
+	err := ch.Expect(types.FrameBlobIDs, &ids)
+	if err != nil {
+		return err
+	}
+
+	metas := make(map[uuid.UUID]*types.BlobMeta)
+	for _, msg := range msgs {
+		if !msg.ContainsBlob() {
+			continue
+		}
+
+		//Only blobs of older daemons may lack the hash that their content is verified with
+		blob := msg.Content.Blob
+		if (blob.Hash == nil && !msg.IsLegacy()) || (blob.Hash != nil && len(blob.Hash) != sha256.Size) || blob.Size < 0 {
+			ch.SendError(types.ErrorBlobHashInvalid, blob.ID.String())
+			return fmt.Errorf("blob %s of message %s has an invalid hash or size", blob.ID, msg.ID)
+		}
+		metas[blob.ID] = blob
+	}
+
+	offsets := make([]int64, len(ids))
+	complete := make([]bool, len(ids))
+	for i, id := range ids {
+		if _, ok := metas[id]; !ok {
+			ch.SendError(types.ErrorBlobUnknown, id.String())
+			return fmt.Errorf("blob %s is not referenced by any message", id)
+		}
+
+		//Content that is already stored in this room, e.g. received from another peer,
+		//doesn't have to be transferred again. It is only referenced once the message is accepted.
+		//Content of other rooms is transferred anyway, so that peers can't probe which content is stored.
+		known := room.KnowsBlob(id, metas[id].Hash)
+		if stat, err := blobmngr.StatFromID(id); err == nil && known {
+			offsets[i], complete[i] = stat.Size(), true
+		} else if size, ok := blobmngr.HasContent(metas[id].Hash); metas[id].Hash != nil && ok && known {
+			offsets[i], complete[i] = size, true
+		} else {
+			offsets[i] = blobmngr.PartialSize(id)
+		}
+	}
+
+	if proto.Supports(types.FeatureBlobResume) {
+		ch.Send(types.FrameBlobOffsets, offsets)
+		ch.Flush()
+	} else {
+		//Older daemons always send the complete blobs
+		for i, id := range ids {
+			offsets[i] = 0
+			err = blobmngr.DiscardPartial(id)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-		file, err := blobmngr.FileFromID(id)
+	for i, id := range ids {
+		err = readBlob(ch, metas[id], offsets[i], complete[i], proto.Supports(types.FeatureBlobStream))
 		if err != nil {
 			return err
 		}
+	}
 
-		rcvOK := false
-		defer func() {
-			file.Close()
-			if !rcvOK {
-				blobmngr.RemoveBlob(id)
-			}
-		}()
+	return nil
+}
+
+// readBlob receives the blob from offset on, either as a single stream or in blocks that are acknowledged one by one.
+// Neither may exceed the size declared in the signed BlobMeta.
+func readBlob(ch types.Channel, meta *types.BlobMeta, offset int64, complete, stream bool) error {
+	var blockcount int
+	err := ch.Expect(types.FrameBlockCount, &blockcount)
+	if err != nil {
+		return err
+	}
 
-		for i := 0; i < blockcount; i++ {
-			buf, err := conn.ReadBytes()
+	//The remote must not send more than the size declared in the signed BlobMeta
+	remaining := int64(meta.Size) - offset
+	if remaining < 0 || blockcount < 0 || blockcount > types.BlockCount(remaining) {
+		ch.SendError(types.ErrorBlobHashInvalid, meta.ID.String())
+		return fmt.Errorf("%d blocks exceed the size of blob %s", blockcount, meta.ID)
+	}
+
+	if complete {
+		//Blob is already complete, older daemons still send it again
+		if stream && blockcount > 0 {
+			err = ch.ReceiveStream(io.Discard, remaining)
 			if err != nil {
 				return err
 			}
+		}
 
-			_, err = file.Write(buf)
+		for i := 0; i < blockcount && !stream; i++ {
+			err = ch.Expect(types.FrameBlock, nil)
 			if err != nil {
 				return err
 			}
 
-			conn.WriteString("block_ok")
-			conn.Flush()
+			ch.Send(types.FrameBlockOK, nil)
+			ch.Flush()
+		}
+
+		ch.Send(types.FrameBlobOK, nil)
+		ch.Flush()
+		return nil
+	}
+
+	file, err := blobmngr.PartialFileFromID(meta.ID)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if stream && blockcount > 0 {
+		//Everything received so far is kept, so that an interrupted stream is resumed as well
+		err = ch.ReceiveStream(file, remaining)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < blockcount && !stream; i++ {
+		var buf []byte
+		err = ch.Expect(types.FrameBlock, &buf)
+		if err != nil {
+			return err
+		}
+
+		if int64(len(buf)) > remaining || len(buf) > types.BlockSize {
+			ch.SendError(types.ErrorBlobHashInvalid, meta.ID.String())
+			return fmt.Errorf("block exceeds the size of blob %s", meta.ID)
+		}
+		remaining -= int64(len(buf))
+
+		_, err = file.Write(buf)
+		if err != nil {
+			return err
 		}
 
-		conn.WriteString("blob_ok")
-		conn.Flush()
+		ch.Send(types.FrameBlockOK, nil)
+		ch.Flush()
+	}
 
-		rcvOK = true
+	file.Close()
+
+	err = blobmngr.VerifyPartial(meta.ID, meta.Hash)
+	if err != nil {
+		ch.SendError(types.ErrorBlobHashInvalid, meta.ID.String())
+		return err
 	}
 
+	ch.Send(types.FrameBlobOK, nil)
+	ch.Flush()
+
+	lf := log.Fields{
+		"blob":   meta.ID.String(),
+		"offset": offset,
+	}
+	log.WithFields(lf).Debug("received blob")
+
 	return nil
 }
 
-func writeRandom(dconn connection.ConnWrapper, length int) ([]byte, error) {
-	r := make([]byte, length)
-	rand.Read(r)
-	_, err := dconn.WriteBytes(r)
+// authenticatePeer lets the remote prove the ownership of its fingerprint,
+// and checks that it is a peer in the room it addressed.
+// If both sides support it, Self proves its identity in the room to the remote as well.
+// If the authentication fails or the remote exceeds its limits, e.g. of limiter, it is notified and false is returned.
+// Otherwise the Channel for the rest of the exchange is returned,
+// and the caller has to call releaseRoomSlot for the room once it is done.
+func authenticatePeer(conn connection.ConnWrapper, limiter *rateLimiter) (*types.Room, string, types.Protocol, types.Channel, bool) {
+	own := types.NewHello()
+	challenge, _ := json.Marshal(own)
+
+	conn.WriteBytes(challenge)
+	conn.Flush()
+
+	fingerprint, clientHello, proto, err := readFingerprint(conn, own)
+	ch := types.NewChannel(conn, proto)
 	if err != nil {
-		return nil, err
+		logSessionError(err, log.Fields{})
+		ch.SendError(types.ErrorAuthFailed, "")
+		return nil, "", types.Protocol{}, nil, false
 	}
-	dconn.Flush()
 
-	return r, nil
-}
+	mutual := proto.Supports(types.FeatureMutualAuth)
+
+	var (
+		id  uuid.UUID
+		sig []byte
+	)
+	if mutual {
+		//The room is part of the transcript, so it's sent before the signature
+		idRaw, err := conn.ReadBytes()
+		if err == nil {
+			sig, err = conn.ReadBytes()
+		}
+		if err != nil {
+			logSessionError(err, log.Fields{"peer": fingerprint})
+			return nil, "", types.Protocol{}, nil, false
+		}
 
-func readFingerprintWithChallenge(conn connection.ConnWrapper) (string, error) {
-	challenge, _ := writeRandom(conn, 32)
+		id, err = uuid.FromBytes(idRaw)
+		if err != nil {
+			log.WithError(err).Debug()
+			ch.SendError(types.ErrorMalformedRoomID, "")
+			return nil, "", types.Protocol{}, nil, false
+		}
+	} else {
+		sig, err = conn.ReadBytes()
+		if err != nil {
+			logSessionError(err, log.Fields{"peer": fingerprint})
+			return nil, "", types.Protocol{}, nil, false
+		}
 
-	fingerprint, err := conn.ReadString()
+		err = verifyFingerprint(fingerprint, challenge, sig)
+		if err != nil {
+			log.WithError(err).Debug()
+			ch.SendError(types.ErrorAuthFailed, "")
+			return nil, "", types.Protocol{}, nil, false
+		}
+
+		frame, err := ch.Receive(types.FrameRoomID)
+		if err != nil {
+			logSessionError(err, log.Fields{"peer": fingerprint})
+			return nil, "", types.Protocol{}, nil, false
+		}
+
+		err = frame.Decode(&id)
+		if err != nil {
+			log.WithError(err).Debug()
+			ch.SendError(types.ErrorMalformedRoomID, "")
+			return nil, "", types.Protocol{}, nil, false
+		}
+	}
+
+	room, ok := GetRoom(id)
+	if !ok {
+		log.WithField("room", id).Debug("unknown room")
+		ch.SendError(types.ErrorAuthFailed, "")
+		return nil, "", types.Protocol{}, nil, false
+	}
+
+	if mutual {
+		transcript := types.HandshakeTranscript(types.HandshakeClient, challenge, clientHello, id, fingerprint, room.Self.Fingerprint())
+		err = verifyFingerprint(fingerprint, transcript, sig)
+		if err != nil {
+			log.WithError(err).Debug()
+			ch.SendError(types.ErrorAuthFailed, "")
+			return nil, "", types.Protocol{}, nil, false
+		}
+	}
+
+	if room.IsBanned(fingerprint) {
+		log.WithFields(log.Fields{"peer": fingerprint, "room": id}).Debug("peer is banned from room")
+		ch.SendError(types.ErrorAuthFailed, "")
+		return nil, "", types.Protocol{}, nil, false
+	}
+
+	if _, ok := room.PeerByFingerprint(fingerprint); !ok {
+		df := log.Fields{
+			"peer": fingerprint,
+			"room": id,
+		}
+		log.WithFields(df).Debug("peer is not part of room")
+		ch.SendError(types.ErrorAuthFailed, "")
+		return nil, "", types.Protocol{}, nil, false
+	}
+
+	//Only members are limited, so nobody can use up the limit of someone else
+	//or fill the limiter with made up fingerprints
+	if !limiter.allow(fingerprint) {
+		log.WithField("peer", fingerprint).Debug("peer exceeded connection rate")
+		ch.SendError(types.ErrorRateLimited, "")
+		return nil, "", types.Protocol{}, nil, false
+	}
+
+	if !acquireRoomSlot(id) {
+		log.WithField("room", id).Debug("too many connections for room")
+		ch.SendError(types.ErrorBusy, "too many connections for room")
+		return nil, "", types.Protocol{}, nil, false
+	}
+
+	if mutual {
+		transcript := types.HandshakeTranscript(types.HandshakeServer, challenge, clientHello, id, fingerprint, room.Self.Fingerprint())
+		serverSig, err := room.Self.Sign(transcript)
+		if err != nil {
+			releaseRoomSlot(id)
+			log.WithError(err).Warn()
+			ch.SendError(types.ErrorInternal, "")
+			return nil, "", types.Protocol{}, nil, false
+		}
+
+		//Flushed together with the response of the caller
+		ch.Send(types.FrameServerAuth, serverSig)
+	}
+
+	room.SetPeerProtocol(fingerprint, proto)
+
+	return room, fingerprint, proto, ch, true
+}
+
+// readFingerprint reads the fingerprint the remote claims to own in response to the own Hello.
+// Newer daemons reply with their Hello before the fingerprint, which is returned as it was sent.
+// The negotiated Protocol is also returned on failure, so that the failure can be reported.
+func readFingerprint(conn connection.ConnWrapper, own types.Hello) (string, []byte, types.Protocol, error) {
+	first, err := conn.ReadBytes()
 	if err != nil {
-		return "", err
+		return "", nil, types.LegacyProtocol(), err
 	}
-	sig, err := conn.ReadBytes()
+
+	hello, ok := types.ParseHello(first)
+	if !ok {
+		//Older daemons start with the fingerprint
+		return string(first), nil, types.LegacyProtocol(), nil
+	}
+
+	proto := types.Negotiate(own, &hello)
+
+	fingerprint, err := conn.ReadString()
 	if err != nil {
-		return "", err
+		return "", nil, proto, err
 	}
 
+	return fingerprint, first, proto, nil
+}
+
+// verifyFingerprint checks that sig is a valid signature of data by the owner of the fingerprint
+func verifyFingerprint(fingerprint string, data, sig []byte) error {
 	keyBytes, err := base64.RawURLEncoding.DecodeString(fingerprint)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	key := ed25519.PublicKey(keyBytes)
-	if !ed25519.Verify(key, challenge, sig) {
-		return "", fmt.Errorf("remote failed challenge")
+	if len(keyBytes) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid length for public key, %d instead of %d", len(keyBytes), ed25519.PublicKeySize)
 	}
 
-	return fingerprint, nil
+	if !ed25519.Verify(ed25519.PublicKey(keyBytes), data, sig) {
+		return fmt.Errorf("remote failed challenge")
+	}
+
+	return nil
 }
@@ -0,0 +1,129 @@
+package daemon_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/daemon"
+	"github.com/craumix/onionmsg/internal/types"
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+)
+
+var (
+	batchSync = types.Protocol{Features: map[string]bool{
+		types.FeatureFrames:    true,
+		types.FeatureBatchSync: true,
+	}}
+)
+
+func TestMain(m *testing.M) {
+	//The message queues of the rooms fail instead of dialing
+	connection.GetConnFunc = func(network, address string) (connection.ConnWrapper, error) {
+		return nil, fmt.Errorf("no network in tests")
+	}
+
+	os.Exit(m.Run())
+}
+
+// syncRoom creates a room with a peer, and the messages it sent
+func syncRoom(t *testing.T, count int) (*types.Room, types.Identity, []types.Message) {
+	room, _ := types.NewRoom(context.Background())
+	t.Cleanup(room.StopQueues)
+
+	sender, _ := types.NewIdentity(types.Self, "")
+	remote, _ := types.NewIdentity(types.Remote, sender.Fingerprint())
+	room.Peers = append(room.Peers, types.NewMessagingPeer(remote))
+
+	msgs := make([]types.Message, count)
+	for i := range msgs {
+		content := types.MessageContent{Type: types.ContentTypeText, Data: []byte(fmt.Sprint(i))}
+		msgs[i] = types.NewMessage(content, sender, uint64(i+1))
+	}
+
+	return room, sender, msgs
+}
+
+// sendBatch sends a batch without blobs like the remote queue does, and stops early if interrupted is set
+func sendBatch(ch types.Channel, batch []types.Message, interrupted bool) {
+	ch.Send(types.FrameMessages, batch)
+	ch.Flush()
+
+	if ch.Expect(types.FrameMessagesOK, nil) != nil || interrupted {
+		return
+	}
+
+	ch.Send(types.FrameBlobIDs, []uuid.UUID{})
+	ch.Flush()
+}
+
+// receiveBatches receives the batches on a new connection, of which the last one is interrupted if interrupted is set
+func receiveBatches(room *types.Room, sender types.Identity, batches [][]types.Message, interrupted bool) error {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	remote := types.NewChannel(connection.WrapConnection(a), batchSync)
+	local := types.NewChannel(connection.WrapConnection(b), batchSync)
+
+	go func() {
+		for i, batch := range batches {
+			last := i == len(batches)-1
+			sendBatch(remote, batch, interrupted && last)
+			if interrupted && last {
+				a.Close()
+			}
+		}
+	}()
+
+	for range batches {
+		frame, err := local.Receive(types.FrameMessages)
+		if err != nil {
+			return err
+		}
+
+		_, err = ReceiveBatch(local, room, sender.Fingerprint(), batchSync, frame)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestReceiveBatchOrder(t *testing.T) {
+	room, sender, msgs := syncRoom(t, 6)
+
+	assert.NoError(t, receiveBatches(room, sender, [][]types.Message{msgs[:3], msgs[3:]}, false))
+
+	assert.Equal(t, uint64(6), room.SyncState[sender.Fingerprint()])
+	for i, msg := range room.Messages {
+		assert.Equal(t, msgs[i].ID, msg.ID)
+	}
+}
+
+func TestReceiveBatchInterrupted(t *testing.T) {
+	room, sender, msgs := syncRoom(t, 6)
+
+	//The first batch is acknowledged, the second one is interrupted before it is complete
+	err := receiveBatches(room, sender, [][]types.Message{msgs[:2], msgs[2:4]}, true)
+	assert.Error(t, err)
+	assert.Len(t, room.Messages, 2)
+	assert.Equal(t, uint64(2), room.SyncState[sender.Fingerprint()])
+
+	//The next sync continues after the last acknowledged batch
+	var resumed []types.Message
+	for _, msg := range msgs {
+		if msg.Meta.Seq > room.SyncState[sender.Fingerprint()] {
+			resumed = append(resumed, msg)
+		}
+	}
+	assert.NoError(t, receiveBatches(room, sender, [][]types.Message{resumed}, false))
+
+	assert.Len(t, room.Messages, len(msgs))
+	assert.Equal(t, uint64(len(msgs)), room.SyncState[sender.Fingerprint()])
+}
@@ -2,9 +2,11 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -28,6 +30,8 @@ type Config struct {
 	BaseDir, TorBinary                      string
 	PortOffset                              int
 	UseControlPass, AutoAccept, Interactive bool
+	// Timeouts for connections to other daemons, unset ones keep their default
+	Timeouts types.Timeouts
 }
 
 var (
@@ -35,6 +39,8 @@ var (
 	controlPort = 10049
 	loContPort  = 10050
 	loConvPort  = 10051
+	//10052 is used by the API
+	loSignalPort = 10053
 
 	torrc    = "torrc"
 	tordir   = "cache/tor"
@@ -44,6 +50,13 @@ var (
 	loadFuse bool
 
 	data = SerializableData{}
+	// roomsMutex guards data.Rooms, which is changed while frontends and peers look up rooms
+	roomsMutex sync.RWMutex
+
+	// ErrRoomNotFound is returned if no room has the requested id
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrBlobNotFound is returned if a blob isn't referenced by the room it was requested for, or by any room
+	ErrBlobNotFound = errors.New("blob not found")
 
 	torInstance *tor.Instance
 
@@ -74,6 +87,8 @@ func StartDaemon(conf Config) {
 
 	parseParams(conf.BaseDir, conf.PortOffset)
 
+	types.SetTimeouts(conf.Timeouts)
+
 	initBlobManager()
 
 	startTor(conf.UseControlPass, conf.TorBinary)
@@ -105,6 +120,7 @@ func parseParams(baseDir string, portOffset int) {
 	controlPort += portOffset
 	loContPort += portOffset
 	loConvPort += portOffset
+	loSignalPort += portOffset
 
 	torrc = filepath.Join(baseDir, torrc)
 	tordir = filepath.Join(baseDir, tordir)
@@ -161,6 +177,7 @@ func loadData() {
 	for _, room := range data.Rooms {
 		// TODO derive this from an actual context
 		room.SetContext(context.Background())
+		room.RebuildState()
 	}
 	loadFuse = true
 }
@@ -182,16 +199,19 @@ func initHiddenServices() {
 func startConnectionHandlers(autoAccept bool) {
 	autoAcceptRequests = autoAccept
 
-	go sio.StartLocalServer(loContPort, contClientHandler, func(err error) {
+	go sio.StartLimitedLocalServer(loContPort, connLimit, contClientHandler, rejectConn, func(err error) {
 		log.WithError(err).Debug("error starting contact handler")
 	})
-	go sio.StartLocalServer(loConvPort, convClientHandler, func(err error) {
+	go sio.StartLimitedLocalServer(loConvPort, connLimit, convClientHandler, rejectConn, func(err error) {
 		log.WithError(err).Debug("error starting conversation handler")
 	})
+	go sio.StartLimitedLocalServer(loSignalPort, connLimit, sigClientHandler, rejectConn, func(err error) {
+		log.WithError(err).Debug("error starting signal handler")
+	})
 }
 
 func startSignalHandler() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -217,5 +237,8 @@ func exitDaemon() {
 }
 
 func saveData() error {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
 	return sio.SaveDataCompressed(datafile, &data)
 }
@@ -0,0 +1,13 @@
+package daemon
+
+// The steps of the message sync are exported for the tests in daemon_test
+var (
+	ReceiveBatch = receiveBatch
+
+	NewRateLimiter = newRateLimiter
+	MaxBuckets     = &maxBuckets
+)
+
+func (l *rateLimiter) Allow(key string) bool {
+	return l.allow(key)
+}
@@ -10,6 +10,10 @@ var (
 	NewRoomHook    func(info *types.RoomInfo)
 	ErrorHook      func(error)
 	NewRequestHook func(*types.RoomRequest)
+	ReceiptHook    func(uuid.UUID, map[string]map[string]types.Receipt)
+	UpdateHook     func(uuid.UUID, []types.MessageInfo, []string)
+	ReactionHook   func(uuid.UUID, map[string]map[string][]string)
+	SignalHook     func(uuid.UUID, types.Signal)
 )
 
 func notifyNewMessages(id uuid.UUID, msgs ...types.Message) {
@@ -25,7 +29,7 @@ func notifyNewRoom(info *types.RoomInfo) {
 }
 
 func notifyError(err error) {
-	if NewMessageHook != nil {
+	if ErrorHook != nil {
 		go ErrorHook(err)
 	}
 }
@@ -35,3 +39,27 @@ func notifyNewRequest(req *types.RoomRequest) {
 		go NewRequestHook(req)
 	}
 }
+
+func notifyReceipts(id uuid.UUID, receipts map[string]map[string]types.Receipt) {
+	if ReceiptHook != nil {
+		go ReceiptHook(id, receipts)
+	}
+}
+
+func notifyMessageUpdates(id uuid.UUID, updated []types.MessageInfo, deleted []string) {
+	if UpdateHook != nil {
+		go UpdateHook(id, updated, deleted)
+	}
+}
+
+func notifyReactions(id uuid.UUID, reactions map[string]map[string][]string) {
+	if ReactionHook != nil {
+		go ReactionHook(id, reactions)
+	}
+}
+
+func notifySignal(id uuid.UUID, signal types.Signal) {
+	if SignalHook != nil {
+		go SignalHook(id, signal)
+	}
+}
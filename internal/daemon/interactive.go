@@ -144,7 +144,7 @@ func startInteractive() {
 				continue
 			}
 
-			for _, msg := range room.Messages {
+			for _, msg := range room.DecryptedMessages(room.Messages...) {
 				log.Printf("From %s, at %s\n", msg.Meta.Sender, msg.Meta.Time)
 				log.Printf("Type %s, Content \"%s\"\n", msg.Content.Type, string(msg.Content.Data))
 			}
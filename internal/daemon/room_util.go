@@ -17,6 +17,18 @@ func initRooms() (err error) {
 
 	for _, room := range data.Rooms {
 		room.RunMessageQueueForAllPeers()
+
+		room.AnnounceRatchet()
+
+		//Rooms that were left before the daemon stopped are deleted once a peer acknowledged it
+		if room.Leaving {
+			var acknowledged <-chan struct{}
+			acknowledged, err = room.Leave()
+			if err != nil {
+				return
+			}
+			go deregisterWhenLeft(room, acknowledged)
+		}
 	}
 
 	return
@@ -28,16 +40,23 @@ func registerRoom(room *types.Room) error {
 		return err
 	}
 
+	roomsMutex.Lock()
 	data.Rooms = append(data.Rooms, room)
+	roomsMutex.Unlock()
 	log.WithField("room", room.ID.String()).Info("registered room")
 
+	room.AnnounceRatchet()
+
 	notifyNewRoom(room.Info())
 
 	return nil
 }
 
 func serveConvIDService(i types.Identity) error {
-	return torInstance.RegisterService(*i.Priv, types.PubConvPort, loConvPort)
+	return torInstance.RegisterServicePorts(*i.Priv, map[int]int{
+		types.PubConvPort:   loConvPort,
+		types.PubSignalPort: loSignalPort,
+	})
 }
 
 func deregisterRoom(id uuid.UUID) error {
@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/craumix/onionmsg/internal/types"
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+)
+
+// sigClientHandler receives ephemeral signals from peers and passes them on to the frontend.
+// Signals are never stored, so nothing is added to the Room.
+func sigClientHandler(c net.Conn) {
+	conn := connection.WrapConnection(c)
+	defer conn.Close()
+
+	types.LimitSession(conn)
+
+	room, fingerprint, _, ch, ok := authenticatePeer(conn, signalLimiter)
+	if !ok {
+		return
+	}
+	defer releaseRoomSlot(room.ID)
+
+	ch.Send(types.FrameAuthOK, nil)
+	ch.Flush()
+
+	ch.SetTimeout(types.ConnTimeouts.Messages)
+
+	signal := types.Signal{}
+	err := ch.Expect(types.FrameSignal, &signal)
+	if err != nil {
+		logSessionError(err, log.Fields{
+			"room": room.ID,
+			"peer": fingerprint,
+		})
+		return
+	}
+
+	if !signal.IsValid() {
+		ch.SendError(types.ErrorSignalInvalid, string(signal.Type))
+		return
+	}
+
+	//The sender was authenticated by the challenge, so the claimed one is ignored
+	signal.Sender = fingerprint
+
+	ch.Send(types.FrameSignalOK, nil)
+	ch.Flush()
+
+	notifySignal(room.ID, signal)
+}
@@ -2,10 +2,15 @@ package daemon
 
 import (
 	"context"
+	"crypto/cipher"
 	"fmt"
+	"io"
 	"strings"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/craumix/onionmsg/internal/types"
+	"github.com/craumix/onionmsg/pkg/blobmngr"
 	"github.com/google/uuid"
 )
 
@@ -23,7 +28,14 @@ var (
 	AddPeerToRoom = addPeerToRoom
 	ListMessages  = listMessages
 
-	SendMessage = sendMessage
+	SendMessage   = sendMessage
+	MarkRead      = markRead
+	EditMessage   = editMessage
+	DeleteMessage = deleteMessage
+	React         = react
+	Unreact       = unreact
+	SendSignal    = sendSignal
+	StreamBlob    = streamBlob
 
 	RequestList       = requestList
 	AcceptRoomRequest = acceptRoomRequest
@@ -71,6 +83,9 @@ func listContactIDs() []string {
 
 // listRooms returns a marshaled list of all the rooms with most information
 func listRooms() []*types.RoomInfo {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
 	var rooms []*types.RoomInfo
 	for _, r := range data.Rooms {
 		rooms = append(rooms, r.Info())
@@ -80,6 +95,9 @@ func listRooms() []*types.RoomInfo {
 }
 
 func roomInfo(id uuid.UUID) (*types.RoomInfo, error) {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
 	for _, r := range data.Rooms {
 		if r.ID == id {
 			return r.Info(), nil
@@ -139,13 +157,48 @@ func addPeerToRoom(roomID uuid.UUID, fingerprint string) error {
 	return room.AddPeers(id)
 }
 
-// deleteRoom deletes the room with the specified uuid.
-func deleteRoom(uid string) error {
+// deleteRoom leaves the room with the specified uuid and deletes it.
+// The room is only deleted once a peer acknowledged leaving it,
+// since the other peers would otherwise keep trying to sync with its onion service.
+// Until then it is marked as leaving, and deregistered in the background.
+// If force is set, the room is deleted right away, e.g. if none of its peers is reachable anymore.
+func deleteRoom(uid string, force bool) error {
 	id, err := uuid.Parse(uid)
 	if err != nil {
 		return err
 	}
-	return deregisterRoom(id)
+
+	room, ok := GetRoom(id)
+	if !ok {
+		return nil
+	}
+
+	if force {
+		return deregisterRoom(id)
+	}
+
+	acknowledged, err := room.Leave()
+	if err != nil {
+		return err
+	}
+
+	go deregisterWhenLeft(room, acknowledged)
+	return nil
+}
+
+// deregisterWhenLeft deregisters room once a peer acknowledged that Self left it.
+// It stops waiting if the room was deregistered in the meantime.
+func deregisterWhenLeft(room *types.Room, acknowledged <-chan struct{}) {
+	select {
+	case <-acknowledged:
+	case <-room.Ctx.Done():
+		return
+	}
+
+	err := deregisterRoom(room.ID)
+	if err != nil {
+		log.WithError(err).WithField("room", room.ID.String()).Warn("unable to deregister room")
+	}
 }
 
 func sendMessage(uid string, content types.MessageContent) error {
@@ -159,11 +212,36 @@ func sendMessage(uid string, content types.MessageContent) error {
 		return fmt.Errorf("no such room: %s", uid)
 	}
 
+	err = room.CheckPermission(content)
+	if err != nil {
+		return err
+	}
+
+	//Frontends only specify the id of the message that is replied to
+	if content.Reply != nil {
+		content.Reply, err = room.NewReplyRef(content.Reply.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if content.Blob != nil {
+		content.Key, err = room.EncryptBlob(content.Blob)
+		if err != nil {
+			return err
+		}
+
+		content.Blob.Hash, err = blobmngr.CommitBlob(content.Blob.ID)
+		if err != nil {
+			return err
+		}
+	}
+
 	room.SendMessageToAllPeers(content)
 	return nil
 }
 
-func listMessages(uid string, count int) ([]types.Message, error) {
+func listMessages(uid string, count int) ([]types.MessageInfo, error) {
 	id, err := uuid.Parse(uid)
 	if err != nil {
 		return nil, err
@@ -174,14 +252,140 @@ func listMessages(uid string, count int) ([]types.Message, error) {
 		return nil, fmt.Errorf("no such room: %s", uid)
 	}
 
-	if count > 0 && count < len(room.Messages) {
-		return room.Messages[len(room.Messages)-count:], nil
+	infos := room.MessageInfos()
+	if count > 0 && count < len(infos) {
+		return infos[len(infos)-count:], nil
 	} else {
-		return room.Messages, nil
+		return infos, nil
 	}
 }
 
+// markRead sends a read receipt for the messages with the specified ids to all peers
+func markRead(uid string, ids []string) error {
+	id, err := uuid.Parse(uid)
+	if err != nil {
+		return err
+	}
+
+	room, ok := GetRoom(id)
+	if !ok {
+		return fmt.Errorf("no such room: %s", uid)
+	}
+
+	room.SendMessageToAllPeers(types.NewReceiptContent(types.ReceiptRead, ids...))
+	return nil
+}
+
+func editMessage(uid, msgID string, data []byte) error {
+	id, err := uuid.Parse(uid)
+	if err != nil {
+		return err
+	}
+
+	room, ok := GetRoom(id)
+	if !ok {
+		return fmt.Errorf("no such room: %s", uid)
+	}
+
+	return room.EditMessage(msgID, data)
+}
+
+func deleteMessage(uid, msgID string) error {
+	id, err := uuid.Parse(uid)
+	if err != nil {
+		return err
+	}
+
+	room, ok := GetRoom(id)
+	if !ok {
+		return fmt.Errorf("no such room: %s", uid)
+	}
+
+	return room.DeleteMessage(msgID)
+}
+
+func react(uid, msgID, emoji string) error {
+	id, err := uuid.Parse(uid)
+	if err != nil {
+		return err
+	}
+
+	room, ok := GetRoom(id)
+	if !ok {
+		return fmt.Errorf("no such room: %s", uid)
+	}
+
+	return room.React(msgID, emoji)
+}
+
+func unreact(uid, msgID, emoji string) error {
+	id, err := uuid.Parse(uid)
+	if err != nil {
+		return err
+	}
+
+	room, ok := GetRoom(id)
+	if !ok {
+		return fmt.Errorf("no such room: %s", uid)
+	}
+
+	return room.Unreact(msgID, emoji)
+}
+
+// sendSignal sends a signal to the peers of the room with the specified id.
+// ErrRoomNotFound is returned if there is no such room.
+func sendSignal(uid string, sType types.SignalType) error {
+	id, err := uuid.Parse(uid)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRoomNotFound, err)
+	}
+
+	room, ok := GetRoom(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrRoomNotFound, uid)
+	}
+
+	return room.SendSignal(sType)
+}
+
+// streamBlob writes the content of the blob with the specified id to w,
+// and decrypts it with the key of the room the frontend requested it for.
+// Older frontends don't specify the room, which is uuid.Nil then,
+// in that case the blob is decrypted with the key of the first room that references it.
+// ErrBlobNotFound is returned if no message of the room references the blob.
+func streamBlob(roomID, id uuid.UUID, w io.Writer) error {
+	var rooms []*types.Room
+	if roomID == uuid.Nil {
+		roomsMutex.RLock()
+		rooms = append(rooms, data.Rooms...)
+		roomsMutex.RUnlock()
+	} else if room, ok := GetRoom(roomID); ok {
+		rooms = append(rooms, room)
+	}
+
+	for _, room := range rooms {
+		stream, found, err := room.BlobStream(id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+
+		if stream != nil {
+			w = cipher.StreamWriter{S: stream, W: w}
+		}
+
+		return blobmngr.StreamTo(id, w)
+	}
+
+	return ErrBlobNotFound
+}
+
 func GetRoom(id uuid.UUID) (*types.Room, bool) {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
 	for _, r := range data.Rooms {
 		if r.ID == id {
 			return r, true
@@ -200,6 +404,9 @@ func GetContactID(fingerprint string) (types.Identity, bool) {
 }
 
 func deleteRoomFromSlice(item *types.Room) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
 	for j, e := range data.Rooms {
 		if e == item {
 			data.Rooms[len(data.Rooms)-1], data.Rooms[j] = data.Rooms[j], data.Rooms[len(data.Rooms)-1]
@@ -238,10 +445,8 @@ func acceptRoomRequest(id uuid.UUID) error {
 
 			v.Room.RunMessageQueueForAllPeers()
 
-			v.Room.SendMessageToAllPeers(types.MessageContent{
-				Type: types.ContentTypeCmd,
-				Data: types.ConstructCommand(nil, types.RoomCommandAccept),
-			})
+			content, _ := types.NewCommandContent(types.RoomCommandAccept, nil)
+			v.Room.SendMessageToAllPeers(content)
 
 			deleteRoomRequest(id)
 			return nil
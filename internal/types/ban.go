@@ -0,0 +1,113 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// banList contains the fingerprints that may not be invited to a Room,
+// it is rebuilt from the membership log together with the roster.
+// Since every invitation creates a new room identity, banning a member
+// also bans the contact identity they were invited through, if it is known.
+type banList struct {
+	banned map[string]struct{}
+	//contacts maps members to the contact identity they were invited through
+	contacts map[string]string
+	//room is the id of the Room, which the signatures of the contact identities cover
+	room uuid.UUID
+}
+
+func newBanList(room uuid.UUID) banList {
+	return banList{
+		banned:   make(map[string]struct{}),
+		contacts: make(map[string]string),
+		room:     room,
+	}
+}
+
+// invite adds the invited peer to the roster, unless it or its contact identity is banned.
+// The contact identity is only recorded if it signed the room identity, see InviteArgs.verifyContact,
+// so the inviter can't name another one. Once anyone is banned, every invite has to name its contact,
+// otherwise a banned peer could be invited again with a new room identity.
+func (bans banList) invite(members roster, args *InviteArgs) error {
+	if bans.isBanned(args.Fingerprint) || bans.isBanned(args.Contact) {
+		return fmt.Errorf("%s is banned", args.Fingerprint)
+	}
+
+	if args.Contact == "" && len(bans.banned) > 0 {
+		return fmt.Errorf("invite of %s doesn't name its contact identity, while peers are banned", args.Fingerprint)
+	}
+	if err := args.verifyContact(bans.room); err != nil {
+		return err
+	}
+
+	if _, found := members[args.Fingerprint]; !found {
+		members[args.Fingerprint] = RoleMember
+	}
+	if args.Contact != "" {
+		bans.contacts[args.Fingerprint] = args.Contact
+	}
+
+	return nil
+}
+
+// apply changes the ban list according to a ban or unban of target.
+// Banned members are removed, which follows the same rules as removing them.
+func (bans banList) apply(members roster, senderRole Role, command Command, target string) error {
+	contact, hasContact := bans.contacts[target]
+
+	if command == RoomCommandUnban {
+		delete(bans.banned, target)
+		if hasContact {
+			delete(bans.banned, contact)
+		}
+		return nil
+	}
+
+	if _, found := members[target]; found {
+		if !members.mayManage(senderRole, target) {
+			return fmt.Errorf("%s may not ban %s", senderRole, target)
+		}
+		delete(members, target)
+	}
+	bans.banned[target] = struct{}{}
+	if hasContact {
+		bans.banned[contact] = struct{}{}
+	}
+
+	return nil
+}
+
+func (bans banList) isBanned(fingerprint string) bool {
+	_, banned := bans.banned[fingerprint]
+	return fingerprint != "" && banned
+}
+
+// IsBanned returns true if the peer or contact identity with the specified fingerprint was banned from the Room
+func (r *Room) IsBanned(fingerprint string) bool {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+
+	return r.isBanned(fingerprint)
+}
+
+func (r *Room) isBanned(fingerprint string) bool {
+	return r.bans.isBanned(fingerprint)
+}
+
+// bannedPeers returns the banned fingerprints in a stable order
+func (r *Room) bannedPeers() []string {
+	banned := make([]string, 0, len(r.bans.banned))
+	for fingerprint := range r.bans.banned {
+		banned = append(banned, fingerprint)
+	}
+	sort.Strings(banned)
+
+	return banned
+}
@@ -0,0 +1,125 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+)
+
+func TestBanRemovesMember(t *testing.T) {
+	room, x := setupRoleTests(t)
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandBan, x.Fingerprint()))
+
+	assert.Empty(t, room.Peers)
+	assert.True(t, room.IsBanned(x.Fingerprint()))
+	assert.Equal(t, []string{x.Fingerprint()}, room.Info().Banned)
+}
+
+func TestBanPreventsInvite(t *testing.T) {
+	room, x := setupRoleTests(t)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandBan, x.Fingerprint()))
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandInvite, x.Fingerprint()))
+	assert.Empty(t, room.Peers)
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandUnban, x.Fingerprint()))
+	assert.False(t, room.IsBanned(x.Fingerprint()))
+	assert.Empty(t, room.Info().Banned)
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandInvite, x.Fingerprint()))
+	_, found := room.PeerByFingerprint(x.Fingerprint())
+	assert.True(t, found)
+}
+
+func TestBanRequiresAdmin(t *testing.T) {
+	room, x := setupRoleTests(t)
+	y := inviteMember(t, room)
+
+	ban := commandMessage(t, x, 1, RoomCommandBan, y.Fingerprint())
+	replica := replicate(t, room, ban)
+
+	assert.False(t, replica.IsBanned(y.Fingerprint()))
+	assert.Contains(t, replica.Info().Roles, y.Fingerprint())
+}
+
+// signedInvite creates the invite of member through contact, which signed it like in the ContactResponse
+func signedInvite(t *testing.T, room *Room, member, contact Identity) MessageContent {
+	sig, err := contact.Sign(append([]byte(member.Fingerprint()), room.ID[:]...))
+	assert.NoError(t, err)
+
+	content, err := NewCommandContent(RoomCommandInvite, &InviteArgs{Fingerprint: member.Fingerprint(), Contact: contact.Fingerprint(), ContactSig: sig})
+	assert.NoError(t, err)
+	return content
+}
+
+func TestBanCoversContact(t *testing.T) {
+	room, _ := setupRoleTests(t)
+	contact, _ := NewIdentity(Contact, "")
+	x, _ := NewIdentity(Self, "")
+
+	invite := func(member Identity) {
+		room.SendMessageToAllPeers(signedInvite(t, room, member, contact))
+	}
+
+	invite(x)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandBan, x.Fingerprint()))
+	assert.True(t, room.IsBanned(contact.Fingerprint()))
+
+	//Inviting the same contact again creates a new room identity
+	y, _ := NewIdentity(Self, "")
+	invite(y)
+	_, found := room.PeerByFingerprint(y.Fingerprint())
+	assert.False(t, found)
+
+	//The contact is refused before it is contacted
+	err := room.AddPeers(contact)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "banned")
+	}
+}
+
+func TestInviteWithUnsignedContact(t *testing.T) {
+	room, _ := setupRoleTests(t)
+	contact, _ := NewIdentity(Contact, "")
+	other, _ := NewIdentity(Contact, "")
+	x, _ := NewIdentity(Self, "")
+
+	//Someone else's contact identity can't be claimed, with or without a signature
+	content, err := NewCommandContent(RoomCommandInvite, &InviteArgs{Fingerprint: x.Fingerprint(), Contact: contact.Fingerprint()})
+	assert.NoError(t, err)
+	room.SendMessageToAllPeers(content)
+
+	sig, _ := other.Sign(append([]byte(x.Fingerprint()), room.ID[:]...))
+	content, err = NewCommandContent(RoomCommandInvite, &InviteArgs{Fingerprint: x.Fingerprint(), Contact: contact.Fingerprint(), ContactSig: sig})
+	assert.NoError(t, err)
+	room.SendMessageToAllPeers(content)
+
+	_, found := room.PeerByFingerprint(x.Fingerprint())
+	assert.False(t, found)
+
+	room.SendMessageToAllPeers(signedInvite(t, room, x, contact))
+	_, found = room.PeerByFingerprint(x.Fingerprint())
+	assert.True(t, found)
+}
+
+func TestInviteWithoutContactWhileBanned(t *testing.T) {
+	room, _ := setupRoleTests(t)
+	contact, _ := NewIdentity(Contact, "")
+	x, _ := NewIdentity(Self, "")
+	room.SendMessageToAllPeers(signedInvite(t, room, x, contact))
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandBan, x.Fingerprint()))
+
+	//Leaving out the contact would invite the banned peer again with a new room identity
+	y, _ := NewIdentity(Self, "")
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandInvite, y.Fingerprint()))
+	_, found := room.PeerByFingerprint(y.Fingerprint())
+	assert.False(t, found)
+
+	other, _ := NewIdentity(Contact, "")
+	room.SendMessageToAllPeers(signedInvite(t, room, y, other))
+	_, found = room.PeerByFingerprint(y.Fingerprint())
+	assert.True(t, found)
+}
@@ -0,0 +1,427 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+)
+
+// FrameKind identifies the content of a Frame
+type FrameKind uint8
+
+const (
+	FrameError FrameKind = iota + 1
+	FrameRoomID
+	FrameAuthOK
+	FrameSyncState
+	FrameMessages
+	FrameEnvelopes
+	FrameMessagesOK
+	FrameBlobIDs
+	FrameBlobOffsets
+	FrameBlockCount
+	FrameBlock
+	FrameBlockOK
+	FrameBlobOK
+	FrameSyncOK
+	FrameSignal
+	FrameSignalOK
+	FrameBatchOK
+	FrameSyncDone
+	FrameServerAuth
+	// FrameRejected lists the IDs of messages in a batch that were not accepted,
+	// it is sent before the batch is acknowledged
+	FrameRejected
+	// FrameSkipped contains the SkippedSeqs the remote doesn't know yet,
+	// it is sent before the first batch of a sync
+	FrameSkipped
+)
+
+// ErrorCode describes why the remote aborted the exchange
+type ErrorCode uint16
+
+const (
+	ErrorInternal ErrorCode = iota + 1
+	ErrorAuthFailed
+	ErrorMalformedRoomID
+	ErrorSignatureInvalid
+	ErrorUndecryptable
+	ErrorBlobUnknown
+	ErrorBlobHashInvalid
+	ErrorSignalInvalid
+	ErrorBusy
+	ErrorRateLimited
+)
+
+var (
+	legacyAcks = map[FrameKind]string{
+		FrameAuthOK:     "auth_ok",
+		FrameMessagesOK: "messages_ok",
+		FrameBlockOK:    "block_ok",
+		FrameBlobOK:     "blob_ok",
+		FrameSyncOK:     "sync_ok",
+		FrameSignalOK:   "signal_ok",
+		FrameBatchOK:    "batch_ok",
+		FrameSyncDone:   "sync_done",
+	}
+
+	legacyErrors = map[ErrorCode]string{
+		ErrorInternal:         "internal_error",
+		ErrorAuthFailed:       "auth_failed",
+		ErrorMalformedRoomID:  "malformed_uuid",
+		ErrorSignatureInvalid: "message_sig_invalid",
+		ErrorUndecryptable:    "messages_undecryptable",
+		ErrorBlobUnknown:      "blob_unknown",
+		ErrorBlobHashInvalid:  "blob_hash_invalid",
+		ErrorSignalInvalid:    "signal_invalid",
+		ErrorBusy:             "busy",
+		ErrorRateLimited:      "rate_limited",
+	}
+
+	cborEnc, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+)
+
+// ProtocolError is returned when the remote sent an error instead of the expected frame
+type ProtocolError struct {
+	Code   ErrorCode `cbor:"1,keyasint" json:"code"`
+	Detail string    `cbor:"2,keyasint,omitempty" json:"detail,omitempty"`
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("remote reported error %s", legacyErrors[e.Code])
+	}
+	return fmt.Sprintf("remote reported error %s: %s", legacyErrors[e.Code], e.Detail)
+}
+
+// Frame is a single typed message received from the remote
+type Frame struct {
+	Kind FrameKind
+
+	payload []byte
+	decode  func([]byte, interface{}) error
+}
+
+// Decode decodes the payload of the frame into v
+func (f Frame) Decode(v interface{}) error {
+	return f.decode(f.payload, v)
+}
+
+// Channel is the connection to another daemon after the handshake.
+// Depending on the negotiated Protocol either typed CBOR frames are used,
+// or the strings and JSON structures understood by older daemons.
+type Channel interface {
+	// Send writes a frame of the kind containing v, it is only sent on Flush
+	Send(kind FrameKind, v interface{}) error
+	// SendError tells the remote why the exchange is aborted, and flushes
+	SendError(code ErrorCode, detail string) error
+	// Receive reads the next frame, which has to be of one of the expected kinds.
+	// If the remote sent an error instead, a *ProtocolError is returned.
+	Receive(expected ...FrameKind) (Frame, error)
+	// Expect receives a frame of the kind and decodes its payload into v, if v isn't nil
+	Expect(kind FrameKind, v interface{}) error
+	// SendStream writes everything read from r, split into as many chunks as needed, see connection.ConnWrapper
+	SendStream(r io.Reader) error
+	// ReceiveStream writes a stream sent with SendStream to w, and aborts once it exceeds limit bytes
+	ReceiveStream(w io.Writer, limit int64) error
+	// SetTimeout sets the time every following operation may take, see connection.ConnWrapper
+	SetTimeout(timeout time.Duration) error
+	Flush() error
+}
+
+// NewChannel creates the Channel for the negotiated Protocol
+func NewChannel(conn connection.ConnWrapper, proto Protocol) Channel {
+	if proto.Supports(FeatureFrames) {
+		return &framedChannel{conn: conn}
+	}
+
+	return &legacyChannel{conn: conn}
+}
+
+type wireFrame struct {
+	Kind    FrameKind       `cbor:"1,keyasint"`
+	Error   *ProtocolError  `cbor:"2,keyasint,omitempty"`
+	Payload cbor.RawMessage `cbor:"3,keyasint,omitempty"`
+}
+
+type framedChannel struct {
+	conn connection.ConnWrapper
+}
+
+func (c *framedChannel) Send(kind FrameKind, v interface{}) error {
+	wf := wireFrame{Kind: kind}
+
+	if v != nil {
+		payload, err := cborEnc.Marshal(v)
+		if err != nil {
+			return err
+		}
+		wf.Payload = payload
+	}
+
+	return c.write(wf)
+}
+
+func (c *framedChannel) SendError(code ErrorCode, detail string) error {
+	err := c.write(wireFrame{
+		Kind:  FrameError,
+		Error: &ProtocolError{Code: code, Detail: detail},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Flush()
+}
+
+func (c *framedChannel) write(wf wireFrame) error {
+	raw, err := cborEnc.Marshal(wf)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.conn.WriteBytes(raw)
+	return err
+}
+
+func (c *framedChannel) Receive(expected ...FrameKind) (Frame, error) {
+	raw, err := c.conn.ReadBytes()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	wf := wireFrame{}
+	err = cbor.Unmarshal(raw, &wf)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	if wf.Kind == FrameError {
+		if wf.Error == nil {
+			return Frame{}, &ProtocolError{Code: ErrorInternal}
+		}
+		return Frame{}, wf.Error
+	}
+
+	if !containsKind(expected, wf.Kind) {
+		return Frame{}, unexpectedFrameError(wf.Kind, expected)
+	}
+
+	return Frame{
+		Kind:    wf.Kind,
+		payload: wf.Payload,
+		decode:  cbor.Unmarshal,
+	}, nil
+}
+
+func (c *framedChannel) Expect(kind FrameKind, v interface{}) error {
+	return expect(c, kind, v)
+}
+
+func (c *framedChannel) SendStream(r io.Reader) error {
+	_, err := c.conn.WriteStream(r)
+	return err
+}
+
+func (c *framedChannel) ReceiveStream(w io.Writer, limit int64) error {
+	_, err := c.conn.ReadStream(w, limit)
+	return err
+}
+
+func (c *framedChannel) SetTimeout(timeout time.Duration) error {
+	return c.conn.SetTimeout(timeout)
+}
+
+func (c *framedChannel) Flush() error {
+	return c.conn.Flush()
+}
+
+// legacyChannel speaks the protocol of daemons that don't support typed frames,
+// in which the kind of every message is implied by its position in the exchange.
+type legacyChannel struct {
+	conn connection.ConnWrapper
+}
+
+func (c *legacyChannel) Send(kind FrameKind, v interface{}) error {
+	var err error
+
+	if ack, ok := legacyAcks[kind]; ok {
+		_, err = c.conn.WriteString(ack)
+		return err
+	}
+
+	switch kind {
+	case FrameRoomID:
+		id := v.(uuid.UUID)
+		_, err = c.conn.WriteBytes(id[:])
+	case FrameBlockCount:
+		_, err = c.conn.WriteInt(v.(int))
+	case FrameBlock:
+		_, err = c.conn.WriteBytes(v.([]byte))
+	default:
+		_, err = c.conn.WriteStruct(v)
+	}
+
+	return err
+}
+
+func (c *legacyChannel) SendError(code ErrorCode, detail string) error {
+	msg := legacyErrors[code]
+	if detail != "" {
+		msg += " " + detail
+	}
+
+	_, err := c.conn.WriteString(msg)
+	if err != nil {
+		return err
+	}
+
+	return c.Flush()
+}
+
+func (c *legacyChannel) Receive(expected ...FrameKind) (Frame, error) {
+	raw, err := c.conn.ReadBytes()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	for _, kind := range expected {
+		if ack, ok := legacyAcks[kind]; ok && string(raw) == ack {
+			return Frame{Kind: kind, decode: decodeNothing}, nil
+		}
+	}
+
+	//Blocks are raw data, which is never mistaken for an error
+	if !containsKind(expected, FrameBlock) {
+		if perr := parseLegacyError(raw); perr != nil {
+			return Frame{}, perr
+		}
+	}
+
+	for _, kind := range expected {
+		if _, ok := legacyAcks[kind]; ok {
+			continue
+		}
+
+		//Both are JSON, but the messages are an array and the envelopes are an object
+		if kind == FrameEnvelopes && !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			continue
+		}
+		if kind == FrameMessages && containsKind(expected, FrameEnvelopes) && bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			continue
+		}
+
+		return Frame{
+			Kind:    kind,
+			payload: raw,
+			decode:  legacyDecoder(kind),
+		}, nil
+	}
+
+	return Frame{}, fmt.Errorf("received response \"%s\" wanted %v", string(raw), expected)
+}
+
+func (c *legacyChannel) Expect(kind FrameKind, v interface{}) error {
+	return expect(c, kind, v)
+}
+
+func (c *legacyChannel) SendStream(r io.Reader) error {
+	_, err := c.conn.WriteStream(r)
+	return err
+}
+
+func (c *legacyChannel) ReceiveStream(w io.Writer, limit int64) error {
+	_, err := c.conn.ReadStream(w, limit)
+	return err
+}
+
+func (c *legacyChannel) SetTimeout(timeout time.Duration) error {
+	return c.conn.SetTimeout(timeout)
+}
+
+func (c *legacyChannel) Flush() error {
+	return c.conn.Flush()
+}
+
+func legacyDecoder(kind FrameKind) func([]byte, interface{}) error {
+	switch kind {
+	case FrameRoomID:
+		return func(raw []byte, v interface{}) error {
+			id, err := uuid.FromBytes(raw)
+			if err != nil {
+				return err
+			}
+			*v.(*uuid.UUID) = id
+			return nil
+		}
+	case FrameBlockCount:
+		return func(raw []byte, v interface{}) error {
+			if len(raw) != 4 {
+				return fmt.Errorf("invalid length for int, %d instead of 4", len(raw))
+			}
+			*v.(*int) = int(binary.LittleEndian.Uint32(raw))
+			return nil
+		}
+	case FrameBlock:
+		return func(raw []byte, v interface{}) error {
+			*v.(*[]byte) = raw
+			return nil
+		}
+	default:
+		return json.Unmarshal
+	}
+}
+
+func parseLegacyError(raw []byte) *ProtocolError {
+	for code, msg := range legacyErrors {
+		if string(raw) == msg {
+			return &ProtocolError{Code: code}
+		}
+
+		if strings.HasPrefix(string(raw), msg+" ") {
+			return &ProtocolError{Code: code, Detail: strings.TrimPrefix(string(raw), msg+" ")}
+		}
+	}
+
+	return nil
+}
+
+func expect(c Channel, kind FrameKind, v interface{}) error {
+	frame, err := c.Receive(kind)
+	if err != nil {
+		return err
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return frame.Decode(v)
+}
+
+func decodeNothing([]byte, interface{}) error {
+	return nil
+}
+
+func containsKind(kinds []FrameKind, kind FrameKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+func unexpectedFrameError(kind FrameKind, expected []FrameKind) error {
+	return fmt.Errorf("received frame of kind %d wanted %v", kind, expected)
+}
@@ -0,0 +1,128 @@
+package types_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+)
+
+var (
+	framed = Protocol{Features: map[string]bool{FeatureFrames: true}}
+)
+
+// pipeChannels returns two connected Channels for the Protocol
+func pipeChannels(proto Protocol) (Channel, Channel) {
+	a, b := net.Pipe()
+	return NewChannel(connection.WrapConnection(a), proto), NewChannel(connection.WrapConnection(b), proto)
+}
+
+// sendFrame sends v in a frame of the kind and returns the frame as it was received
+func sendFrame(t *testing.T, proto Protocol, kind FrameKind, v interface{}) Frame {
+	sender, receiver := pipeChannels(proto)
+
+	go func() {
+		sender.Send(kind, v)
+		sender.Flush()
+	}()
+
+	frame, err := receiver.Receive(kind)
+	assert.NoError(t, err)
+
+	return frame
+}
+
+func TestChannelMessages(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+	msgs := []Message{
+		NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1),
+	}
+
+	for _, proto := range []Protocol{framed, LegacyProtocol()} {
+		received := make([]Message, 0)
+		err := sendFrame(t, proto, FrameMessages, msgs).Decode(&received)
+
+		assert.NoError(t, err)
+		assert.Equal(t, msgs[0].ID, received[0].ID)
+		assert.True(t, received[0].SigIsValid())
+	}
+}
+
+func TestChannelRawKinds(t *testing.T) {
+	id := uuid.New()
+
+	for _, proto := range []Protocol{framed, LegacyProtocol()} {
+		var receivedID uuid.UUID
+		assert.NoError(t, sendFrame(t, proto, FrameRoomID, id).Decode(&receivedID))
+		assert.Equal(t, id, receivedID)
+
+		var count int
+		assert.NoError(t, sendFrame(t, proto, FrameBlockCount, 42).Decode(&count))
+		assert.Equal(t, 42, count)
+
+		var block []byte
+		assert.NoError(t, sendFrame(t, proto, FrameBlock, []byte("blob_ok")).Decode(&block))
+		assert.Equal(t, []byte("blob_ok"), block)
+	}
+}
+
+func TestChannelError(t *testing.T) {
+	for _, proto := range []Protocol{framed, LegacyProtocol()} {
+		sender, receiver := pipeChannels(proto)
+
+		go sender.SendError(ErrorSignatureInvalid, "detail")
+
+		err := receiver.Expect(FrameMessagesOK, nil)
+
+		assert.Equal(t, &ProtocolError{Code: ErrorSignatureInvalid, Detail: "detail"}, err)
+	}
+}
+
+func TestChannelUnexpectedFrame(t *testing.T) {
+	for _, proto := range []Protocol{framed, LegacyProtocol()} {
+		sender, receiver := pipeChannels(proto)
+
+		go func() {
+			sender.Send(FrameSyncOK, nil)
+			sender.Flush()
+		}()
+
+		err := receiver.Expect(FrameMessagesOK, nil)
+
+		assert.Error(t, err)
+		_, isProtocolError := err.(*ProtocolError)
+		assert.False(t, isProtocolError)
+	}
+}
+
+func TestChannelStream(t *testing.T) {
+	payload := make([]byte, 3*BlockSize+42)
+	rand.Read(payload)
+
+	sender, receiver := pipeChannels(framed)
+	go func() {
+		sender.SendStream(bytes.NewReader(payload))
+		sender.Send(FrameBlobOK, nil)
+		sender.Flush()
+	}()
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, receiver.ReceiveStream(buf, int64(len(payload))))
+	assert.Equal(t, payload, buf.Bytes())
+	assert.NoError(t, receiver.Expect(FrameBlobOK, nil))
+
+	//The receiver doesn't accept more than the declared size
+	sender, receiver = pipeChannels(framed)
+	go func() {
+		sender.SendStream(bytes.NewReader(payload))
+		sender.Flush()
+	}()
+
+	assert.Error(t, receiver.ReceiveStream(&bytes.Buffer{}, int64(len(payload)-1)))
+}
@@ -2,9 +2,6 @@ package types
 
 import (
 	"fmt"
-	"strings"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type Command string
@@ -14,12 +11,24 @@ const (
 	RoomCommandNameRoom   Command = "name_room"
 	RoomCommandNick       Command = "nick"
 	RoomCommandPromote    Command = "promote"
+	RoomCommandDemote     Command = "demote"
+	RoomCommandSetRole    Command = "set_role"
 	RoomCommandRemovePeer Command = "remove_peer"
+	RoomCommandRoomKey    Command = "room_key"
+	RoomCommandRatchet    Command = "ratchet"
 
 	//This command is essentially a No-Op,
 	//and is mainly used for indication in frontends
 	RoomCommandAccept Command = "accept"
 
+	RoomCommandTransferOwnership Command = "transfer_ownership"
+	RoomCommandTopic             Command = "topic"
+	RoomCommandLeave             Command = "leave"
+	RoomCommandBan               Command = "ban"
+	RoomCommandUnban             Command = "unban"
+	//RoomCommandCreate is only used for the founding event of a Room, see Room.Genesis
+	RoomCommandCreate Command = "create"
+
 	CommandDelimiter = " "
 )
 
@@ -62,150 +71,213 @@ func RegisterRoomCommands() error {
 		return err
 	}
 
-	err = RegisterCommand(RoomCommandPromote, promoteCallback)
+	err = RegisterCommand(RoomCommandTopic, topicCallback)
 	if err != nil {
 		return err
 	}
 
-	err = RegisterCommand(RoomCommandRemovePeer, removePeerCallback)
+	err = RegisterCommand(RoomCommandPromote, promoteCallback)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	err = RegisterCommand(RoomCommandDemote, demoteCallback)
+	if err != nil {
+		return err
+	}
 
-func inviteCallback(command Command, message *Message, room *Room) error {
-	args, err := parseCommand(message, command, RoomCommandInvite, 2)
+	err = RegisterCommand(RoomCommandSetRole, setRoleCallback)
 	if err != nil {
 		return err
 	}
 
-	if _, found := room.PeerByFingerprint(args[1]); found || args[1] == room.Self.Fingerprint() {
-		return fmt.Errorf("user %s already added, or self", args[1])
+	err = RegisterCommand(RoomCommandTransferOwnership, transferOwnershipCallback)
+	if err != nil {
+		return err
 	}
 
-	peerID, err := NewIdentity(Remote, args[1])
+	err = RegisterCommand(RoomCommandRemovePeer, removePeerCallback)
 	if err != nil {
 		return err
 	}
 
-	newPeer := NewMessagingPeer(peerID)
-	room.Peers = append(room.Peers, newPeer)
+	err = RegisterCommand(RoomCommandLeave, leaveCallback)
+	if err != nil {
+		return err
+	}
 
-	go newPeer.RunMessageQueue(room.Ctx, room)
+	err = RegisterCommand(RoomCommandBan, banCallback)
+	if err != nil {
+		return err
+	}
 
-	lf := log.Fields{
-		"peer": newPeer.RIdentity.Fingerprint(),
-		"room": room.ID,
+	err = RegisterCommand(RoomCommandUnban, unbanCallback)
+	if err != nil {
+		return err
 	}
-	log.WithFields(lf).Debug("new peer added to room")
-	return nil
-}
 
-func nameRoomCallback(command Command, message *Message, room *Room) error {
-	args, err := parseCommand(message, command, RoomCommandNameRoom, 2)
+	err = RegisterCommand(RoomCommandRoomKey, roomKeyCallback)
 	if err != nil {
 		return err
 	}
 
-	room.Name = args[1]
-	log.Debugf("Room with id %s renamed to %s", room.ID, room.Name)
+	err = RegisterCommand(RoomCommandRatchet, ratchetCallback)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func nickCallback(command Command, message *Message, room *Room) error {
-	args, err := parseCommand(message, command, RoomCommandNick, 2)
+// inviteCallback only checks the format of the command,
+// the peer is added when the membership log is replayed, see Room.rebuildRoster.
+func inviteCallback(command Command, message *Message, room *Room) error {
+	args := &InviteArgs{}
+	err := parseCommandArgs(message, RoomCommandInvite, args)
 	if err != nil {
 		return err
 	}
 
-	sender, err := getSender(message, room, false)
-	if err != nil {
-		return err
+	if room.isBanned(args.Fingerprint) || room.isBanned(args.Contact) {
+		return fmt.Errorf("%s is banned from room %s", args.Fingerprint, room.ID)
 	}
 
-	nickname := args[1]
-	sender.Meta.Nick = nickname
-	log.Debugf("Set nickname for %s to %s", sender.Fingerprint(), nickname)
+	return args.verifyContact(room.ID)
+}
 
-	return nil
+// The callbacks of the room state only check the format of the command,
+// the state is changed when the message is added, see Room.applyStateCommand.
+
+func nameRoomCallback(command Command, message *Message, room *Room) error {
+	return parseCommandArgs(message, RoomCommandNameRoom, &NameRoomArgs{})
+}
+
+func topicCallback(command Command, message *Message, room *Room) error {
+	return parseCommandArgs(message, RoomCommandTopic, &TopicArgs{})
 }
 
+func nickCallback(command Command, message *Message, room *Room) error {
+	return parseCommandArgs(message, RoomCommandNick, &NickArgs{})
+}
+
+// The callbacks of the role changes only check the format of the command,
+// the roles are changed when the membership log is replayed, see roster.apply.
+
 func promoteCallback(command Command, message *Message, room *Room) error {
-	args, err := parseCommand(message, command, RoomCommandPromote, 2)
+	return parseCommandArgs(message, RoomCommandPromote, &PeerArgs{})
+}
+
+func demoteCallback(command Command, message *Message, room *Room) error {
+	return parseCommandArgs(message, RoomCommandDemote, &PeerArgs{})
+}
+
+func setRoleCallback(command Command, message *Message, room *Room) error {
+	return parseCommandArgs(message, RoomCommandSetRole, &SetRoleArgs{})
+}
+
+func transferOwnershipCallback(command Command, message *Message, room *Room) error {
+	return parseCommandArgs(message, RoomCommandTransferOwnership, &PeerArgs{})
+}
+
+// removePeerCallback only checks the command, the peer is removed and the room key is rotated
+// when the membership log is replayed, see Room.rebuildRoster.
+func removePeerCallback(command Command, message *Message, room *Room) error {
+	args := &PeerArgs{}
+	err := parseCommandArgs(message, RoomCommandRemovePeer, args)
 	if err != nil {
 		return err
 	}
 
-	_, err = getSender(message, room, true)
+	sender, target, err := getSenderAndTarget(message, room, args.Fingerprint)
 	if err != nil {
 		return err
 	}
 
-	toPromote, found := room.PeerByFingerprint(args[1])
-	switch {
-	case found:
-		toPromote.Meta.Admin = true
-	case room.isSelf(args[1]):
-		room.Self.Meta.Admin = true
-	default:
-		return peerNotFoundError(args[1])
+	if !mayManage(sender, target) {
+		return fmt.Errorf("%s may not remove %s", sender.Fingerprint(), target.Fingerprint())
 	}
 
 	return nil
 }
 
-func removePeerCallback(command Command, message *Message, room *Room) error {
-	args, err := parseCommand(message, command, RoomCommandRemovePeer, 2)
+// leaveCallback only checks the sender of the command, the member is removed, its queue is stopped
+// and the room key is rotated when the membership log is replayed.
+func leaveCallback(command Command, message *Message, room *Room) error {
+	if room.isSelf(message.Meta.Sender) {
+		return nil
+	}
+
+	_, err := getSender(message, room)
+	return err
+}
+
+// banCallback checks whether the sender may remove the banned peer, if it is a member.
+// The ban list is changed when the membership log is replayed, see banList.apply.
+func banCallback(command Command, message *Message, room *Room) error {
+	args := &PeerArgs{}
+	err := parseCommandArgs(message, RoomCommandBan, args)
 	if err != nil {
 		return err
 	}
 
-	_, err = getSender(message, room, true)
+	target, member := room.memberByFingerprint(args.Fingerprint)
+	if !member {
+		return nil
+	}
+
+	sender, err := getSender(message, room)
 	if err != nil {
 		return err
 	}
 
-	return room.removePeer(args[1])
+	if !mayManage(sender, target) {
+		return fmt.Errorf("%s may not ban %s", sender.Fingerprint(), target.Fingerprint())
+	}
+
+	return nil
 }
 
-func getSender(msg *Message, r *Room, shouldBeAdmin bool) (Identity, error) {
-	sender, found := r.PeerByFingerprint(msg.Meta.Sender)
-	if !found {
-		if r.Self.Fingerprint() != msg.Meta.Sender {
-			return Identity{}, peerNotFoundError(msg.Meta.Sender)
-		}
-		sender = r.Self
-	}
+func unbanCallback(command Command, message *Message, room *Room) error {
+	return parseCommandArgs(message, RoomCommandUnban, &PeerArgs{})
+}
+
+// roomKeyCallback only checks the format of the command,
+// the key itself is applied when the message is added to the Room.
+func roomKeyCallback(command Command, message *Message, room *Room) error {
+	return parseCommandArgs(message, RoomCommandRoomKey, &RoomKeyArgs{})
+}
+
+// ratchetCallback only checks the sender of the announcement,
+// which is recorded when the message is added to the Room.
+func ratchetCallback(command Command, message *Message, room *Room) error {
+	_, err := getSender(message, room)
+	return err
+}
 
-	if shouldBeAdmin && !sender.Meta.Admin {
-		return Identity{}, peerNotAdminError(msg.Meta.Sender)
+// getSender returns the identity of the member that sent msg.
+// Whether the sender may run the command is checked before it is handled, see Room.checkPermission.
+func getSender(msg *Message, r *Room) (Identity, error) {
+	sender, found := r.memberByFingerprint(msg.Meta.Sender)
+	if !found {
+		return Identity{}, peerNotFoundError(msg.Meta.Sender)
 	}
 
 	return sender, nil
 }
 
-func parseCommand(message *Message, actualCommand, expectedCommand Command, expectedArgs int) ([]string, error) {
-	if actualCommand != expectedCommand {
-		return nil, fmt.Errorf("%s is the wrong command", actualCommand)
+// getSenderAndTarget returns the identities of the sender of msg and the member it refers to
+func getSenderAndTarget(msg *Message, r *Room, target string) (Identity, Identity, error) {
+	sender, err := getSender(msg, r)
+	if err != nil {
+		return Identity{}, Identity{}, err
 	}
 
-	args := strings.Split(string(message.Content.Data), CommandDelimiter)
-	if !enoughArgs(args, expectedArgs) {
-		return nil, fmt.Errorf("%s doesn't have enough arguments", actualCommand)
+	targetID, found := r.memberByFingerprint(target)
+	if !found {
+		return Identity{}, Identity{}, peerNotFoundError(target)
 	}
 
-	return strings.Split(string(message.Content.Data), CommandDelimiter), nil
-}
-
-func enoughArgs(args []string, needed int) bool {
-	if len(args) < needed {
-		log.Warnf("Not enough args for command \"%s\"\n", strings.Join(args, " "))
-		return false
-	}
-	return true
+	return sender, targetID, nil
 }
 
 func peerNotFoundError(peer string) error {
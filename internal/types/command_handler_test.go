@@ -1,6 +1,7 @@
 package types_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -121,3 +122,82 @@ func TestAddCommand(t *testing.T) {
 
 	assert.Equal(t, expected, string(actual))
 }
+
+func TestNameRoomStructured(t *testing.T) {
+	CleanCallbacks()
+	RegisterRoomCommands()
+	defer CleanCallbacks()
+
+	room, _ := NewRoom(context.Background())
+	content, err := NewCommandContent(RoomCommandNameRoom, &NameRoomArgs{Name: "name with spaces"})
+	assert.NoError(t, err)
+
+	err = room.PushMessages(NewMessage(content, room.Self, 1))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "name with spaces", room.Name)
+}
+
+func TestNameRoomLegacy(t *testing.T) {
+	CleanCallbacks()
+	RegisterRoomCommands()
+	defer CleanCallbacks()
+
+	room, _ := NewRoom(context.Background())
+	msg := NewMessage(MessageContent{
+		Type: ContentTypeCmd,
+		Data: ConstructCommand([]byte("name with spaces"), RoomCommandNameRoom),
+	}, room.Self, 1)
+
+	err := room.PushMessages(msg)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "name with spaces", room.Name)
+}
+
+func TestCommandInvalidArgs(t *testing.T) {
+	CleanCallbacks()
+	RegisterRoomCommands()
+	defer CleanCallbacks()
+
+	room, _ := NewRoom(context.Background())
+	msg := Message{
+		Content: MessageContent{
+			Type: ContentTypeCmd,
+			Data: []byte(`{"v":1,"cmd":"invite","args":{"fingerprint":"invalid"}}`),
+		},
+	}
+
+	assert.Error(t, HandleCommand(&msg, room))
+	assert.Empty(t, room.Peers)
+
+	_, err := NewCommandContent(RoomCommandNameRoom, &NameRoomArgs{})
+	assert.Error(t, err)
+}
+
+func TestCommandUnsupportedVersion(t *testing.T) {
+	CleanCallbacks()
+	RegisterRoomCommands()
+	defer CleanCallbacks()
+
+	room, _ := NewRoom(context.Background())
+	msg := Message{
+		Content: MessageContent{
+			Type: ContentTypeCmd,
+			Data: []byte(`{"v":2,"cmd":"name_room","args":{"name":"test"}}`),
+		},
+	}
+
+	assert.Error(t, HandleCommand(&msg, room))
+	assert.Empty(t, room.Name)
+}
+
+func TestCommandSentInLegacyFormat(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+
+	content, _ := NewCommandContent(RoomCommandNameRoom, &NameRoomArgs{Name: "test name"})
+	room.SendMessageToAllPeers(content)
+
+	//Without peers that are known to understand structured commands, the old format is used
+	assert.Equal(t, "name_room test name", string(room.Messages[0].Content.Data))
+}
@@ -0,0 +1,524 @@
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// CommandPayloadVersion is the version of the structured command format, see CommandPayload
+	CommandPayloadVersion = 1
+
+	maxCommandTextLength = 256
+
+	//legacyParentPrefix and legacySeenPrefix mark the words of membership commands in the old format
+	//that contain the parents and Seen, older versions ignore them, since they only read the arguments they expect
+	legacyParentPrefix = "parent:"
+	legacySeenPrefix   = "seen:"
+)
+
+var (
+	//commandArgTypes creates the arguments of every command that takes any
+	commandArgTypes = map[Command]func() commandArgs{
+		RoomCommandInvite:     func() commandArgs { return &InviteArgs{} },
+		RoomCommandNameRoom:   func() commandArgs { return &NameRoomArgs{} },
+		RoomCommandNick:       func() commandArgs { return &NickArgs{} },
+		RoomCommandPromote:    func() commandArgs { return &PeerArgs{} },
+		RoomCommandDemote:     func() commandArgs { return &PeerArgs{} },
+		RoomCommandSetRole:    func() commandArgs { return &SetRoleArgs{} },
+		RoomCommandRemovePeer: func() commandArgs { return &PeerArgs{} },
+		RoomCommandRoomKey:    func() commandArgs { return &RoomKeyArgs{} },
+		RoomCommandTopic:      func() commandArgs { return &TopicArgs{} },
+		RoomCommandBan:        func() commandArgs { return &PeerArgs{} },
+		RoomCommandUnban:      func() commandArgs { return &PeerArgs{} },
+		RoomCommandCreate:     func() commandArgs { return &CreateArgs{} },
+
+		RoomCommandTransferOwnership: func() commandArgs { return &PeerArgs{} },
+	}
+)
+
+// CommandPayload is the data of a structured command message.
+// Older versions send commands as the name followed by space-delimited arguments,
+// which are still understood, see ConstructCommand.
+type CommandPayload struct {
+	Version int             `json:"v"`
+	Command Command         `json:"cmd"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	//Parents are the ids of the latest membership events known to the sender,
+	//they are only set for membership commands, see withParents
+	Parents []string `json:"parents,omitempty"`
+	//Seen is the sequence number up to which the sender knew the messages of the peer a membership command refers to,
+	//which determines the messages of that peer the command applies to, see Room.roleAt
+	Seen *uint64 `json:"seen,omitempty"`
+	//Clock is the lamport clock of commands that change the room state, see withClock
+	Clock uint64 `json:"clock,omitempty"`
+}
+
+// commandArgs are the arguments of a command
+type commandArgs interface {
+	// validate checks the arguments after they were decoded
+	validate() error
+	// fromLegacy fills the arguments from the words following the command in the old format
+	fromLegacy(words []string) error
+	// legacy returns the arguments in the old format
+	legacy() string
+}
+
+// PeerArgs are the arguments of commands that refer to a single peer
+type PeerArgs struct {
+	Fingerprint string `json:"fingerprint"`
+}
+
+func (a *PeerArgs) validate() error {
+	raw, err := base64.RawURLEncoding.DecodeString(a.Fingerprint)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid fingerprint \"%s\"", a.Fingerprint)
+	}
+
+	return nil
+}
+
+func (a *PeerArgs) fromLegacy(words []string) error {
+	if len(words) < 1 {
+		return fmt.Errorf("missing fingerprint")
+	}
+
+	a.Fingerprint = words[0]
+	return nil
+}
+
+func (a *PeerArgs) legacy() string {
+	return a.Fingerprint
+}
+
+// InviteArgs are the arguments of RoomCommandInvite.
+// Contact is the fingerprint of the contact identity the peer was invited through,
+// which stays the same when it is invited again with a new room identity, see banList.
+// ContactSig is the signature of the room identity and the Room by the contact identity,
+// which it sends in the ContactResponse.
+// In the old format they follow the fingerprint, older versions don't send them and ignore them.
+type InviteArgs struct {
+	Fingerprint string `json:"fingerprint"`
+	Contact     string `json:"contact,omitempty"`
+	ContactSig  []byte `json:"contactSig,omitempty"`
+}
+
+func (a *InviteArgs) validate() error {
+	if len(a.ContactSig) > 0 && a.Contact == "" {
+		return fmt.Errorf("signature without contact identity")
+	}
+
+	if a.Contact != "" {
+		err := (&PeerArgs{Fingerprint: a.Contact}).validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return (&PeerArgs{Fingerprint: a.Fingerprint}).validate()
+}
+
+// verifyContact checks that the Contact signed the invited room identity for the Room with the specified id
+func (a *InviteArgs) verifyContact(room uuid.UUID) error {
+	if a.Contact == "" {
+		return nil
+	}
+
+	contact, err := NewIdentity(Remote, a.Contact)
+	if err != nil {
+		return err
+	}
+
+	ok, err := contact.Verify(append([]byte(a.Fingerprint), room[:]...), a.ContactSig)
+	if err != nil || !ok {
+		return fmt.Errorf("invite of %s isn't signed by contact identity %s", a.Fingerprint, a.Contact)
+	}
+
+	return nil
+}
+
+func (a *InviteArgs) fromLegacy(words []string) error {
+	if len(words) < 1 {
+		return fmt.Errorf("missing fingerprint")
+	}
+
+	a.Fingerprint = words[0]
+	if len(words) > 1 {
+		a.Contact = words[1]
+	}
+	if len(words) > 2 {
+		sig, err := base64.RawURLEncoding.DecodeString(words[2])
+		if err != nil {
+			return err
+		}
+		a.ContactSig = sig
+	}
+	return nil
+}
+
+func (a *InviteArgs) legacy() string {
+	if a.Contact == "" {
+		return a.Fingerprint
+	}
+	if len(a.ContactSig) == 0 {
+		return a.Fingerprint + CommandDelimiter + a.Contact
+	}
+
+	return a.Fingerprint + CommandDelimiter + a.Contact + CommandDelimiter + base64.RawURLEncoding.EncodeToString(a.ContactSig)
+}
+
+// SetRoleArgs are the arguments of RoomCommandSetRole
+type SetRoleArgs struct {
+	Fingerprint string `json:"fingerprint"`
+	Role        Role   `json:"role"`
+}
+
+func (a *SetRoleArgs) validate() error {
+	if !a.Role.Valid() {
+		return fmt.Errorf("unknown role \"%s\"", a.Role)
+	}
+
+	return (&PeerArgs{Fingerprint: a.Fingerprint}).validate()
+}
+
+func (a *SetRoleArgs) fromLegacy(words []string) error {
+	if len(words) < 2 {
+		return fmt.Errorf("missing fingerprint or role")
+	}
+
+	a.Fingerprint = words[0]
+	a.Role = Role(words[1])
+	return nil
+}
+
+func (a *SetRoleArgs) legacy() string {
+	return a.Fingerprint + CommandDelimiter + string(a.Role)
+}
+
+// NameRoomArgs are the arguments of RoomCommandNameRoom
+type NameRoomArgs struct {
+	Name string `json:"name"`
+}
+
+func (a *NameRoomArgs) validate() error {
+	return validateCommandText("name", a.Name)
+}
+
+func (a *NameRoomArgs) fromLegacy(words []string) error {
+	a.Name = strings.Join(words, CommandDelimiter)
+	return nil
+}
+
+func (a *NameRoomArgs) legacy() string {
+	return a.Name
+}
+
+// NickArgs are the arguments of RoomCommandNick
+type NickArgs struct {
+	Nick string `json:"nick"`
+}
+
+func (a *NickArgs) validate() error {
+	return validateCommandText("nickname", a.Nick)
+}
+
+func (a *NickArgs) fromLegacy(words []string) error {
+	a.Nick = strings.Join(words, CommandDelimiter)
+	return nil
+}
+
+func (a *NickArgs) legacy() string {
+	return a.Nick
+}
+
+// TopicArgs are the arguments of RoomCommandTopic, an empty topic removes it
+type TopicArgs struct {
+	Topic string `json:"topic"`
+}
+
+func (a *TopicArgs) validate() error {
+	if a.Topic == "" {
+		return nil
+	}
+
+	return validateCommandText("topic", a.Topic)
+}
+
+func (a *TopicArgs) fromLegacy(words []string) error {
+	a.Topic = strings.Join(words, CommandDelimiter)
+	return nil
+}
+
+func (a *TopicArgs) legacy() string {
+	return a.Topic
+}
+
+// RoomKeyArgs are the arguments of RoomCommandRoomKey,
+// Keys contains the sealed room key for every member except the sender by its fingerprint,
+// which is empty if the sender is the only member
+type RoomKeyArgs struct {
+	ID   string            `json:"id"`
+	Keys map[string][]byte `json:"keys"`
+}
+
+func (a *RoomKeyArgs) validate() error {
+	if a.ID == "" {
+		return fmt.Errorf("room key is incomplete")
+	}
+
+	return nil
+}
+
+func (a *RoomKeyArgs) fromLegacy(words []string) error {
+	if len(words) < 2 {
+		return fmt.Errorf("room key is incomplete")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(words[1])
+	if err != nil {
+		return err
+	}
+
+	a.ID = words[0]
+	return json.Unmarshal(raw, &a.Keys)
+}
+
+func (a *RoomKeyArgs) legacy() string {
+	raw, _ := json.Marshal(a.Keys)
+	return a.ID + CommandDelimiter + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// NewCommandContent creates the content of a structured command message.
+// args has to be nil for commands without arguments.
+func NewCommandContent(command Command, args commandArgs) (MessageContent, error) {
+	payload := CommandPayload{
+		Version: CommandPayloadVersion,
+		Command: command,
+	}
+
+	if args != nil {
+		err := args.validate()
+		if err != nil {
+			return MessageContent{}, err
+		}
+
+		payload.Args, err = json.Marshal(args)
+		if err != nil {
+			return MessageContent{}, err
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return MessageContent{}, err
+	}
+
+	return MessageContent{
+		Type: ContentTypeCmd,
+		Data: data,
+	}, nil
+}
+
+// NewTextCommandContent creates the content of a command message
+// from text containing its arguments in the old space-delimited format
+func NewTextCommandContent(command Command, text string) (MessageContent, error) {
+	newArgs, ok := commandArgTypes[command]
+	if !ok {
+		return NewCommandContent(command, nil)
+	}
+
+	args := newArgs()
+	err := args.fromLegacy(strings.Split(text, CommandDelimiter))
+	if err != nil {
+		return MessageContent{}, err
+	}
+
+	return NewCommandContent(command, args)
+}
+
+// commandName returns the name of the command contained in data, which may be in either format
+func commandName(data []byte) Command {
+	if isStructuredCommand(data) {
+		payload := CommandPayload{}
+		if json.Unmarshal(data, &payload) != nil {
+			return ""
+		}
+		return payload.Command
+	}
+
+	return Command(strings.Split(string(data), CommandDelimiter)[0])
+}
+
+// parseCommandArgs decodes the arguments of message into args and validates them
+func parseCommandArgs(message *Message, expected Command, args commandArgs) error {
+	data := message.Content.Data
+
+	if !isStructuredCommand(data) {
+		words := strings.Split(string(data), CommandDelimiter)
+		if Command(words[0]) != expected {
+			return fmt.Errorf("%s is the wrong command", words[0])
+		}
+
+		err := args.fromLegacy(withoutLegacyOrder(expected, words[1:]))
+		if err != nil {
+			return fmt.Errorf("invalid arguments for %s: %v", expected, err)
+		}
+
+		return args.validate()
+	}
+
+	payload := CommandPayload{}
+	err := json.Unmarshal(data, &payload)
+	switch {
+	case err != nil:
+		return err
+	case payload.Version < 1 || payload.Version > CommandPayloadVersion:
+		return fmt.Errorf("unsupported command version %d", payload.Version)
+	case payload.Command != expected:
+		return fmt.Errorf("%s is the wrong command", payload.Command)
+	}
+
+	err = json.Unmarshal(payload.Args, args)
+	if err != nil {
+		return fmt.Errorf("invalid arguments for %s: %v", expected, err)
+	}
+
+	return args.validate()
+}
+
+// legacyCommandData converts a structured command to the format understood by older versions
+func legacyCommandData(data []byte) ([]byte, error) {
+	if !isStructuredCommand(data) {
+		return data, nil
+	}
+
+	payload := CommandPayload{}
+	err := json.Unmarshal(data, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var words []string
+	if newArgs, ok := commandArgTypes[payload.Command]; ok {
+		args := newArgs()
+		err = json.Unmarshal(payload.Args, args)
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, args.legacy())
+	}
+
+	for _, parent := range payload.Parents {
+		words = append(words, legacyParentPrefix+parent)
+	}
+	if payload.Seen != nil {
+		words = append(words, legacySeenPrefix+strconv.FormatUint(*payload.Seen, 10))
+	}
+
+	return ConstructCommand([]byte(strings.Join(words, CommandDelimiter)), payload.Command), nil
+}
+
+// legacyParents returns the parents of a membership command in the old format
+func legacyParents(data []byte) []string {
+	words := strings.Split(string(data), CommandDelimiter)
+	if _, ok := membershipCommands[Command(words[0])]; !ok {
+		return nil
+	}
+
+	var parents []string
+	for _, word := range words[1:] {
+		if strings.HasPrefix(word, legacyParentPrefix) {
+			parents = append(parents, strings.TrimPrefix(word, legacyParentPrefix))
+		}
+	}
+
+	return parents
+}
+
+// legacySeen returns Seen of a membership command in the old format
+func legacySeen(data []byte) (uint64, bool) {
+	words := strings.Split(string(data), CommandDelimiter)
+	if _, ok := membershipCommands[Command(words[0])]; !ok {
+		return 0, false
+	}
+
+	for _, word := range words[1:] {
+		if !strings.HasPrefix(word, legacySeenPrefix) {
+			continue
+		}
+
+		seen, err := strconv.ParseUint(strings.TrimPrefix(word, legacySeenPrefix), 10, 64)
+		return seen, err == nil
+	}
+
+	return 0, false
+}
+
+// withoutLegacyOrder removes the parents and Seen from the words of a membership command in the old format
+func withoutLegacyOrder(command Command, words []string) []string {
+	if _, ok := membershipCommands[command]; !ok {
+		return words
+	}
+
+	args := make([]string, 0, len(words))
+	for _, word := range words {
+		if !strings.HasPrefix(word, legacyParentPrefix) && !strings.HasPrefix(word, legacySeenPrefix) {
+			args = append(args, word)
+		}
+	}
+
+	return args
+}
+
+// structuredPayload decodes data, if it contains a structured command
+func structuredPayload(data []byte) (CommandPayload, bool) {
+	payload := CommandPayload{}
+	if !isStructuredCommand(data) || json.Unmarshal(data, &payload) != nil {
+		return CommandPayload{}, false
+	}
+
+	return payload, true
+}
+
+// updatePayload applies update to the structured command in data.
+// If data can't be decoded or encoded again, it is returned as it is.
+func updatePayload(data []byte, update func(*CommandPayload)) []byte {
+	payload, ok := structuredPayload(data)
+	if !ok {
+		return data
+	}
+
+	update(&payload)
+
+	updated, err := json.Marshal(payload)
+	if err != nil {
+		return data
+	}
+
+	return updated
+}
+
+func isStructuredCommand(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("{"))
+}
+
+func validateCommandText(field, text string) error {
+	switch {
+	case text == "":
+		return fmt.Errorf("%s must not be empty", field)
+	case len(text) > maxCommandTextLength:
+		return fmt.Errorf("%s cannot be longer than %d bytes", field, maxCommandTextLength)
+	case !utf8.ValidString(text):
+		return fmt.Errorf("%s is not valid UTF-8", field)
+	}
+
+	return nil
+}
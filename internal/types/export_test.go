@@ -0,0 +1,26 @@
+package types
+
+import "time"
+
+// The helpers of the message sync are exported for the tests in types_test
+var (
+	BatchMessages     = batchMessages
+	AcknowledgedState = acknowledgedState
+	ClientHandshake   = clientHandshake
+
+	DeliveryInterval = &deliveryInterval
+	SignalInterval   = &signalInterval
+)
+
+const (
+	MaxBatchSize     = maxBatchSize
+	MaxBatchMessages = maxBatchMessages
+)
+
+// FindMessagesToSync returns the messages a sync with the peer sends for the remote state, in both formats
+func FindMessagesToSync(r *Room, peer *MessagingPeer, state SyncMap, times map[string]time.Time) ([]Message, []Message) {
+	if peer.Room != r {
+		peer.Room = r
+	}
+	return peer.findMessagesToSync(state), peer.findMessagesToSyncLegacy(times)
+}
@@ -0,0 +1,86 @@
+package types
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+const (
+	foundingNonceSize = 16
+)
+
+// CreateArgs are the arguments of RoomCommandCreate.
+// The id of the Room is derived from the founder and Nonce, see roomIDFor.
+type CreateArgs struct {
+	Nonce string `json:"nonce"`
+}
+
+func (a *CreateArgs) validate() error {
+	raw, err := base64.RawURLEncoding.DecodeString(a.Nonce)
+	if err != nil || len(raw) != foundingNonceSize {
+		return fmt.Errorf("invalid nonce \"%s\"", a.Nonce)
+	}
+
+	return nil
+}
+
+func (a *CreateArgs) fromLegacy(words []string) error {
+	if len(words) < 1 {
+		return fmt.Errorf("missing nonce")
+	}
+
+	a.Nonce = words[0]
+	return nil
+}
+
+func (a *CreateArgs) legacy() string {
+	return a.Nonce
+}
+
+// roomIDFor derives the id of a Room from the fingerprint of its founder and a random nonce,
+// so that nobody else can claim to have founded it
+func roomIDFor(founder, nonce string) uuid.UUID {
+	return uuid.NewHash(sha256.New(), uuid.Nil, []byte(founder+CommandDelimiter+nonce), 5)
+}
+
+// newGenesis creates the founding event of a Room for founder, and the id of the Room that is bound to it
+func newGenesis(founder Identity) (Message, uuid.UUID, error) {
+	raw := make([]byte, foundingNonceSize)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return Message{}, uuid.Nil, err
+	}
+
+	args := &CreateArgs{Nonce: base64.RawURLEncoding.EncodeToString(raw)}
+	content, err := NewCommandContent(RoomCommandCreate, args)
+	if err != nil {
+		return Message{}, uuid.Nil, err
+	}
+
+	roomID := roomIDFor(founder.Fingerprint(), args.Nonce)
+	return NewRoomMessage(content, founder, 0, roomID), roomID, nil
+}
+
+// VerifyGenesis checks that genesis is the founding event of the Room with the specified id,
+// and returns the fingerprint of the founder
+func VerifyGenesis(roomID uuid.UUID, genesis Message) (string, error) {
+	if genesis.Meta.SigVersion == LegacySigVersion || !genesis.BelongsTo(roomID) || !genesis.SigIsValid() {
+		return "", fmt.Errorf("founding event of room %s isn't signed for it", roomID)
+	}
+
+	args := &CreateArgs{}
+	err := parseCommandArgs(&genesis, RoomCommandCreate, args)
+	if err != nil {
+		return "", err
+	}
+
+	if roomIDFor(genesis.Meta.Sender, args.Nonce) != roomID {
+		return "", fmt.Errorf("%s didn't found room %s", genesis.Meta.Sender, roomID)
+	}
+
+	return genesis.Meta.Sender, nil
+}
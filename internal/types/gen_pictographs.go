@@ -0,0 +1,168 @@
+//go:build ignore
+// +build ignore
+
+// gen_pictographs generates pictographs_table.go from the emoji-data.txt of the Unicode Character Database.
+// The file is downloaded for the specified Unicode version, unless a local copy is passed with -data.
+//
+//	go run gen_pictographs.go -version 14.0.0
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const property = "Extended_Pictographic"
+
+var (
+	version = flag.String("version", "14.0.0", "version of the Unicode Character Database")
+	data    = flag.String("data", "", "local copy of emoji-data.txt, instead of downloading it")
+	output  = flag.String("output", "pictographs_table.go", "file the table is written to")
+)
+
+type codeRange struct {
+	lo, hi rune
+}
+
+func main() {
+	flag.Parse()
+
+	in, source, err := open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+
+	ranges, err := parse(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(ranges) == 0 {
+		log.Fatalf("%s doesn't contain any %s code points", source, property)
+	}
+
+	src, err := format.Source(generate(ranges))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = os.WriteFile(*output, src, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func open() (io.ReadCloser, string, error) {
+	if *data != "" {
+		f, err := os.Open(*data)
+		return f, *data, err
+	}
+
+	url := "https://www.unicode.org/Public/" + *version + "/ucd/emoji/emoji-data.txt"
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, url, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, url, fmt.Errorf("unable to download %s: %s", url, resp.Status)
+	}
+
+	return resp.Body, url, nil
+}
+
+// parse reads the ranges of the property from lines like
+// "1F000..1F0FF  ; Extended_Pictographic# 5.1  [256] (🀀..🃿)",
+// and merges the ones that are adjacent.
+func parse(r io.Reader) ([]codeRange, error) {
+	ranges := make([]codeRange, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Split(line, ";")
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) != property {
+			continue
+		}
+
+		bounds := strings.SplitN(strings.TrimSpace(fields[0]), "..", 2)
+		lo, err := strconv.ParseUint(bounds[0], 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			hi, err = strconv.ParseUint(bounds[1], 16, 32)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		ranges = append(ranges, codeRange{lo: rune(lo), hi: rune(hi)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].lo < ranges[j].lo })
+
+	merged := make([]codeRange, 0, len(ranges))
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && r.lo <= merged[last].hi+1 {
+			if r.hi > merged[last].hi {
+				merged[last].hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged, nil
+}
+
+func generate(ranges []codeRange) []byte {
+	var r16, r32 bytes.Buffer
+	latinOffset := 0
+
+	for _, r := range ranges {
+		switch {
+		case r.hi <= unicode.MaxLatin1:
+			latinOffset++
+			fallthrough
+		case r.hi <= 0xffff:
+			fmt.Fprintf(&r16, "{Lo: 0x%04x, Hi: 0x%04x, Stride: 1},\n", r.lo, r.hi)
+		default:
+			fmt.Fprintf(&r32, "{Lo: 0x%x, Hi: 0x%x, Stride: 1},\n", r.lo, r.hi)
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by gen_pictographs.go from the emoji-data.txt of Unicode %s. DO NOT EDIT.\n\n", *version)
+	b.WriteString("package types\n\n")
+	b.WriteString("import \"unicode\"\n\n")
+	fmt.Fprintf(&b, "// pictographs contains the code points of the %s property,\n", property)
+	b.WriteString("// which are shown as an emoji, see https://unicode.org/reports/tr51/\n")
+	b.WriteString("var pictographs = &unicode.RangeTable{\n")
+	fmt.Fprintf(&b, "R16: []unicode.Range16{\n%s},\n", r16.String())
+	fmt.Fprintf(&b, "R32: []unicode.Range32{\n%s},\n", r32.String())
+	fmt.Fprintf(&b, "LatinOffset: %d,\n", latinOffset)
+	b.WriteString("}\n")
+
+	return b.Bytes()
+}
@@ -0,0 +1,127 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+	"github.com/google/uuid"
+)
+
+const (
+	// HandshakeClient and HandshakeServer are the roles in the transcript of a mutual handshake,
+	// so that the signature of one side can't be used as the signature of the other.
+	HandshakeClient = "client"
+	HandshakeServer = "server"
+
+	handshakeContext = "onionmsg conversation handshake v1"
+
+	// legacyChallengeSize is the size of the random challenge sent by older daemons
+	legacyChallengeSize = 32
+)
+
+// HandshakeTranscript returns the data that is signed by the specified side of a mutual handshake.
+// It binds the signature to the protocol, the direction, both Hellos, the Room and both fingerprints,
+// so that it can't be replayed in any other context.
+// The hash is prefixed with the context, so that a transcript is never mistaken for the challenge of an older daemon.
+func HandshakeTranscript(role string, challenge, clientHello []byte, roomID uuid.UUID, clientFP, serverFP string) []byte {
+	fields := [][]byte{
+		[]byte(handshakeContext),
+		[]byte(role),
+		challenge,
+		clientHello,
+		roomID[:],
+		[]byte(clientFP),
+		[]byte(serverFP),
+	}
+
+	h := sha256.New()
+	for _, field := range fields {
+		l := make([]byte, 4)
+		binary.BigEndian.PutUint32(l, uint32(len(field)))
+		h.Write(l)
+		h.Write(field)
+	}
+
+	return h.Sum([]byte(handshakeContext))
+}
+
+// clientHandshake authenticates Self to the daemon of the peer for the Room,
+// and returns the Channel for the rest of the exchange.
+// Newer daemons send their Hello as the challenge, which is then answered with a Hello as well,
+// while older daemons send random bytes and only expect the signed challenge.
+// Those are only signed if they can't be anything else, and only if the peer never negotiated FeatureMutualAuth,
+// so that a downgrade can't be used to get arbitrary data signed.
+// If both sides support it, the peer has to prove its identity as well.
+// If the remote rejected the connection, a *ProtocolError is returned.
+func clientHandshake(conn connection.ConnWrapper, room *Room, peer Identity) (Protocol, Channel, error) {
+	challenge, err := conn.ReadBytes()
+	if err != nil {
+		return Protocol{}, nil, err
+	}
+
+	own := NewHello()
+	ownRaw, _ := json.Marshal(own)
+
+	var remote *Hello
+	if hello, ok := ParseHello(challenge); ok {
+		if hello.Error != nil {
+			return Protocol{}, nil, hello.Error
+		}
+
+		remote = &hello
+		conn.WriteBytes(ownRaw)
+	} else if len(challenge) != legacyChallengeSize {
+		return Protocol{}, nil, fmt.Errorf("invalid length for challenge, %d instead of %d", len(challenge), legacyChallengeSize)
+	} else if room.peerSupported(peer.Fingerprint(), FeatureMutualAuth) {
+		return Protocol{}, nil, fmt.Errorf("peer %s no longer supports mutual authentication", peer.Fingerprint())
+	}
+
+	proto := Negotiate(own, remote)
+	self := room.Self
+
+	conn.WriteString(self.Fingerprint())
+
+	if !proto.Supports(FeatureMutualAuth) {
+		signed, err := self.Sign(challenge)
+		if err != nil {
+			return Protocol{}, nil, err
+		}
+		conn.WriteBytes(signed)
+
+		ch := NewChannel(conn, proto)
+		ch.Send(FrameRoomID, room.ID)
+		ch.Flush()
+
+		return proto, ch, nil
+	}
+
+	//The Room is part of the transcript, so it's sent before the signature
+	conn.WriteBytes(room.ID[:])
+
+	signed, err := self.Sign(HandshakeTranscript(HandshakeClient, challenge, ownRaw, room.ID, self.Fingerprint(), peer.Fingerprint()))
+	if err != nil {
+		return Protocol{}, nil, err
+	}
+	conn.WriteBytes(signed)
+	conn.Flush()
+
+	ch := NewChannel(conn, proto)
+
+	var serverSig []byte
+	err = ch.Expect(FrameServerAuth, &serverSig)
+	if err != nil {
+		return Protocol{}, nil, err
+	}
+
+	ok, err := peer.Verify(HandshakeTranscript(HandshakeServer, challenge, ownRaw, room.ID, self.Fingerprint(), peer.Fingerprint()), serverSig)
+	if err != nil {
+		return Protocol{}, nil, err
+	} else if !ok {
+		return Protocol{}, nil, fmt.Errorf("peer %s failed to authenticate", peer.Fingerprint())
+	}
+
+	return proto, ch, nil
+}
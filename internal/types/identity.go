@@ -18,6 +18,8 @@ const (
 type IdentityMeta struct {
 	Nick  string `json:"nick"`
 	Admin bool   `json:"admin"`
+	//Role is empty for identities from older versions, see Identity.Role
+	Role Role `json:"role,omitempty"`
 }
 
 type Identity struct {
@@ -126,11 +128,7 @@ func (i Identity) ServiceID() string {
 }
 
 func (i Identity) Admin() bool {
-	if i.Meta == nil {
-		return false
-	}
-
-	return i.Meta.Admin
+	return i.Role().AtLeast(RoleAdmin)
 }
 
 func (i Identity) Nick() string {
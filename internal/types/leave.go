@@ -0,0 +1,126 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+)
+
+// syncWaiter is closed once a peer acknowledged the messages of Self up to seq
+type syncWaiter struct {
+	seq  uint64
+	done chan struct{}
+}
+
+// Leave records in the membership log that Self left the Room, and marks the Room as Leaving.
+// The returned channel is closed once at least one peer acknowledged it, so that the others learn about it from that peer.
+// If Self already left, only the acknowledgement is waited for.
+// Rooms without peers are left immediately.
+func (r *Room) Leave() (<-chan struct{}, error) {
+	r.msgUpdateMutex.Lock()
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+	r.Leaving = true
+	alone := len(r.Peers) == 0
+	left := r.leaveSeq != 0
+	r.msgUpdateMutex.Unlock()
+
+	if alone {
+		done := make(chan struct{})
+		close(done)
+		return done, nil
+	}
+
+	if !left {
+		content, err := NewCommandContent(RoomCommandLeave, nil)
+		if err != nil {
+			return nil, err
+		}
+		r.SendMessageToAllPeers(content)
+	}
+
+	return r.awaitLeaveSync()
+}
+
+// awaitLeaveSync returns a channel that is closed once a peer acknowledged the leave command of Self
+func (r *Room) awaitLeaveSync() (<-chan struct{}, error) {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	if r.leaveSeq == 0 {
+		return nil, fmt.Errorf("unable to leave room %s", r.ID)
+	}
+
+	waiter := syncWaiter{
+		seq:  r.leaveSeq,
+		done: make(chan struct{}),
+	}
+
+	for _, peer := range r.Peers {
+		if peer.LastSyncState[r.Self.Fingerprint()] >= waiter.seq {
+			close(waiter.done)
+			return waiter.done, nil
+		}
+	}
+
+	r.syncWaiters = append(r.syncWaiters, waiter)
+	return waiter.done, nil
+}
+
+// SetPeerSyncState records that the peer acknowledged all messages in state,
+// which completes the waits for acknowledgements up to it, and compacts the receipts all peers know.
+func (r *Room) SetPeerSyncState(fingerprint string, state SyncMap) {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	for _, peer := range r.Peers {
+		if peer.RIdentity.Fingerprint() == fingerprint {
+			peer.LastSyncState = state
+		}
+	}
+
+	var waiting []syncWaiter
+	for _, waiter := range r.syncWaiters {
+		if state[r.Self.Fingerprint()] >= waiter.seq {
+			close(waiter.done)
+		} else {
+			waiting = append(waiting, waiter)
+		}
+	}
+	r.syncWaiters = waiting
+
+	r.compactReceipts()
+}
+
+// peerSynced returns true if the peer already acknowledged all messages in state
+func (r *Room) peerSynced(peer *MessagingPeer, state SyncMap) bool {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	return SyncMapsEqual(state, peer.LastSyncState)
+}
+
+// leave removes sender from the roster.
+// If the owner leaves, the member with the highest role, and the lowest fingerprint among those, becomes the owner.
+func (members roster) leave(sender string) {
+	role := members[sender]
+	delete(members, sender)
+
+	if role != RoleOwner || len(members) == 0 {
+		return
+	}
+
+	successors := make([]string, 0, len(members))
+	for fingerprint := range members {
+		successors = append(successors, fingerprint)
+	}
+	sort.Slice(successors, func(i, j int) bool {
+		a, b := members[successors[i]], members[successors[j]]
+		if a != b {
+			return a.AtLeast(b)
+		}
+		return successors[i] < successors[j]
+	})
+
+	members[successors[0]] = RoleOwner
+}
@@ -0,0 +1,92 @@
+package types_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+)
+
+func leaveMessage(t *testing.T, sender Identity) Message {
+	content, err := NewCommandContent(RoomCommandLeave, nil)
+	assert.NoError(t, err)
+
+	return NewMessage(content, sender, 1)
+}
+
+func TestLeaveRemovesMember(t *testing.T) {
+	room, x := setupRoleTests(t)
+
+	replica := replicate(t, room, leaveMessage(t, x))
+
+	assert.NotContains(t, replica.Info().Roles, x.Fingerprint())
+	_, found := replica.PeerByFingerprint(x.Fingerprint())
+	assert.False(t, found)
+}
+
+func TestLeaveOwnerSuccessor(t *testing.T) {
+	room, x := setupRoleTests(t)
+	y := inviteMember(t, room)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, y.Fingerprint()))
+
+	replica := replicate(t, room, leaveMessage(t, room.Self))
+
+	assert.Equal(t, RoleOwner, replica.Info().Roles[y.Fingerprint()])
+	assert.Equal(t, RoleMember, replica.Info().Roles[x.Fingerprint()])
+	assert.NotContains(t, replica.Info().Roles, room.Self.Fingerprint())
+}
+
+// acknowledgedWithin returns true if the channel is closed before the timeout
+func acknowledgedWithin(acknowledged <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-acknowledged:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestLeaveWithoutPeers(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+
+	acknowledged, err := room.Leave()
+	assert.NoError(t, err)
+	assert.True(t, acknowledgedWithin(acknowledged, time.Millisecond))
+	assert.Empty(t, room.Messages)
+}
+
+func TestLeaveWaitsForAcknowledgement(t *testing.T) {
+	room, _ := setupRoleTests(t)
+
+	acknowledged, err := room.Leave()
+	assert.NoError(t, err)
+	assert.True(t, room.Info().Leaving)
+	assert.False(t, acknowledgedWithin(acknowledged, 10*time.Millisecond))
+	leave := room.Messages[len(room.Messages)-1]
+
+	//Leaving again only waits for the acknowledgement of the first leave command
+	again, err := room.Leave()
+	assert.NoError(t, err)
+	room.SetPeerSyncState(room.Peers[0].RIdentity.Fingerprint(), SyncMap{room.Self.Fingerprint(): leave.Meta.Seq})
+	assert.True(t, acknowledgedWithin(acknowledged, 10*time.Millisecond))
+	assert.True(t, acknowledgedWithin(again, 10*time.Millisecond))
+	assert.Equal(t, leave.ID, room.Messages[len(room.Messages)-1].ID)
+}
+
+func TestLeaveRejectedByPeer(t *testing.T) {
+	room, _ := setupRoleTests(t)
+
+	acknowledged, err := room.Leave()
+	assert.NoError(t, err)
+	leave := room.Messages[len(room.Messages)-1]
+
+	//A sync in which the peer rejected the leave command doesn't acknowledge it
+	state := AcknowledgedState(room.SyncStateCopy(), []Message{leave})
+	assert.Equal(t, leave.Meta.Seq-1, state[room.Self.Fingerprint()])
+
+	room.SetPeerSyncState(room.Peers[0].RIdentity.Fingerprint(), state)
+	assert.False(t, acknowledgedWithin(acknowledged, 10*time.Millisecond))
+}
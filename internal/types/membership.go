@@ -0,0 +1,355 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	//membershipCommands change who is a member of a Room or which role a member has.
+	//Together they form the membership log, from which the roster is rebuilt.
+	membershipCommands = map[Command]struct{}{
+		RoomCommandInvite:            {},
+		RoomCommandRemovePeer:        {},
+		RoomCommandPromote:           {},
+		RoomCommandDemote:            {},
+		RoomCommandSetRole:           {},
+		RoomCommandTransferOwnership: {},
+		RoomCommandLeave:             {},
+		RoomCommandBan:               {},
+		RoomCommandUnban:             {},
+	}
+)
+
+// roster maps the fingerprint of every member to its role
+type roster map[string]Role
+
+// roleHistory contains the changes of the role of every member in the order of the membership log, see Room.roleAt
+type roleHistory map[string][]roleChange
+
+// roleChange is the role a member has after event, which is empty if it isn't a member anymore.
+// seen is the Seen of event, if the member is the peer it refers to.
+// The founder is the owner from the start, which has no event.
+type roleChange struct {
+	event *Message
+	seen  *uint64
+	role  Role
+}
+
+func (m *Message) isMembershipEvent() bool {
+	isCmd, cmd := m.isCommand()
+	if !isCmd {
+		return false
+	}
+
+	_, ok := membershipCommands[Command(cmd)]
+	return ok
+}
+
+// eventParents returns the ids of the membership events that msg was created after.
+// Commands from older versions have no parents.
+func eventParents(msg Message) []string {
+	payload, ok := structuredPayload(msg.Content.Data)
+	if !ok {
+		return legacyParents(msg.Content.Data)
+	}
+
+	return payload.Parents
+}
+
+// withParents adds the current heads of the membership log to the structured membership command in data,
+// so that every peer orders it after all events that were known when it was created.
+// It also records up to which message of the peer it refers to the sender knew, see CommandPayload.Seen.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) withParents(data []byte) []byte {
+	return updatePayload(data, func(payload *CommandPayload) {
+		payload.Parents = r.eventHeads()
+
+		if target := payloadTarget(*payload); target != "" {
+			seen := r.SyncState[target]
+			payload.Seen = &seen
+		}
+	})
+}
+
+// payloadTarget returns the fingerprint of the peer a structured command refers to, if any
+func payloadTarget(payload CommandPayload) string {
+	args := struct {
+		Fingerprint string `json:"fingerprint"`
+	}{}
+	if json.Unmarshal(payload.Args, &args) != nil {
+		return ""
+	}
+
+	return args.Fingerprint
+}
+
+// eventTarget returns the fingerprint of the peer a membership event refers to, if any
+func eventTarget(event Message) string {
+	if payload, ok := structuredPayload(event.Content.Data); ok {
+		return payloadTarget(payload)
+	}
+
+	words := withoutLegacyOrder(commandName(event.Content.Data), strings.Split(string(event.Content.Data), CommandDelimiter)[1:])
+	if len(words) == 0 {
+		return ""
+	}
+	return words[0]
+}
+
+// eventSeen returns the Seen of a membership event, which events of older versions don't have
+func eventSeen(event Message) *uint64 {
+	payload, ok := structuredPayload(event.Content.Data)
+	if !ok {
+		if seen, ok := legacySeen(event.Content.Data); ok {
+			return &seen
+		}
+		return nil
+	}
+
+	return payload.Seen
+}
+
+// eventHeads returns the ids of all membership events that aren't the parent of another one
+func (r *Room) eventHeads() []string {
+	return r.memberLog.sortedHeads()
+}
+
+// inMembershipLog returns true if fingerprint belongs to a current member,
+// or to someone who was a member at any point of the membership log
+func (r *Room) inMembershipLog(fingerprint string) bool {
+	if _, member := r.memberByFingerprint(fingerprint); member || fingerprint == r.Founder {
+		return true
+	}
+
+	_, invited := r.memberLog.invited[fingerprint]
+	return invited
+}
+
+// earlierEvent returns true if a has an earlier time than b, or the same time and a lower id
+func earlierEvent(a, b Message) bool {
+	if !a.Meta.Time.Equal(b.Meta.Time) {
+		return a.Meta.Time.Before(b.Meta.Time)
+	}
+	return a.ID < b.ID
+}
+
+// record adds the roles that changed with event to the history
+func (history roleHistory) record(event Message, before, after roster) {
+	changed := make(map[string]struct{})
+	for fingerprint, role := range before {
+		if after[fingerprint] != role {
+			changed[fingerprint] = struct{}{}
+		}
+	}
+	for fingerprint, role := range after {
+		if before[fingerprint] != role {
+			changed[fingerprint] = struct{}{}
+		}
+	}
+
+	for fingerprint := range changed {
+		change := roleChange{event: &event, role: after[fingerprint]}
+		if fingerprint == eventTarget(event) {
+			change.seen = eventSeen(event)
+		}
+		history[fingerprint] = append(history[fingerprint], change)
+	}
+}
+
+func (members roster) copy() roster {
+	copied := make(roster, len(members))
+	for fingerprint, role := range members {
+		copied[fingerprint] = role
+	}
+
+	return copied
+}
+
+// apply changes the roster according to event, with the same rules as the command callbacks
+func (members roster) apply(event Message, bans banList) error {
+	command := commandName(event.Content.Data)
+
+	required := RequiredRole(command)
+	if command == RoomCommandInvite && isLegacyEvent(event) {
+		//Before there were roles every member could invite, the events of older versions keep that rule
+		required = RoleMember
+	}
+
+	senderRole, ok := members[event.Meta.Sender]
+	if !ok {
+		return peerNotFoundError(event.Meta.Sender)
+	} else if !senderRole.AtLeast(required) {
+		return peerNotAdminError(event.Meta.Sender)
+	}
+
+	if command == RoomCommandLeave {
+		members.leave(event.Meta.Sender)
+		return nil
+	}
+
+	if command == RoomCommandInvite {
+		args := &InviteArgs{}
+		err := parseCommandArgs(&event, command, args)
+		if err != nil {
+			return err
+		}
+
+		return bans.invite(members, args)
+	}
+
+	if command == RoomCommandSetRole {
+		args := &SetRoleArgs{}
+		err := parseCommandArgs(&event, command, args)
+		if err != nil {
+			return err
+		}
+
+		if !members.mayManage(senderRole, args.Fingerprint) || args.Role == RoleOwner || !senderRole.AtLeast(args.Role) {
+			return peerNotAdminError(event.Meta.Sender)
+		}
+		members[args.Fingerprint] = args.Role
+		return nil
+	}
+
+	args := &PeerArgs{}
+	err := parseCommandArgs(&event, command, args)
+	if err != nil {
+		return err
+	}
+	target := args.Fingerprint
+
+	switch command {
+	case RoomCommandBan, RoomCommandUnban:
+		return bans.apply(members, senderRole, command, target)
+	case RoomCommandTransferOwnership:
+		if _, found := members[target]; !found || senderRole != RoleOwner {
+			return peerNotAdminError(event.Meta.Sender)
+		}
+		members[target] = RoleOwner
+		members[event.Meta.Sender] = RoleAdmin
+		return nil
+	}
+
+	if !members.mayManage(senderRole, target) {
+		return peerNotAdminError(event.Meta.Sender)
+	}
+
+	switch command {
+	case RoomCommandRemovePeer:
+		delete(members, target)
+	case RoomCommandPromote:
+		members[target] = RoleAdmin
+	case RoomCommandDemote:
+		members[target] = RoleMember
+	}
+
+	return nil
+}
+
+// isLegacyEvent returns true for membership events created by versions without roles,
+// which neither have a structured payload nor refer to their parents
+func isLegacyEvent(event Message) bool {
+	return !isStructuredCommand(event.Content.Data) && len(legacyParents(event.Content.Data)) == 0
+}
+
+// mayManage is the equivalent of the function of the same name for identities
+func (members roster) mayManage(managerRole Role, target string) bool {
+	targetRole, found := members[target]
+	return found && targetRole != RoleOwner && managerRole.AtLeast(targetRole)
+}
+
+// rebuildRoster replays the membership log and updates the peers and all roles to match it.
+// Rooms without any membership events keep their peers as they are,
+// and so do peers that the known events don't mention yet, e.g. while their invitation is still synced.
+// It returns the fingerprints of the peers that were removed.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) rebuildRoster() []string {
+	if r.memberLog.empty() {
+		return nil
+	}
+
+	lf := log.Fields{"room": r.ID.String()}
+	if r.memberLog.order() {
+		log.WithFields(lf).Debug("membership log contains a cycle")
+	}
+
+	//Rooms created by older versions have no founding event, and joining peers don't know the founder.
+	//The sender of the first membership event is assumed to be it, and kept from then on.
+	if r.Founder == "" {
+		r.Founder = r.memberLog.earliest().Meta.Sender
+	}
+
+	members, bans, history := r.memberLog.replay(r.Founder)
+	r.bans = bans
+	r.roleHistory = history
+
+	var removed []string
+	for _, peer := range r.Peers {
+		if _, logged := history[peer.RIdentity.Fingerprint()]; !logged {
+			continue
+		}
+
+		role, found := members[peer.RIdentity.Fingerprint()]
+		if !found {
+			removed = append(removed, peer.RIdentity.Fingerprint())
+			continue
+		}
+		peer.RIdentity.SetRole(role)
+	}
+
+	for _, fingerprint := range removed {
+		r.removePeer(fingerprint)
+		log.WithFields(lf).WithField("peer", fingerprint).Debug("peer removed from room")
+	}
+
+	for fingerprint, role := range members {
+		if _, found := r.memberByFingerprint(fingerprint); found {
+			continue
+		}
+
+		peerID, err := NewIdentity(Remote, fingerprint)
+		if err != nil {
+			continue
+		}
+		peerID.SetRole(role)
+		peerID.Meta.Nick = r.stateNick(fingerprint)
+
+		newPeer := NewMessagingPeer(peerID)
+		r.Peers = append(r.Peers, newPeer)
+		if r.Ctx != nil {
+			go newPeer.RunMessageQueue(r.Ctx, r)
+		}
+
+		log.WithFields(lf).WithField("peer", fingerprint).Debug("new peer added to room")
+	}
+
+	//Until the event that added Self arrived, its role is kept
+	if role, found := members[r.Self.Fingerprint()]; found {
+		r.Self.SetRole(role)
+	}
+
+	//State commands may have become valid or invalid at their position
+	r.rebuildState()
+
+	return removed
+}
+
+// rotatesKeyAfter returns true if Self has to distribute a new room key after events removed peers.
+// Whoever removed them does so, and the owner as well, since nobody else does when a member leaves.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) rotatesKeyAfter(events []Message) bool {
+	if r.Self.Role() == RoleOwner {
+		return true
+	}
+
+	for _, event := range events {
+		if r.isSelf(event.Meta.Sender) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,586 @@
+package types
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// replayCheckpointInterval is the number of events between two saved states of a replay,
+	// from which later replays continue, see membershipLog.replay
+	replayCheckpointInterval = 32
+)
+
+// membershipLog contains the membership events of a Room in the order they are replayed in.
+// The order and the replays are kept between batches, so that a batch only orders and replays
+// the events from the earliest position it affected on.
+type membershipLog struct {
+	//events are in causal order, every event comes after its parents,
+	//events that don't depend on each other are ordered by id
+	events []*logEvent
+	byID   map[string]*logEvent
+	//bySender contains the events of every sender, in the order they were received
+	bySender map[string][]*logEvent
+	//byTime contains all events ordered by earlierEvent, which orders the events of older versions, see timeOrdered
+	byTime []*logEvent
+	//missing contains the events that list a parent which wasn't received yet, by the id of the parent
+	missing map[string][]*logEvent
+	//referenced contains the ids of all events that are listed as a parent
+	referenced map[string]struct{}
+	heads      map[string]struct{}
+	invited    map[string]struct{}
+
+	//added contains the events that weren't ordered yet
+	added []*logEvent
+	//orderFrom is the position from which the order has to be computed again,
+	//replayFrom the one from which the replays have to be repeated
+	orderFrom  int
+	replayFrom int
+	//firstBreak is the position of the first event that was ordered to break a cycle, if any
+	firstBreak int
+
+	//room is the id of the Room, which the signatures of invited contacts cover, see banList.invite
+	room    uuid.UUID
+	founder string
+	rounds  []replayRound
+}
+
+// logEvent is a membership event together with its place in the membershipLog
+type logEvent struct {
+	msg Message
+	pos int
+	//timeOrdered is set for events without parents, which are taken to be created
+	//after every event with an earlier time, see earlierEvent
+	timeOrdered bool
+	//parents contains the parents that were received, children the events that list this one as a parent
+	parents  []*logEvent
+	children []*logEvent
+
+	//The state while ordering, see membershipLog.order
+	done    bool
+	queued  bool
+	pending int
+}
+
+func newMembershipLog(room uuid.UUID) *membershipLog {
+	return &membershipLog{
+		room:       room,
+		byID:       make(map[string]*logEvent),
+		bySender:   make(map[string][]*logEvent),
+		missing:    make(map[string][]*logEvent),
+		referenced: make(map[string]struct{}),
+		heads:      make(map[string]struct{}),
+		invited:    make(map[string]struct{}),
+		firstBreak: -1,
+	}
+}
+
+func (l *membershipLog) empty() bool {
+	return len(l.byID) == 0
+}
+
+// add adds a membership event to the log, which is ordered with the next call of order.
+// It determines the earliest position the event can change the order at,
+// since the order before it stays the same.
+func (l *membershipLog) add(msg Message) {
+	if _, known := l.byID[msg.ID]; known {
+		return
+	}
+
+	event := &logEvent{msg: msg, pos: -1}
+	claimed := eventParents(msg)
+	event.timeOrdered = len(claimed) == 0
+
+	from := len(l.events)
+	lowerFrom := func(pos int) {
+		if pos >= 0 && pos < from {
+			from = pos
+		}
+	}
+
+	for _, id := range claimed {
+		l.referenced[id] = struct{}{}
+		delete(l.heads, id)
+
+		if id == msg.ID || event.hasParent(id) {
+			continue
+		}
+
+		if parent, ok := l.byID[id]; ok {
+			event.parents = append(event.parents, parent)
+			parent.children = append(parent.children, event)
+		} else {
+			l.missing[id] = append(l.missing[id], event)
+		}
+	}
+
+	//Events that listed this one as a missing parent can't come before it anymore
+	for _, child := range l.missing[msg.ID] {
+		child.parents = append(child.parents, event)
+		event.children = append(event.children, child)
+		lowerFrom(child.pos)
+	}
+	delete(l.missing, msg.ID)
+
+	i := sort.Search(len(l.byTime), func(i int) bool {
+		return earlierEvent(msg, l.byTime[i].msg)
+	})
+	l.byTime = append(l.byTime, nil)
+	copy(l.byTime[i+1:], l.byTime[i:])
+	l.byTime[i] = event
+
+	//The event can be ordered right after the last of its parents,
+	//and the events of older versions with a later time have to come after it
+	earliest := 0
+	if event.timeOrdered {
+		for _, earlier := range l.byTime[:i] {
+			if earlier.pos+1 > earliest {
+				earliest = earlier.pos + 1
+			}
+		}
+	}
+	for _, parent := range event.parents {
+		if parent.pos+1 > earliest {
+			earliest = parent.pos + 1
+		}
+	}
+	lowerFrom(earliest)
+
+	for _, later := range l.byTime[i+1:] {
+		if later.timeOrdered {
+			lowerFrom(later.pos)
+		}
+	}
+
+	//Breaking a cycle picks the lowest pending id, which may now be this event
+	lowerFrom(l.firstBreak)
+
+	if from < l.orderFrom {
+		l.orderFrom = from
+	}
+
+	l.byID[msg.ID] = event
+	l.bySender[msg.Meta.Sender] = append(l.bySender[msg.Meta.Sender], event)
+	l.added = append(l.added, event)
+
+	if _, ok := l.referenced[msg.ID]; !ok {
+		l.heads[msg.ID] = struct{}{}
+	}
+
+	if commandName(msg.Content.Data) == RoomCommandInvite {
+		args := &InviteArgs{}
+		if parseCommandArgs(&msg, RoomCommandInvite, args) == nil {
+			l.invited[args.Fingerprint] = struct{}{}
+		}
+	}
+}
+
+func (e *logEvent) hasParent(id string) bool {
+	for _, parent := range e.parents {
+		if parent.msg.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortedHeads returns the ids of all events that aren't the parent of another one
+func (l *membershipLog) sortedHeads() []string {
+	heads := make([]string, 0, len(l.heads))
+	for id := range l.heads {
+		heads = append(heads, id)
+	}
+	sort.Strings(heads)
+
+	return heads
+}
+
+// earliest returns the event with the oldest time
+func (l *membershipLog) earliest() Message {
+	return l.byTime[0].msg
+}
+
+// order places the added events in the causal order, by ordering all events from the earliest position they affect again.
+// Every event comes after its parents, events that don't depend on each other are ordered by id.
+// It returns true if a cycle had to be broken, which the events of older versions can form with events
+// that list them as parents, but have an earlier time. Cycles are broken at the lowest id.
+func (l *membershipLog) order() bool {
+	if len(l.added) == 0 {
+		return false
+	}
+
+	from := l.orderFrom
+	remaining := append(l.added, l.events[from:]...)
+	l.events = l.events[:from]
+	l.added = nil
+	l.orderFrom = len(l.byID)
+	if l.firstBreak >= from {
+		l.firstBreak = -1
+	}
+	if from < l.replayFrom {
+		l.replayFrom = from
+	}
+
+	//The events before from stay done since they were ordered
+	for _, event := range remaining {
+		event.done, event.queued, event.pending, event.pos = false, false, 0, -1
+	}
+
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].msg.ID < remaining[j].msg.ID
+	})
+
+	ready := &eventHeap{}
+	for _, event := range remaining {
+		for _, parent := range event.parents {
+			if !parent.done {
+				event.pending++
+			}
+		}
+		if !event.timeOrdered && event.pending == 0 {
+			event.queued = true
+			heap.Push(ready, event)
+		}
+	}
+
+	//Events of older versions are ready once all events with an earlier time are done
+	timeDone := 0
+	advanceTime := func() {
+		for timeDone < len(l.byTime) && l.byTime[timeDone].done {
+			timeDone++
+		}
+		if timeDone < len(l.byTime) {
+			next := l.byTime[timeDone]
+			if next.timeOrdered && !next.queued {
+				next.queued = true
+				heap.Push(ready, next)
+			}
+		}
+	}
+	advanceTime()
+
+	lowest := 0
+	broken := false
+	for len(l.events) < len(l.byID) {
+		var next *logEvent
+		if ready.Len() > 0 {
+			next = heap.Pop(ready).(*logEvent)
+		} else {
+			for remaining[lowest].done {
+				lowest++
+			}
+			next = remaining[lowest]
+			broken = true
+			if l.firstBreak == -1 {
+				l.firstBreak = len(l.events)
+			}
+		}
+
+		if next.done {
+			continue
+		}
+
+		next.done = true
+		next.pos = len(l.events)
+		l.events = append(l.events, next)
+
+		for _, child := range next.children {
+			child.pending--
+			if !child.done && !child.timeOrdered && child.pending == 0 && !child.queued {
+				child.queued = true
+				heap.Push(ready, child)
+			}
+		}
+		advanceTime()
+	}
+
+	return broken
+}
+
+// isAncestor returns true if event was created after ancestor.
+// Since the order places every event after its parents, only the events in between are searched.
+// Paths through events that were ordered before ancestor to break a cycle are therefore not found.
+func (l *membershipLog) isAncestor(ancestor, event *logEvent) bool {
+	if ancestor.pos >= event.pos {
+		return false
+	}
+
+	visited := map[*logEvent]struct{}{event: {}}
+	stack := []*logEvent{event}
+	visit := func(parent *logEvent) bool {
+		if parent == ancestor {
+			return true
+		}
+		if _, seen := visited[parent]; !seen && parent.pos > ancestor.pos {
+			visited[parent] = struct{}{}
+			stack = append(stack, parent)
+		}
+		return false
+	}
+
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if current.timeOrdered {
+			for _, earlier := range l.events[ancestor.pos:current.pos] {
+				if earlierEvent(earlier.msg, current.msg) && visit(earlier) {
+					return true
+				}
+			}
+			continue
+		}
+
+		for _, parent := range current.parents {
+			if visit(parent) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// concurrent returns true if neither event was created after the other
+func (l *membershipLog) concurrent(a, b *logEvent) bool {
+	return a != b && !l.isAncestor(a, b) && !l.isAncestor(b, a)
+}
+
+// eventHeap orders the events that are ready by id
+type eventHeap []*logEvent
+
+func (h eventHeap) Len() int            { return len(h) }
+func (h eventHeap) Less(i, j int) bool  { return h[i].msg.ID < h[j].msg.ID }
+func (h eventHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *eventHeap) Push(x interface{}) { *h = append(*h, x.(*logEvent)) }
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	event := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return event
+}
+
+// replayRound is a replay of the ordered log, in which the events in vetoed are skipped.
+// checkpoints[i] is the state before the event at position i*replayCheckpointInterval.
+type replayRound struct {
+	vetoed      map[string]struct{}
+	checkpoints []replayState
+	final       replayState
+}
+
+// replayState is the state of a replay after some of the events.
+// revocations contains the ids of the events by which someone else removed a member or lowered their role, by member.
+type replayState struct {
+	members     roster
+	bans        banList
+	history     roleHistory
+	revocations map[string][]string
+}
+
+func newReplayState(founder string, room uuid.UUID) replayState {
+	return replayState{
+		members:     roster{founder: RoleOwner},
+		bans:        newBanList(room),
+		history:     roleHistory{founder: {{role: RoleOwner}}},
+		revocations: make(map[string][]string),
+	}
+}
+
+// snapshot returns a copy of the state, which doesn't change when replaying further events on either of them
+func (s replayState) snapshot() replayState {
+	bans := newBanList(s.bans.room)
+	for fingerprint := range s.bans.banned {
+		bans.banned[fingerprint] = struct{}{}
+	}
+	for fingerprint, contact := range s.bans.contacts {
+		bans.contacts[fingerprint] = contact
+	}
+
+	//The slices are capped, so that appending to them copies them first
+	history := make(roleHistory, len(s.history))
+	for fingerprint, changes := range s.history {
+		history[fingerprint] = changes[:len(changes):len(changes)]
+	}
+	revocations := make(map[string][]string, len(s.revocations))
+	for fingerprint, ids := range s.revocations {
+		revocations[fingerprint] = ids[:len(ids):len(ids)]
+	}
+
+	return replayState{
+		members:     s.members.copy(),
+		bans:        bans,
+		history:     history,
+		revocations: revocations,
+	}
+}
+
+// apply applies event, unless it is vetoed or its sender wasn't allowed to create it
+func (s *replayState) apply(event Message, vetoed map[string]struct{}) {
+	if _, ok := vetoed[event.ID]; ok {
+		log.Debugf("skipping membership event %s, since its sender lost their role concurrently", event.ID)
+		return
+	}
+
+	before := s.members.copy()
+	err := s.members.apply(event, s.bans)
+	if err != nil {
+		log.WithError(err).Debugf("skipping membership event %s", event.ID)
+		return
+	}
+
+	for fingerprint, role := range before {
+		if fingerprint == event.Meta.Sender {
+			continue
+		}
+		if newRole, found := s.members[fingerprint]; !found || !newRole.AtLeast(role) {
+			s.revocations[fingerprint] = append(s.revocations[fingerprint], event.ID)
+		}
+	}
+
+	s.history.record(event, before, s.members)
+}
+
+// replay replays the ordered log starting with the founder as the owner.
+// Events that their sender wasn't allowed to create at their position are skipped.
+// If someone else removed a member or lowered their role, the events of that member
+// which were created concurrently to it are skipped as well, no matter where they are ordered.
+// Otherwise whoever loses a role could claim to have used it before, by listing old parents.
+// Skipping events can change which revocations are applied, so the log is replayed in rounds
+// until no more events are skipped. The vetoes only grow, so this ends after at most one round per event.
+// Every round continues the same round of the last call, or the previous round of this call,
+// from the earliest position at which the order or the skipped events differ.
+func (l *membershipLog) replay(founder string) (roster, banList, roleHistory) {
+	if founder != l.founder {
+		l.founder = founder
+		l.rounds = nil
+	}
+
+	rounds := make([]replayRound, 0, len(l.rounds))
+	vetoed := make(map[string]struct{})
+	concurrent := make(map[[2]*logEvent]bool)
+
+	for k := 0; ; k++ {
+		var base *replayRound
+		from := 0
+		if k < len(l.rounds) {
+			base = &l.rounds[k]
+			from = minInt(l.replayFrom, l.firstDifference(base.vetoed, vetoed))
+		}
+		if k > 0 {
+			if same := l.firstDifference(rounds[k-1].vetoed, vetoed); base == nil || same > from {
+				base, from = &rounds[k-1], same
+			}
+		}
+
+		round := l.replayRound(founder, base, from, vetoed)
+		rounds = append(rounds, round)
+
+		next, more := l.vetoes(round, concurrent)
+		if !more {
+			break
+		}
+		vetoed = next
+	}
+
+	l.rounds = rounds
+	l.replayFrom = len(l.events)
+
+	final := rounds[len(rounds)-1].final
+	return final.members, final.bans, final.history
+}
+
+// replayRound replays the events from the last checkpoint of base before from on,
+// or all of them if there is no base
+func (l *membershipLog) replayRound(founder string, base *replayRound, from int, vetoed map[string]struct{}) replayRound {
+	round := replayRound{vetoed: vetoed}
+	state := newReplayState(founder, l.room)
+	start := 0
+
+	if base != nil && len(base.checkpoints) > 0 {
+		n := from / replayCheckpointInterval
+		if n >= len(base.checkpoints) {
+			n = len(base.checkpoints) - 1
+		}
+
+		round.checkpoints = append(round.checkpoints, base.checkpoints[:n+1]...)
+		state = base.checkpoints[n].snapshot()
+		start = n * replayCheckpointInterval
+	}
+
+	for i := start; i < len(l.events); i++ {
+		if i%replayCheckpointInterval == 0 && i/replayCheckpointInterval == len(round.checkpoints) {
+			round.checkpoints = append(round.checkpoints, state.snapshot())
+		}
+
+		state.apply(l.events[i].msg, vetoed)
+	}
+
+	round.final = state
+	return round
+}
+
+// vetoes returns the events of round.vetoed, and those that were created concurrently
+// to a revocation of their sender in round. It also returns whether there are any new ones.
+func (l *membershipLog) vetoes(round replayRound, concurrent map[[2]*logEvent]bool) (map[string]struct{}, bool) {
+	vetoed := make(map[string]struct{}, len(round.vetoed))
+	for id := range round.vetoed {
+		vetoed[id] = struct{}{}
+	}
+
+	more := false
+	for member, revocations := range round.final.revocations {
+		for _, event := range l.bySender[member] {
+			if _, ok := vetoed[event.msg.ID]; ok {
+				continue
+			}
+
+			for _, id := range revocations {
+				pair := [2]*logEvent{event, l.byID[id]}
+				isConcurrent, ok := concurrent[pair]
+				if !ok {
+					isConcurrent = l.concurrent(pair[0], pair[1])
+					concurrent[pair] = isConcurrent
+				}
+
+				if isConcurrent {
+					vetoed[event.msg.ID] = struct{}{}
+					more = true
+					break
+				}
+			}
+		}
+	}
+
+	return vetoed, more
+}
+
+// firstDifference returns the earliest position of an event that is contained in only one of a and b
+func (l *membershipLog) firstDifference(a, b map[string]struct{}) int {
+	first := len(l.events)
+	compare := func(a, b map[string]struct{}) {
+		for id := range a {
+			if _, ok := b[id]; !ok && l.byID[id].pos < first {
+				first = l.byID[id].pos
+			}
+		}
+	}
+	compare(a, b)
+	compare(b, a)
+
+	return first
+}
+
+func minInt(values ...int) int {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+
+	return min
+}
@@ -0,0 +1,246 @@
+package types_test
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+)
+
+// newReplica creates a Room with the same founder as room, without any messages
+func newReplica(t *testing.T, room *Room) *Room {
+	replica, _ := NewRoom(context.Background())
+	t.Cleanup(replica.StopQueues)
+
+	replica.Founder = room.Founder
+	founder, _ := NewIdentity(Remote, room.Self.Fingerprint())
+	founder.SetRole(RoleOwner)
+	replica.Peers = append(replica.Peers, NewMessagingPeer(founder))
+
+	return replica
+}
+
+// replicate creates a Room with the same founder as room, to which all messages of room are pushed
+func replicate(t *testing.T, room *Room, msgs ...Message) *Room {
+	replica := newReplica(t, room)
+	replica.PushMessages(room.Messages...)
+	replica.PushMessages(msgs...)
+
+	return replica
+}
+
+func eventMessage(t *testing.T, sender Identity, command Command, target string, parents ...string) Message {
+	args, _ := json.Marshal(PeerArgs{Fingerprint: target})
+	data, _ := json.Marshal(CommandPayload{
+		Version: CommandPayloadVersion,
+		Command: command,
+		Args:    args,
+		Parents: parents,
+	})
+
+	return NewMessage(MessageContent{Type: ContentTypeCmd, Data: data}, sender, 1)
+}
+
+func TestMembershipLogRebuildsRoster(t *testing.T) {
+	room, x := setupRoleTests(t)
+	y := inviteMember(t, room)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, x.Fingerprint()))
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandRemovePeer, y.Fingerprint()))
+
+	replica := replicate(t, room)
+
+	assert.Len(t, room.Peers, 1)
+	assert.Equal(t, room.Info().Roles[x.Fingerprint()], replica.Info().Roles[x.Fingerprint()])
+	assert.NotContains(t, replica.Info().Roles, y.Fingerprint())
+}
+
+func TestMembershipLogConcurrentEvents(t *testing.T) {
+	room, x := setupRoleTests(t)
+	y := inviteMember(t, room)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, x.Fingerprint()))
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, y.Fingerprint()))
+	head := room.Messages[len(room.Messages)-1].ID
+
+	//Both admins demote each other without knowing about the other event
+	demoteY := eventMessage(t, x, RoomCommandDemote, y.Fingerprint(), head)
+	demoteX := eventMessage(t, y, RoomCommandDemote, x.Fingerprint(), head)
+
+	first := replicate(t, room, demoteY, demoteX)
+	second := replicate(t, room, demoteX, demoteY)
+
+	for _, fp := range []string{x.Fingerprint(), y.Fingerprint()} {
+		assert.Equal(t, first.Info().Roles[fp], second.Info().Roles[fp])
+	}
+	assert.NotEqual(t, first.Info().Roles[x.Fingerprint()], first.Info().Roles[y.Fingerprint()])
+}
+
+func TestMembershipEventParents(t *testing.T) {
+	room, x := setupRoleTests(t)
+	invite := room.Messages[len(room.Messages)-1].ID
+
+	room.SetPeerProtocol(x.Fingerprint(), Protocol{Features: map[string]bool{FeatureCommandPayload: true}})
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, x.Fingerprint()))
+
+	payload := CommandPayload{}
+	assert.NoError(t, json.Unmarshal(room.Messages[len(room.Messages)-1].Content.Data, &payload))
+	assert.Equal(t, []string{invite}, payload.Parents)
+}
+
+func TestMembershipLogRevocationWins(t *testing.T) {
+	room, x := setupRoleTests(t)
+	y := inviteMember(t, room)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, x.Fingerprint()))
+	promote := room.Messages[len(room.Messages)-1].ID
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandDemote, x.Fingerprint()))
+
+	//The demoted admin claims to have removed y before learning about the demotion
+	remove := eventMessage(t, x, RoomCommandRemovePeer, y.Fingerprint(), promote)
+	//or in the old format without parents, backdated to before the demotion
+	legacyRemove := commandMessage(t, x, 2, RoomCommandRemovePeer, y.Fingerprint())
+	legacyRemove.Content.Data = []byte("remove_peer " + y.Fingerprint())
+	legacyRemove.Meta.Time = room.Messages[len(room.Messages)-2].Meta.Time
+	legacyRemove.Sign(*x.Priv)
+
+	for _, forged := range []Message{remove, legacyRemove} {
+		replica := replicate(t, room, forged)
+
+		assert.Contains(t, replica.Info().Roles, y.Fingerprint())
+		assert.Equal(t, RoleMember, replica.Info().Roles[x.Fingerprint()])
+	}
+}
+
+func TestMembershipEventLegacyParents(t *testing.T) {
+	room, x := setupRoleTests(t)
+	invite := room.Messages[len(room.Messages)-1].ID
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, x.Fingerprint()))
+
+	assert.Equal(t, "promote "+x.Fingerprint()+" parent:"+invite+" seen:0", string(room.Messages[len(room.Messages)-1].Content.Data))
+	assert.Equal(t, RoleAdmin, replicate(t, room).Info().Roles[x.Fingerprint()])
+}
+
+func TestMembershipLogLegacyInvite(t *testing.T) {
+	room, x := setupRoleTests(t)
+	y, _ := NewIdentity(Self, "")
+	z, _ := NewIdentity(Self, "")
+	head := room.Messages[len(room.Messages)-1].ID
+
+	//Older versions let every member invite, newer ones require an admin
+	legacy := commandMessage(t, x, 1, RoomCommandInvite, y.Fingerprint())
+	legacy.Content.Data = []byte("invite " + y.Fingerprint())
+	legacy.Sign(*x.Priv)
+	structured := eventMessage(t, x, RoomCommandInvite, z.Fingerprint(), head)
+	structured.Meta.Seq = 2
+	structured.Sign(*x.Priv)
+	room.PushMessages(legacy, structured)
+
+	raw, err := json.Marshal(room)
+	assert.NoError(t, err)
+	reloaded := &Room{}
+	assert.NoError(t, json.Unmarshal(raw, reloaded))
+	reloaded.RebuildState()
+
+	for _, r := range []*Room{room, reloaded} {
+		assert.Contains(t, r.Info().Roles, y.Fingerprint())
+		assert.NotContains(t, r.Info().Roles, z.Fingerprint())
+	}
+}
+
+func TestMembershipLogInviteInLaterBatch(t *testing.T) {
+	room, x := setupRoleTests(t)
+	y := inviteMember(t, room)
+	inviteY := len(room.Messages) - 1
+
+	//The joining peer already knows y from its invitation, before the event that invited y is synced
+	replica, _ := NewRoom(context.Background())
+	t.Cleanup(replica.StopQueues)
+	replica.Founder = room.Founder
+	founder, _ := NewIdentity(Remote, room.Self.Fingerprint())
+	founder.SetRole(RoleOwner)
+	remoteY, _ := NewIdentity(Remote, y.Fingerprint())
+	peerY := NewMessagingPeer(remoteY)
+	peerY.LastSyncState = SyncMap{y.Fingerprint(): 1}
+	replica.Peers = append(replica.Peers, NewMessagingPeer(founder), peerY)
+
+	//The peer is neither removed nor added again, which would stop its queue and drop its state
+	replica.PushMessages(room.Messages[:inviteY]...)
+	assert.Contains(t, replica.Peers, peerY)
+
+	replica.PushMessages(room.Messages[inviteY:]...)
+	assert.Contains(t, replica.Peers, peerY)
+	assert.Len(t, replica.Peers, 3)
+	assert.Equal(t, SyncMap{y.Fingerprint(): 1}, peerY.LastSyncState)
+	assert.Contains(t, replica.Info().Roles, x.Fingerprint())
+	assert.Equal(t, RoleMember, replica.Info().Roles[y.Fingerprint()])
+}
+
+func TestMembershipLogBatchesAgree(t *testing.T) {
+	room, x := setupRoleTests(t)
+	members := []Identity{x}
+	for i := 0; i < 60; i++ {
+		members = append(members, inviteMember(t, room))
+	}
+	for i := 0; i < len(members); i += 3 {
+		room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, members[i].Fingerprint()))
+	}
+	head := room.Messages[len(room.Messages)-1].ID
+
+	//Admins demote each other and remove members concurrently
+	var concurrent []Message
+	for i := 0; i+3 < len(members); i += 6 {
+		concurrent = append(concurrent,
+			eventMessage(t, members[i], RoomCommandDemote, members[i+3].Fingerprint(), head),
+			eventMessage(t, members[i+3], RoomCommandRemovePeer, members[i+1].Fingerprint(), head),
+		)
+	}
+	msgs := append(append([]Message{}, room.Messages...), concurrent...)
+
+	whole := replicate(t, room, concurrent...)
+
+	//Every message on its own and newest first, so that events arrive before their parents.
+	//Those rejected because their sender wasn't invited yet arrive again with the next sync.
+	single := newReplica(t, room)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		single.PushMessages(msgs[i])
+	}
+	single.PushMessages(msgs...)
+
+	batched := newReplica(t, room)
+	shuffled := append([]Message{}, msgs...)
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	for i := 0; i < len(shuffled); i += 7 {
+		end := i + 7
+		if end > len(shuffled) {
+			end = len(shuffled)
+		}
+		batched.PushMessages(shuffled[i:end]...)
+	}
+	batched.PushMessages(msgs...)
+
+	raw, err := json.Marshal(whole)
+	assert.NoError(t, err)
+	reloaded := &Room{}
+	assert.NoError(t, json.Unmarshal(raw, reloaded))
+	reloaded.RebuildState()
+
+	//Self of every replica isn't part of the log
+	roles := func(r *Room) map[string]Role {
+		roles := r.Info().Roles
+		delete(roles, r.Self.Fingerprint())
+		return roles
+	}
+
+	expected := roles(whole)
+	//Every removal is made by an admin who is demoted concurrently
+	assert.Equal(t, RoleMember, expected[members[3].Fingerprint()])
+	assert.Contains(t, expected, members[1].Fingerprint())
+	for _, r := range []*Room{single, batched, reloaded} {
+		assert.Equal(t, expected, roles(r))
+	}
+}
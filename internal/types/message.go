@@ -2,10 +2,8 @@ package types
 
 import (
 	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
-	"reflect"
-	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -20,6 +18,15 @@ const (
 	ContentTypeCmd     ContentType = "mtype.cmd"
 	ContentTypeFile    ContentType = "mtype.file"
 	ContentTypeSticker ContentType = "mtype.sticker"
+
+	ContentTypeDelivered ContentType = "mtype.delivered"
+	ContentTypeRead      ContentType = "mtype.read"
+
+	ContentTypeEdit   ContentType = "mtype.edit"
+	ContentTypeDelete ContentType = "mtype.delete"
+
+	ContentTypeReaction       ContentType = "mtype.reaction"
+	ContentTypeReactionRemove ContentType = "mtype.reaction.remove"
 )
 
 type BlobMeta struct {
@@ -27,32 +34,79 @@ type BlobMeta struct {
 	Name string    `json:"name,omitempty"`
 	Type string    `json:"type,omitempty"`
 	Size int       `json:"size,omitempty"`
+	Hash []byte    `json:"hash,omitempty"`
 }
 
 type MessageMeta struct {
 	Sender string    `json:"sender"`
 	Time   time.Time `json:"time"`
+	//Seq is the per-sender sequence number of the message, starting at 1.
+	//Messages created before sequence numbers were introduced have a Seq of 0.
+	Seq uint64 `json:"seq,omitempty"`
+	//SigVersion is the format of the data covered by the signature, see signData
+	SigVersion int `json:"sigVersion,omitempty"`
+	//Room is the id of the Room the message was created in, it is only set from SigVersion 1 on
+	Room *uuid.UUID `json:"room,omitempty"`
 }
 
 type MessageContent struct {
-	Type    ContentType `json:"type"`
-	ReplyTo *Message    `json:"replyto,omitempty"`
-	Blob    *BlobMeta   `json:"blob,omitempty"`
-	Data    []byte      `json:"data,omitempty"`
+	Type ContentType `json:"type"`
+	//Reply references the message this one replies to
+	Reply *ReplyRef `json:"reply,omitempty"`
+	//ReplyTo is the complete message that is replied to, it is only set by older versions
+	ReplyTo *Message `json:"replyto,omitempty"`
+	//Target is the id of the message that is referenced by e.g. an edit or deletion
+	Target string    `json:"target,omitempty"`
+	Blob   *BlobMeta `json:"blob,omitempty"`
+	//Key is the id of the room key that Data and the blob are encrypted with,
+	//it is empty for content that isn't encrypted.
+	Key  string `json:"key,omitempty"`
+	Data []byte `json:"data,omitempty"`
 }
 
 type Message struct {
+	ID      string         `json:"id,omitempty"`
 	Meta    MessageMeta    `json:"meta"`
 	Content MessageContent `json:"content"`
 	Sig     []byte         `json:"sig"`
+	//ExtSig covers the fields of a message in the legacy format that older daemons don't know,
+	//which they drop without breaking Sig, see legacySignData
+	ExtSig []byte `json:"extSig,omitempty"`
 }
 
 func (m *Message) ContainsBlob() bool {
 	return m.Content.Blob != nil
 }
 
+// IsChatMessage returns true if the message is shown as a line in the chat
+func (m *Message) IsChatMessage() bool {
+	switch m.Content.Type {
+	case ContentTypeText, ContentTypeFile, ContentTypeSticker:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsAnnotation returns true if the message only changes the state of other messages,
+// and is therefore not shown as a line in the chat itself.
+func (m *Message) IsAnnotation() bool {
+	switch m.Content.Type {
+	case ContentTypeDelivered, ContentTypeRead, ContentTypeEdit, ContentTypeDelete,
+		ContentTypeReaction, ContentTypeReactionRemove:
+		return true
+	default:
+		return false
+	}
+}
+
 func (m *Message) Sign(key ed25519.PrivateKey) {
 	m.Sig = ed25519.Sign(key, m.signData())
+	m.ExtSig = nil
+	if m.Meta.SigVersion == LegacySigVersion && m.hasExtension() {
+		m.ExtSig = ed25519.Sign(key, m.extensionSignData())
+	}
+	m.ID = m.calculateID()
 }
 
 func (m *Message) SigIsValid() bool {
@@ -65,45 +119,64 @@ func (m *Message) SigIsValid() bool {
 		return false
 	}
 
+	if m.Meta.SigVersion > SigVersion {
+		log.Debugf("unsupported signature version %d!", m.Meta.SigVersion)
+		return false
+	}
+
+	if m.ID != "" && m.ID != m.calculateID() {
+		log.Debugf("message id %s doesn't match its content!", m.ID)
+		return false
+	}
+
+	//Older versions embed the complete message that is replied to, whose signature is checked as well
 	if m.Content.ReplyTo != nil && !m.Content.ReplyTo.SigIsValid() {
-		log.Warn("recursive signature check failed for message")
+		log.Debugf("invalid signature of the message replied to by %s!", m.ID)
 		return false
 	}
 
 	pubKey := ed25519.PublicKey(rawKey)
 
+	if m.Meta.SigVersion == LegacySigVersion && (m.ExtSig != nil || m.hasExtension()) &&
+		!ed25519.Verify(pubKey, m.extensionSignData(), m.ExtSig) {
+		log.Debugf("invalid extension signature of message %s!", m.ID)
+		return false
+	}
+
 	return ed25519.Verify(pubKey, m.signData(), m.Sig)
 }
 
-func (m *Message) signData() []byte {
-	const (
-		sigFieldName = "Sig"
-	)
-
-	ref := reflect.ValueOf(m).Elem()
-	typeOf := ref.Type()
-
-	signData := make([]byte, 0)
+// IsLegacy returns true if the message was created by an older daemon,
+// which doesn't know any of the fields added since, e.g. the hash of a blob
+func (m *Message) IsLegacy() bool {
+	return m.Meta.SigVersion == LegacySigVersion && m.ExtSig == nil
+}
 
-	if _, containsSig := typeOf.FieldByName(sigFieldName); !containsSig {
-		log.Panicf("Message struct is missing a signature field called %s!", sigFieldName)
+// BelongsTo returns false if the message is bound to a different Room than the one with the specified id.
+// Messages signed in the legacy format aren't bound to any Room.
+func (m *Message) BelongsTo(roomID uuid.UUID) bool {
+	if m.Meta.SigVersion == LegacySigVersion {
+		return true
 	}
 
-	for i := 0; i < ref.NumField(); i++ {
-		if typeOf.Field(i).Name != sigFieldName {
-			v, _ := json.Marshal(ref.Field(i).Interface())
-			signData = append(signData, v...)
-		}
-	}
+	return m.Meta.Room != nil && *m.Meta.Room == roomID
+}
 
-	return signData
+// calculateID derives the ID of a message from the data covered by its signature,
+// so that the same message has the same ID on every peer.
+func (m *Message) calculateID() string {
+	sum := sha256.Sum256(m.signData())
+	return base64.RawURLEncoding.EncodeToString(sum[:])
 }
 
-func NewMessage(content MessageContent, sender Identity) Message {
+// NewMessage creates a message signed in the legacy format, which can be verified by older daemons.
+// Older daemons drop the fields they don't know, which are covered by the ExtSig instead.
+func NewMessage(content MessageContent, sender Identity, seq uint64) Message {
 	msg := Message{
 		Meta: MessageMeta{
 			Sender: sender.Fingerprint(),
 			Time:   time.Now().UTC(),
+			Seq:    seq,
 		},
 		Content: content,
 	}
@@ -113,6 +186,38 @@ func NewMessage(content MessageContent, sender Identity) Message {
 	return msg
 }
 
+// NewRoomMessage creates a message signed in the canonical format, which binds it to the Room with the specified id
+func NewRoomMessage(content MessageContent, sender Identity, seq uint64, roomID uuid.UUID) Message {
+	msg := Message{
+		Meta: MessageMeta{
+			Sender:     sender.Fingerprint(),
+			Time:       time.Now().UTC(),
+			Seq:        seq,
+			SigVersion: SigVersion,
+			Room:       &roomID,
+		},
+		Content: content,
+	}
+
+	msg.Sign(*sender.Priv)
+
+	return msg
+}
+
+func (m *Message) isRoomKey() bool {
+	isCmd, cmd := m.isCommand()
+	return isCmd && Command(cmd) == RoomCommandRoomKey
+}
+
+func (m *Message) isRatchetAnnouncement() bool {
+	isCmd, cmd := m.isCommand()
+	return isCmd && Command(cmd) == RoomCommandRatchet
+}
+
 func (m *Message) isCommand() (bool, string) {
-	return m.Content.Type == ContentTypeCmd, strings.Split(string(m.Content.Data), CommandDelimiter)[0]
+	if m.Content.Type != ContentTypeCmd {
+		return false, ""
+	}
+
+	return true, string(commandName(m.Content.Data))
 }
@@ -0,0 +1,80 @@
+package types
+
+import (
+	"time"
+)
+
+// MessageInfo is a Message as it is presented to frontends,
+// in its latest revision and together with the state that other messages attached to it.
+type MessageInfo struct {
+	Message
+	Receipts map[string]Receipt `json:"receipts,omitempty"`
+	Edited   *time.Time         `json:"edited,omitempty"`
+	//Reactions maps every emoji to the fingerprints of the peers that reacted with it
+	Reactions map[string][]string `json:"reactions,omitempty"`
+}
+
+// MessageInfos returns all messages that are shown in the chat,
+// together with the receipts and reactions of all peers for them.
+func (r *Room) MessageInfos() []MessageInfo {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	infos := make([]MessageInfo, 0)
+	for _, msg := range r.Messages {
+		//Room keys and ratchet announcements are only meant to be read by the daemon
+		if msg.IsAnnotation() || msg.isRoomKey() || msg.isRatchetAnnouncement() {
+			continue
+		}
+
+		infos = append(infos, r.messageInfo(msg))
+	}
+
+	return infos
+}
+
+// MessageInfosByID returns the MessageInfo for every message with one of the specified ids.
+// Ids of unknown or deleted messages are skipped.
+func (r *Room) MessageInfosByID(ids ...string) []MessageInfo {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	infos := make([]MessageInfo, 0)
+	for _, id := range ids {
+		if msg, _, found := r.messageByID(id); found {
+			infos = append(infos, r.messageInfo(msg))
+		}
+	}
+
+	return infos
+}
+
+// messageInfo has to be called with msgUpdateMutex held
+func (r *Room) messageInfo(msg Message) MessageInfo {
+	info := MessageInfo{
+		Message:   msg,
+		Receipts:  copyReceipts(r.receipts[msg.ID]),
+		Reactions: r.reactionsFor(msg.ID),
+	}
+
+	r.decryptContent(&info.Content)
+
+	if edit, found := r.latestEdit(msg); found {
+		r.decryptContent(&edit.Content)
+		info.Content.Data = edit.Content.Data
+		info.Edited = &edit.Meta.Time
+	}
+
+	return info
+}
+
+// messageByID has to be called with msgUpdateMutex held
+func (r *Room) messageByID(id string) (Message, int, bool) {
+	for i, msg := range r.Messages {
+		if msg.ID == id {
+			return msg, i, true
+		}
+	}
+
+	return Message{}, 0, false
+}
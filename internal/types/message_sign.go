@@ -0,0 +1,196 @@
+package types
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// LegacySigVersion messages are signed over the JSON encoding of their fields,
+	// which changes whenever a field is added, so it is only used for older daemons.
+	LegacySigVersion = 0
+	// SigVersion is the version of the canonical format, see canonicalSignData
+	SigVersion = 1
+
+	sigContext = "onionmsg message"
+)
+
+// signData returns the data that is covered by the signature and the ID of the message,
+// in the format specified by its SigVersion.
+func (m *Message) signData() []byte {
+	if m.Meta.SigVersion == LegacySigVersion {
+		return m.legacySignData()
+	}
+
+	return m.canonicalSignData()
+}
+
+// canonicalSignData encodes the message in an explicitly defined format,
+// which doesn't depend on the Go types or their JSON encoding.
+// Every field is written in a fixed order, variable length fields are prefixed with their length.
+// Fields that are added later on are only covered by a new SigVersion.
+// With a SigVersion of 0, it is used for the extension signature of messages in the legacy format.
+//
+// Version 1 consists of:
+//
+//	context "onionmsg message", version, room id,
+//	sender, time in unix nanoseconds, seq,
+//	content type, id of the replied to message, reply excerpt, target,
+//	blob (presence, uuid, name, type, size, hash), key, data
+func (m *Message) canonicalSignData() []byte {
+	w := &canonicalWriter{}
+
+	w.string(sigContext)
+	w.uint64(uint64(m.Meta.SigVersion))
+	if m.Meta.Room != nil {
+		w.bytes(m.Meta.Room[:])
+	} else {
+		w.bytes(nil)
+	}
+
+	w.string(m.Meta.Sender)
+	w.uint64(uint64(m.Meta.Time.UnixNano()))
+	w.uint64(m.Meta.Seq)
+
+	c := m.Content
+	w.string(string(c.Type))
+	w.string(c.ReplyID())
+	if c.Reply != nil {
+		w.bytes(c.Reply.Excerpt)
+	} else {
+		w.bytes(nil)
+	}
+	w.string(c.Target)
+
+	if c.Blob != nil {
+		w.bool(true)
+		w.bytes(c.Blob.ID[:])
+		w.string(c.Blob.Name)
+		w.string(c.Blob.Type)
+		w.uint64(uint64(c.Blob.Size))
+		w.bytes(c.Blob.Hash)
+	} else {
+		w.bool(false)
+	}
+
+	w.string(c.Key)
+	w.bytes(c.Data)
+
+	return w.buf
+}
+
+// legacySignData concatenates the JSON encoding of the meta and content of the message,
+// restricted to the fields that older daemons know, so that they re-encode the same bytes.
+// All other fields are covered by the extension signature, see extensionSignData.
+func (m *Message) legacySignData() []byte {
+	legacy := legacyMessageOf(m)
+
+	meta, _ := json.Marshal(legacy.Meta)
+	content, _ := json.Marshal(legacy.Content)
+
+	return append(meta, content...)
+}
+
+// extensionSignData is the data covered by the ExtSig of a message in the legacy format,
+// which is the canonical format with a SigVersion of 0
+func (m *Message) extensionSignData() []byte {
+	return m.canonicalSignData()
+}
+
+// hasExtension returns true if a message in the legacy format sets fields that older daemons don't know
+func (m *Message) hasExtension() bool {
+	c := m.Content
+	return m.Meta.Seq != 0 || c.Reply != nil || c.Target != "" || c.Key != "" || (c.Blob != nil && c.Blob.Hash != nil)
+}
+
+// The legacy types mirror the message as it is known to older daemons
+type legacyBlobMeta struct {
+	ID   uuid.UUID `json:"uuid"`
+	Name string    `json:"name,omitempty"`
+	Type string    `json:"type,omitempty"`
+	Size int       `json:"size,omitempty"`
+}
+
+type legacyMessageMeta struct {
+	Sender string    `json:"sender"`
+	Time   time.Time `json:"time"`
+}
+
+type legacyMessageContent struct {
+	Type    ContentType     `json:"type"`
+	ReplyTo *legacyMessage  `json:"replyto,omitempty"`
+	Blob    *legacyBlobMeta `json:"blob,omitempty"`
+	Data    []byte          `json:"data,omitempty"`
+}
+
+type legacyMessage struct {
+	Meta    legacyMessageMeta    `json:"meta"`
+	Content legacyMessageContent `json:"content"`
+	Sig     []byte               `json:"sig"`
+}
+
+func legacyMessageOf(m *Message) legacyMessage {
+	legacy := legacyMessage{
+		Meta: legacyMessageMeta{
+			Sender: m.Meta.Sender,
+			Time:   m.Meta.Time,
+		},
+		Content: legacyMessageContent{
+			Type: m.Content.Type,
+			Data: m.Content.Data,
+		},
+		Sig: m.Sig,
+	}
+
+	if m.Content.ReplyTo != nil {
+		replyTo := legacyMessageOf(m.Content.ReplyTo)
+		legacy.Content.ReplyTo = &replyTo
+	}
+
+	if blob := m.Content.Blob; blob != nil {
+		legacy.Content.Blob = &legacyBlobMeta{
+			ID:   blob.ID,
+			Name: blob.Name,
+			Type: blob.Type,
+			Size: blob.Size,
+		}
+	}
+
+	return legacy
+}
+
+type canonicalWriter struct {
+	buf []byte
+}
+
+func (w *canonicalWriter) bytes(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *canonicalWriter) string(s string) {
+	w.bytes([]byte(s))
+}
+
+func (w *canonicalWriter) uint32(v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *canonicalWriter) uint64(v uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	w.buf = append(w.buf, b...)
+}
+
+func (w *canonicalWriter) bool(v bool) {
+	if v {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
@@ -0,0 +1,173 @@
+package types_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+)
+
+func TestMessageID(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1)
+
+	assert.NotEmpty(t, msg.ID)
+	assert.True(t, msg.SigIsValid())
+}
+
+func TestMessageIDTampered(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1)
+	other := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("other")}, sender, 2)
+
+	msg.ID = other.ID
+
+	assert.False(t, msg.SigIsValid())
+}
+
+func TestRoomMessageSignature(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+	room := uuid.New()
+
+	msg := NewRoomMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1, room)
+
+	assert.Equal(t, SigVersion, msg.Meta.SigVersion)
+	assert.True(t, msg.SigIsValid())
+	assert.True(t, msg.BelongsTo(room))
+	assert.False(t, msg.BelongsTo(uuid.New()))
+}
+
+func TestRoomMessageIndependentOfEncoding(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+	msg := NewRoomMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1, uuid.New())
+
+	raw, _ := json.Marshal(msg)
+	decoded := Message{}
+	json.Unmarshal(raw, &decoded)
+	decoded.Meta.Time = decoded.Meta.Time.In(time.FixedZone("test", 3600))
+
+	assert.True(t, decoded.SigIsValid())
+}
+
+func TestRoomMessageMovedToOtherRoom(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+	msg := NewRoomMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1, uuid.New())
+
+	other := uuid.New()
+	msg.Meta.Room = &other
+	msg.ID = ""
+
+	assert.False(t, msg.SigIsValid())
+}
+
+func TestUnknownSigVersion(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+	msg := NewRoomMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1, uuid.New())
+
+	msg.Meta.SigVersion = SigVersion + 1
+	msg.Sign(*sender.Priv)
+
+	assert.False(t, msg.SigIsValid())
+}
+
+func TestRoomMessageReplyTampered(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+	reply := &ReplyRef{ID: "target", Excerpt: []byte("quote")}
+	msg := NewRoomMessage(MessageContent{Type: ContentTypeText, Reply: reply, Data: []byte("test")}, sender, 1, uuid.New())
+
+	assert.True(t, msg.SigIsValid())
+
+	msg.Content.Reply = &ReplyRef{ID: "target", Excerpt: []byte("forged")}
+	msg.ID = ""
+
+	assert.False(t, msg.SigIsValid())
+}
+
+// The baseline types are the message as it is known to older daemons, which verify its signature
+// over the JSON encoding of the meta and content, after dropping all fields they don't know
+type baselineBlobMeta struct {
+	ID   uuid.UUID `json:"uuid"`
+	Name string    `json:"name,omitempty"`
+	Type string    `json:"type,omitempty"`
+	Size int       `json:"size,omitempty"`
+}
+
+type baselineMessageMeta struct {
+	Sender string    `json:"sender"`
+	Time   time.Time `json:"time"`
+}
+
+type baselineMessageContent struct {
+	Type    ContentType       `json:"type"`
+	ReplyTo *baselineMessage  `json:"replyto,omitempty"`
+	Blob    *baselineBlobMeta `json:"blob,omitempty"`
+	Data    []byte            `json:"data,omitempty"`
+}
+
+type baselineMessage struct {
+	Meta    baselineMessageMeta    `json:"meta"`
+	Content baselineMessageContent `json:"content"`
+	Sig     []byte                 `json:"sig"`
+}
+
+func (m *baselineMessage) sigIsValid() bool {
+	meta, _ := json.Marshal(m.Meta)
+	content, _ := json.Marshal(m.Content)
+
+	rawKey, _ := base64.RawURLEncoding.DecodeString(m.Meta.Sender)
+	return ed25519.Verify(rawKey, append(meta, content...), m.Sig)
+}
+
+func TestLegacyMessageVerifiedByOlderDaemons(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+	content := MessageContent{
+		Type:   ContentTypeFile,
+		Reply:  &ReplyRef{ID: "target", Excerpt: []byte("quote")},
+		Target: "target",
+		Blob:   &BlobMeta{ID: uuid.New(), Name: "file", Size: 3, Hash: []byte("hash")},
+		Key:    "key",
+		Data:   []byte("test"),
+	}
+	msg := NewMessage(content, sender, 7)
+
+	raw, _ := json.Marshal(msg)
+	baseline := baselineMessage{}
+	assert.NoError(t, json.Unmarshal(raw, &baseline))
+	assert.True(t, baseline.sigIsValid())
+
+	//An older daemon relays the message without the fields it doesn't know
+	raw, _ = json.Marshal(baseline)
+	relayed := Message{}
+	assert.NoError(t, json.Unmarshal(raw, &relayed))
+	assert.True(t, relayed.SigIsValid())
+}
+
+func TestLegacyMessageExtensionTampered(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 7)
+
+	msg.Meta.Seq = 1
+	assert.False(t, msg.SigIsValid())
+
+	msg.Meta.Seq = 7
+	msg.ExtSig = nil
+	assert.False(t, msg.SigIsValid())
+}
+
+func TestLegacyReplyToTampered(t *testing.T) {
+	sender, _ := NewIdentity(Self, "")
+	replyTo := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 0)
+	replyTo.Content.Data = []byte("forged")
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, ReplyTo: &replyTo, Data: []byte("reply")}, sender, 0)
+
+	assert.False(t, msg.SigIsValid())
+}
@@ -2,32 +2,64 @@ package types
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/craumix/onionmsg/pkg/blobmngr"
+	"github.com/craumix/onionmsg/pkg/ratchet"
 	"github.com/craumix/onionmsg/pkg/sio/connection"
 	"github.com/google/uuid"
 )
 
 const (
 	queueTimeout = time.Second * 15
+
+	//maxBatchSize is the approximate encoded size of a batch,
+	//which leaves enough room for the overhead of envelopes below the frame limit of DataConn
+	maxBatchSize     = 1 << 18 // 256K
+	maxBatchMessages = 500
 )
 
 type MessagingPeer struct {
 	RIdentity     Identity `json:"identity"`
-	LastSyncState SyncMap  `json:"lastSync"`
+	LastSyncState SyncMap  `json:"lastSyncState"`
+
+	//Session is the double ratchet session with the peer, which is only used in two-party Rooms
+	Session      *ratchet.Session `json:"session,omitempty"`
+	sessionMutex sync.Mutex
 
+	//Protocol is the one negotiated during the last handshake, it is nil if there was none yet
+	Protocol *Protocol `json:"protocol,omitempty"`
+
+	//queueMutex guards the contexts of the message queue, which is stopped and bumped from other goroutines
+	queueMutex  sync.Mutex
 	ctx         context.Context
 	stop        context.CancelFunc
+	stopped     bool
 	skipTimeout context.CancelFunc
 
 	Room *Room `json:"-"`
 }
 
+// plainPeer is encoded like MessagingPeer, without calling its MarshalJSON
+type plainPeer MessagingPeer
+
+// MarshalJSON encodes the MessagingPeer while holding sessionMutex,
+// since the Session is changed in place whenever messages are sealed or opened,
+// and a torn Session couldn't decrypt anything after a restart.
+func (mp *MessagingPeer) MarshalJSON() ([]byte, error) {
+	mp.sessionMutex.Lock()
+	defer mp.sessionMutex.Unlock()
+
+	return json.Marshal((*plainPeer)(mp))
+}
+
 func NewMessagingPeer(rid Identity) *MessagingPeer {
 	return &MessagingPeer{
 		RIdentity: rid,
@@ -39,7 +71,12 @@ func NewMessagingPeer(rid Identity) *MessagingPeer {
 func (mp *MessagingPeer) RunMessageQueue(ctx context.Context, room *Room) {
 	mp.Room = room
 
+	mp.queueMutex.Lock()
 	mp.ctx, mp.stop = context.WithCancel(ctx)
+	if mp.stopped {
+		mp.stop()
+	}
+	mp.queueMutex.Unlock()
 
 	lf := log.Fields{
 		"room": mp.Room.ID,
@@ -54,7 +91,9 @@ func (mp *MessagingPeer) RunMessageQueue(ctx context.Context, room *Room) {
 			log.WithFields(lf).Debug("queue terminated")
 			return
 		default:
-			if SyncMapsEqual(mp.Room.SyncState, mp.LastSyncState) {
+			//Messages added during the sync aren't acknowledged by it
+			syncState := mp.Room.SyncStateCopy()
+			if mp.Room.peerSynced(mp, syncState) {
 				break
 			}
 
@@ -62,17 +101,21 @@ func (mp *MessagingPeer) RunMessageQueue(ctx context.Context, room *Room) {
 
 			log.WithFields(lf).Debug("running message sync")
 
-			err := mp.syncMsgs()
-			if err != nil {
+			rejected, err := mp.syncMsgs()
+			if connection.IsTimeout(err) {
+				log.WithError(err).WithFields(lf).Info("message sync timed out")
+			} else if err != nil {
 				log.WithError(err).WithFields(lf).Debug("message sync failed")
 			} else {
-				mp.LastSyncState = CopySyncMap(mp.Room.SyncState)
+				mp.Room.SetPeerSyncState(mp.RIdentity.Fingerprint(), acknowledgedState(syncState, rejected))
 				log.WithField("time", time.Since(startSync)).WithFields(lf).Debug("message sync done")
 			}
 		}
 
-		var skip context.Context
-		skip, mp.skipTimeout = context.WithCancel(context.Background())
+		mp.queueMutex.Lock()
+		skip, skipTimeout := context.WithCancel(context.Background())
+		mp.skipTimeout = skipTimeout
+		mp.queueMutex.Unlock()
 
 		select {
 		case <-skip.Done(): //used to skip a single wait period
@@ -83,121 +126,355 @@ func (mp *MessagingPeer) RunMessageQueue(ctx context.Context, room *Room) {
 }
 
 func (mp *MessagingPeer) BumpQueue() {
+	mp.queueMutex.Lock()
+	defer mp.queueMutex.Unlock()
+
 	if mp.skipTimeout != nil {
 		mp.skipTimeout()
 	}
 }
 
-func (mp *MessagingPeer) syncMsgs() error {
+// syncMsgs sends the messages the remote doesn't know yet and returns those it rejected
+func (mp *MessagingPeer) syncMsgs() ([]Message, error) {
 	if mp.Room == nil {
-		return fmt.Errorf("Room not set")
+		return nil, fmt.Errorf("Room not set")
 	}
 
 	conn, err := connection.GetConnFunc("tcp", mp.RIdentity.URL()+":"+strconv.Itoa(PubConvPort))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer conn.Close()
 
-	err = fingerprintChallenge(conn, mp.Room.Self)
+	LimitSession(conn)
+
+	proto, ch, err := clientHandshake(conn, mp.Room, mp.RIdentity)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	mp.Room.SetPeerProtocol(mp.RIdentity.Fingerprint(), proto)
 
-	conn.WriteBytes(mp.Room.ID[:])
-	conn.Flush()
-
-	err = expectResponse(conn, "auth_ok")
+	err = ch.Expect(FrameAuthOK, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	remoteSyncTimes := make(SyncMap)
-	err = conn.ReadStruct(&remoteSyncTimes)
-	if err != nil {
-		return err
+	var (
+		msgsToSync []Message
+		skipped    SkippedSeqs
+	)
+	if proto.Supports(FeatureSeqSync) {
+		remoteSyncState := make(SyncMap)
+		err = ch.Expect(FrameSyncState, &remoteSyncState)
+		if err != nil {
+			return nil, err
+		}
+
+		msgsToSync = mp.findMessagesToSync(remoteSyncState)
+		skipped = mp.Room.SkippedFor(remoteSyncState)
+	} else {
+		remoteSyncTimes := make(map[string]time.Time)
+		err = ch.Expect(FrameSyncState, &remoteSyncTimes)
+		if err != nil {
+			return nil, err
+		}
+
+		msgsToSync = mp.findMessagesToSyncLegacy(remoteSyncTimes)
+	}
+
+	ch.SetTimeout(ConnTimeouts.Messages)
+
+	//Older daemons expect all messages at once
+	if !proto.Supports(FeatureBatchSync) {
+		rejected, err := mp.syncBatch(ch, proto, msgsToSync, FrameSyncOK)
+		return rejectedMessages(msgsToSync, rejected), err
 	}
 
-	msgsToSync := mp.findMessagesToSync(remoteSyncTimes)
-	conn.WriteStruct(msgsToSync)
-	conn.Flush()
+	//Without the skipped sequence numbers the remote would never get past them
+	if len(skipped) > 0 && proto.Supports(FeatureSkippedSeqs) {
+		err = ch.Send(FrameSkipped, skipped)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	err = expectResponse(conn, "messages_ok")
+	batches := batchMessages(msgsToSync)
+	if len(batches) == 0 && proto.Supports(FeatureRatchet) && mp.needsBootstrap() {
+		batches = append(batches, []Message{})
+	}
+	var rejected []string
+	for i, batch := range batches {
+		ids, err := mp.syncBatch(ch, proto, batch, FrameBatchOK)
+		if err != nil {
+			return nil, err
+		}
+		rejected = append(rejected, ids...)
+
+		lf := log.Fields{
+			"room":  mp.Room.ID,
+			"peer":  mp.RIdentity.Fingerprint(),
+			"batch": fmt.Sprintf("%d/%d", i+1, len(batches)),
+		}
+		log.WithFields(lf).Debug("synced batch")
+	}
+
+	ch.Send(FrameSyncDone, nil)
+	ch.Flush()
+
+	return rejectedMessages(msgsToSync, rejected), ch.Expect(FrameSyncOK, nil)
+}
+
+// syncBatch sends msgs and the blobs they reference, and waits for the remote to acknowledge them with ack.
+// The remote stores every acknowledged batch, so that an interrupted sync continues after the last one.
+// It returns the ids of the messages the remote rejected.
+func (mp *MessagingPeer) syncBatch(ch Channel, proto Protocol, msgs []Message, ack FrameKind) ([]string, error) {
+	var (
+		kind                = FrameMessages
+		payload interface{} = msgs
+		err     error
+	)
+	if proto.Supports(FeatureRatchet) {
+		kind, payload, err = mp.sealMessages(msgs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = ch.Send(kind, payload)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	ch.Flush()
 
-	blobIDs := blobIDsFromMessages(msgsToSync...)
-	err = sendBlobs(conn, blobIDs)
+	err = ch.Expect(FrameMessagesOK, nil)
+	if perr, ok := err.(*ProtocolError); ok && perr.Code == ErrorUndecryptable {
+		//The peer lost its state, so a new session is started with the next sync
+		if mp.isInitiator() {
+			mp.resetSession()
+		}
+		return nil, fmt.Errorf("peer was unable to decrypt the messages")
+	} else if err != nil {
+		return nil, err
+	}
+
+	ch.SetTimeout(ConnTimeouts.Blobs)
+	err = sendBlobs(ch, blobIDsFromMessages(msgs...), proto)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	ch.SetTimeout(ConnTimeouts.Messages)
 
-	err = expectResponse(conn, "sync_ok")
+	frame, err := ch.Receive(ack, FrameRejected)
+	if err != nil || frame.Kind == ack {
+		return nil, err
+	}
+
+	//The rejected messages are offered again with the next sync,
+	//in case the peer just didn't know their sender yet
+	var rejected []string
+	err = frame.Decode(&rejected)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	log.WithField("peer", mp.RIdentity.Fingerprint()).Warnf("peer rejected messages %v", rejected)
+
+	return rejected, ch.Expect(ack, nil)
+}
+
+// rejectedMessages returns the messages in msgs with the specified ids
+func rejectedMessages(msgs []Message, ids []string) []Message {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rejected := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		rejected[id] = struct{}{}
+	}
+
+	var found []Message
+	for _, msg := range msgs {
+		if _, ok := rejected[msg.ID]; ok {
+			found = append(found, msg)
+		}
+	}
+
+	return found
+}
+
+// acknowledgedState returns the part of state that the remote acknowledged by a sync, in which it rejected some messages.
+// The remote knows the messages of a sender only up to the first one it rejected.
+func acknowledgedState(state SyncMap, rejected []Message) SyncMap {
+	acknowledged := CopySyncMap(state)
+	for _, msg := range rejected {
+		if seq, ok := acknowledged[msg.Meta.Sender]; ok && msg.Meta.Seq > 0 && msg.Meta.Seq <= seq {
+			acknowledged[msg.Meta.Sender] = msg.Meta.Seq - 1
+		}
+	}
+
+	return acknowledged
 }
 
 func (mp *MessagingPeer) Stop() {
+	mp.queueMutex.Lock()
+	defer mp.queueMutex.Unlock()
+
+	mp.stopped = true
 	if mp.stop != nil {
 		mp.stop()
 	}
 }
 
-func sendBlobs(conn connection.ConnWrapper, ids []uuid.UUID) error {
-	conn.WriteStruct(ids)
-	conn.Flush()
+// sendBlobs transfers the blobs with the specified ids.
+// With FeatureBlobResume the receiver reports how many bytes of each blob it already has,
+// so that interrupted transfers are resumed from that offset.
+func sendBlobs(ch Channel, ids []uuid.UUID, proto Protocol) error {
+	ch.Send(FrameBlobIDs, ids)
+	ch.Flush()
 
-	for _, id := range ids {
-		stat, err := blobmngr.StatFromID(id)
+	offsets := make([]int64, len(ids))
+	if proto.Supports(FeatureBlobResume) {
+		err := ch.Expect(FrameBlobOffsets, &offsets)
 		if err != nil {
 			return err
 		}
 
-		blockCount := int(stat.Size() / blocksize)
-		if stat.Size()%blocksize != 0 {
-			blockCount++
+		if len(offsets) != len(ids) {
+			return fmt.Errorf("received %d blob offsets for %d blobs", len(offsets), len(ids))
 		}
+	}
 
-		conn.WriteInt(blockCount)
-		conn.Flush()
+	var err error
 
-		file, err := blobmngr.FileFromID(id)
+	for i, id := range ids {
+		err = sendBlob(ch, id, offsets[i], proto.Supports(FeatureBlobStream))
 		if err != nil {
 			return err
 		}
-		defer file.Close()
+	}
 
-		buf := make([]byte, blocksize)
-		for c := 0; c < blockCount; c++ {
-			n, err := file.Read(buf)
-			if err != nil {
-				return err
-			}
+	return nil
+}
 
-			conn.WriteBytes(buf[:n])
-			conn.Flush()
+// sendBlob sends the blob from offset on, either as a single stream or in blocks that are acknowledged one by one
+func sendBlob(ch Channel, id uuid.UUID, offset int64, stream bool) error {
+	stat, err := blobmngr.StatFromID(id)
+	if err != nil {
+		return err
+	}
 
-			err = expectResponse(conn, "block_ok")
-			if err != nil {
-				return err
-			}
+	if offset < 0 || offset > stat.Size() {
+		return fmt.Errorf("invalid offset %d for blob %s", offset, id)
+	}
+
+	blockCount := BlockCount(stat.Size() - offset)
+
+	ch.Send(FrameBlockCount, blockCount)
+	ch.Flush()
+
+	file, err := blobmngr.FileFromID(id)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if stream && blockCount > 0 {
+		err = ch.SendStream(io.LimitReader(file, stat.Size()-offset))
+		if err != nil {
+			return err
+		}
+		ch.Flush()
+	}
+
+	buf := make([]byte, BlockSize)
+	for c := 0; c < blockCount && !stream; c++ {
+		n, err := file.Read(buf)
+		if err != nil {
+			return err
 		}
 
-		err = expectResponse(conn, "blob_ok")
+		ch.Send(FrameBlock, buf[:n])
+		ch.Flush()
+
+		err = ch.Expect(FrameBlockOK, nil)
 		if err != nil {
 			return err
 		}
+	}
+
+	err = ch.Expect(FrameBlobOK, nil)
+	if err != nil {
+		return err
+	}
 
-		log.WithField("blob", id.String()).Debug("transferred blob")
+	lf := log.Fields{
+		"blob":   id.String(),
+		"offset": offset,
 	}
+	log.WithFields(lf).Debug("transferred blob")
 
 	return nil
 }
 
-func (mp *MessagingPeer) findMessagesToSync(remoteSyncTimes SyncMap) []Message {
+// batchMessages splits msgs into batches that can each be sent in a single frame.
+// The order of the messages is kept, so that every batch can be applied by the remote on its own.
+func batchMessages(msgs []Message) [][]Message {
+	batches := make([][]Message, 0)
+
+	var (
+		batch = make([]Message, 0)
+		size  = 0
+	)
+	for _, msg := range msgs {
+		raw, _ := json.Marshal(msg)
+
+		if len(batch) > 0 && (size+len(raw) > maxBatchSize || len(batch) >= maxBatchMessages) {
+			batches = append(batches, batch)
+			batch = make([]Message, 0)
+			size = 0
+		}
+
+		batch = append(batch, msg)
+		size += len(raw)
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// findMessagesToSync returns all messages after the sequence numbers up to which the remote knows all messages of their sender.
+// The remote ignores the ones it already received after a gap.
+// Messages without a sequence number are only sent if the remote doesn't know their sender at all.
+func (mp *MessagingPeer) findMessagesToSync(remoteSyncState SyncMap) []Message {
+	mp.Room.msgUpdateMutex.Lock()
+	defer mp.Room.msgUpdateMutex.Unlock()
+
+	msgs := make([]Message, 0)
+
+	for _, msg := range mp.Room.Messages {
+		last, ok := remoteSyncState[msg.Meta.Sender]
+		if !ok || msg.Meta.Seq > last {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs
+}
+
+// findMessagesToSyncLegacy returns all messages that are newer than the last message of their sender known to the remote,
+// which is how older daemons determine the messages to sync.
+func (mp *MessagingPeer) findMessagesToSyncLegacy(remoteSyncTimes map[string]time.Time) []Message {
+	mp.Room.msgUpdateMutex.Lock()
+	defer mp.Room.msgUpdateMutex.Unlock()
+
 	msgs := make([]Message, 0)
 
 	for _, msg := range mp.Room.Messages {
@@ -0,0 +1,115 @@
+package types_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+)
+
+func textMessages(count, size int) []Message {
+	sender, _ := NewIdentity(Self, "")
+
+	msgs := make([]Message, count)
+	for i := range msgs {
+		msgs[i] = NewMessage(MessageContent{Type: ContentTypeText, Data: make([]byte, size)}, sender, uint64(i+1))
+	}
+
+	return msgs
+}
+
+// flatten returns the messages of all batches in order
+func flatten(batches [][]Message) []Message {
+	msgs := make([]Message, 0)
+	for _, batch := range batches {
+		msgs = append(msgs, batch...)
+	}
+
+	return msgs
+}
+
+func batchSize(batch []Message) int {
+	size := 0
+	for _, msg := range batch {
+		raw, _ := json.Marshal(msg)
+		size += len(raw)
+	}
+
+	return size
+}
+
+func TestBatchMessagesCount(t *testing.T) {
+	msgs := textMessages(2*MaxBatchMessages+1, 1)
+
+	batches := BatchMessages(msgs)
+
+	assert.Len(t, batches, 3)
+	assert.Len(t, batches[0], MaxBatchMessages)
+	assert.Len(t, batches[1], MaxBatchMessages)
+	assert.Len(t, batches[2], 1)
+	assert.Equal(t, msgs, flatten(batches))
+}
+
+func TestBatchMessagesSize(t *testing.T) {
+	msgs := textMessages(10, MaxBatchSize/4)
+
+	batches := BatchMessages(msgs)
+
+	assert.Greater(t, len(batches), 1)
+	for _, batch := range batches {
+		assert.LessOrEqual(t, batchSize(batch), MaxBatchSize)
+	}
+	assert.Equal(t, msgs, flatten(batches))
+}
+
+func TestBatchMessagesOversized(t *testing.T) {
+	msgs := textMessages(3, 1)
+	msgs[1] = textMessages(1, MaxBatchSize)[0]
+
+	batches := BatchMessages(msgs)
+
+	//A message that exceeds the size on its own is still sent, in a batch of its own
+	assert.Len(t, batches, 3)
+	assert.Equal(t, [][]Message{{msgs[0]}, {msgs[1]}, {msgs[2]}}, batches)
+}
+
+func TestBatchMessagesEmpty(t *testing.T) {
+	assert.Empty(t, BatchMessages(nil))
+}
+
+func TestFindMessagesToSyncConcurrent(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	t.Cleanup(room.StopQueues)
+	newMember(room)
+	peer := room.Peers[0]
+	FindMessagesToSync(room, peer, SyncMap{}, map[string]time.Time{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 50; i++ {
+			room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("test")})
+			if i%2 == 0 {
+				msgs, _ := FindMessagesToSync(room, peer, SyncMap{}, map[string]time.Time{})
+				room.DeleteMessage(msgs[len(msgs)-1].ID)
+			}
+		}
+	}()
+
+	//Run with -race, the messages to sync are collected while others are added and deleted
+	for {
+		select {
+		case <-done:
+			msgs, legacy := FindMessagesToSync(room, peer, SyncMap{}, map[string]time.Time{})
+			assert.Equal(t, msgs, legacy)
+			return
+		default:
+			FindMessagesToSync(room, peer, SyncMap{}, map[string]time.Time{})
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package types
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"time"
+)
+
+const (
+	protocolName = "onionmsg"
+
+	// LegacyProtocolVersion is spoken by daemons that don't send a Hello at all
+	LegacyProtocolVersion = 1
+	ProtocolVersion       = 2
+
+	// FeatureSeqSync means that sync states contain sequence numbers instead of timestamps
+	FeatureSeqSync = "seq_sync"
+	// FeatureBlobResume means that the receiver of blobs reports how much of each blob it already has
+	FeatureBlobResume = "blob_resume"
+	// FeatureRatchet means that messages can be sent in ratchet envelopes
+	FeatureRatchet = "ratchet"
+	// FeatureFrames means that everything after the handshake is sent in typed frames, see Channel
+	FeatureFrames = "frames"
+	// FeatureBatchSync means that messages are synced in batches, which are acknowledged one by one
+	FeatureBatchSync = "batch_sync"
+	// FeatureMutualAuth means that both sides of the handshake sign a transcript of it
+	FeatureMutualAuth = "mutual_auth"
+	// FeatureCanonicalSig means that messages signed in the canonical format can be verified, see SigVersion
+	FeatureCanonicalSig = "canonical_sig"
+	// FeatureRejections means that the receiver of messages reports those it rejected, see FrameRejected
+	FeatureRejections = "rejections"
+	// FeatureCommandPayload means that structured command messages are understood, see CommandPayload
+	FeatureCommandPayload = "cmd_payload"
+	// FeatureSkippedSeqs means that the sequence numbers of deleted and compacted messages are reported, see SkippedSeqs
+	FeatureSkippedSeqs = "skipped_seqs"
+	// FeatureRoomKey means that content encrypted with a room key can be decrypted, see RotateKey
+	FeatureRoomKey = "room_key"
+	// FeatureBlobStream means that blobs are sent as a single stream instead of acknowledged blocks, see Channel.SendStream
+	FeatureBlobStream = "blob_stream"
+
+	helloNonceSize = 32
+)
+
+var (
+	supportedFeatures = []string{FeatureSeqSync, FeatureBlobResume, FeatureRatchet, FeatureFrames, FeatureBatchSync, FeatureMutualAuth, FeatureCanonicalSig, FeatureRejections, FeatureCommandPayload, FeatureSkippedSeqs, FeatureRoomKey, FeatureBlobStream}
+)
+
+// Hello is exchanged at the start of every connection between two daemons,
+// and advertises the protocol version and the features that are supported by the sender.
+//
+// On the conversation port the server sends its Hello, which is also the challenge for the client.
+// The client replies with its own Hello, followed by its fingerprint and the signed challenge.
+// With FeatureMutualAuth the client sends the Room before signing a transcript of the handshake,
+// and the server answers with its own signature of the transcript.
+// Older clients just sign the challenge, older servers send random bytes instead of a Hello.
+// On the contact port the Hello is part of the ContactRequest and the ContactResponse.
+type Hello struct {
+	Protocol string   `json:"protocol"`
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+	//Nonce makes every Hello unique, so that it can also be used as a challenge
+	Nonce []byte `json:"nonce,omitempty"`
+	//Error is set instead of the Nonce if the connection is rejected before the handshake
+	Error *ProtocolError `json:"error,omitempty"`
+}
+
+// Protocol is the result of the negotiation between two daemons,
+// it contains the features that are supported by both.
+// The version of the Hello only tells newer daemons apart from older ones,
+// everything else depends on the features alone.
+type Protocol struct {
+	Features map[string]bool `json:"features"`
+}
+
+// NewHello creates the Hello for the protocol spoken by this daemon
+func NewHello() Hello {
+	nonce := make([]byte, helloNonceSize)
+	rand.Read(nonce)
+
+	return Hello{
+		Protocol: protocolName,
+		Version:  ProtocolVersion,
+		Features: supportedFeatures,
+		Nonce:    nonce,
+	}
+}
+
+// NewRejectHello creates the Hello that is sent in place of the challenge,
+// when a connection is rejected before the handshake, e.g. because the daemon is busy.
+func NewRejectHello(code ErrorCode, detail string) Hello {
+	return Hello{
+		Protocol: protocolName,
+		Version:  ProtocolVersion,
+		Error:    &ProtocolError{Code: code, Detail: detail},
+	}
+}
+
+// ParseHello returns the Hello contained in raw.
+// Older daemons send something else in its place, in which case false is returned.
+func ParseHello(raw []byte) (Hello, bool) {
+	hello := Hello{}
+
+	err := json.Unmarshal(raw, &hello)
+	if err != nil || hello.Protocol != protocolName || hello.Version <= LegacyProtocolVersion {
+		return Hello{}, false
+	}
+
+	return hello, true
+}
+
+// Negotiate determines the Protocol used with a remote that sent the specified Hello.
+// A nil Hello means that the remote is an older daemon.
+func Negotiate(own Hello, remote *Hello) Protocol {
+	if remote == nil {
+		return LegacyProtocol()
+	}
+
+	p := Protocol{
+		Features: make(map[string]bool),
+	}
+
+	for _, feature := range own.Features {
+		for _, remoteFeature := range remote.Features {
+			if feature == remoteFeature {
+				p.Features[feature] = true
+			}
+		}
+	}
+
+	return p
+}
+
+// LegacyProtocol returns the Protocol spoken by daemons that don't send a Hello
+func LegacyProtocol() Protocol {
+	return Protocol{
+		Features: make(map[string]bool),
+	}
+}
+
+// Supports returns true if both sides support the feature
+func (p Protocol) Supports(feature string) bool {
+	return p.Features[feature]
+}
+
+// LegacySyncState returns the time of the newest message of every sender,
+// which is how older daemons describe the state of a Room.
+func (r *Room) LegacySyncState() map[string]time.Time {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	state := make(map[string]time.Time)
+	for _, msg := range r.Messages {
+		if last, ok := state[msg.Meta.Sender]; !ok || msg.Meta.Time.After(last) {
+			state[msg.Meta.Sender] = msg.Meta.Time
+		}
+	}
+
+	return state
+}
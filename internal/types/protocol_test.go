@@ -0,0 +1,113 @@
+package types_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+)
+
+func TestParseHello(t *testing.T) {
+	hello := NewHello()
+	raw, _ := json.Marshal(hello)
+
+	parsed, ok := ParseHello(raw)
+
+	assert.True(t, ok)
+	assert.Equal(t, hello, parsed)
+}
+
+func TestParseHelloLegacyChallenge(t *testing.T) {
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+
+	_, ok := ParseHello(challenge)
+
+	assert.False(t, ok)
+}
+
+func TestNegotiate(t *testing.T) {
+	own := NewHello()
+	remote := Hello{
+		Version:  ProtocolVersion + 1,
+		Features: []string{FeatureSeqSync, "unknown"},
+	}
+
+	proto := Negotiate(own, &remote)
+
+	assert.True(t, proto.Supports(FeatureSeqSync))
+	assert.False(t, proto.Supports(FeatureRatchet))
+	assert.False(t, proto.Supports("unknown"))
+}
+
+func TestNegotiateLegacy(t *testing.T) {
+	proto := Negotiate(NewHello(), nil)
+
+	assert.False(t, proto.Supports(FeatureSeqSync))
+	assert.False(t, proto.Supports(FeatureBlobResume))
+}
+
+func TestParseRejectHello(t *testing.T) {
+	raw, _ := json.Marshal(NewRejectHello(ErrorBusy, "too many connections"))
+
+	hello, ok := ParseHello(raw)
+
+	assert.True(t, ok)
+	assert.Equal(t, &ProtocolError{Code: ErrorBusy, Detail: "too many connections"}, hello.Error)
+}
+
+func TestHandshakeTranscriptSeparation(t *testing.T) {
+	challenge, _ := json.Marshal(NewHello())
+	clientHello, _ := json.Marshal(NewHello())
+	room := uuid.New()
+
+	client := HandshakeTranscript(HandshakeClient, challenge, clientHello, room, "client", "server")
+
+	assert.NotEqual(t, client, HandshakeTranscript(HandshakeServer, challenge, clientHello, room, "client", "server"))
+	assert.NotEqual(t, client, HandshakeTranscript(HandshakeClient, challenge, clientHello, uuid.New(), "client", "server"))
+	assert.NotEqual(t, client, HandshakeTranscript(HandshakeClient, challenge, clientHello, room, "server", "client"))
+	//Fields are length prefixed, so moving bytes between them changes the transcript
+	assert.NotEqual(t, client, HandshakeTranscript(HandshakeClient, challenge, clientHello, room, "clients", "erver"))
+	//A transcript can't be relayed as the challenge of an older daemon
+	assert.NotEqual(t, 32, len(client))
+}
+
+// legacyChallenge lets the client answer challenge as an older daemon, and returns the error of the handshake
+func legacyChallenge(t *testing.T, room *Room, peer Identity, challenge []byte) error {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		remote := connection.WrapConnection(server)
+		remote.WriteBytes(challenge)
+		remote.Flush()
+		io.Copy(io.Discard, server)
+	}()
+
+	_, _, err := ClientHandshake(connection.WrapConnection(client), room, peer)
+	return err
+}
+
+func TestHandshakeLegacyChallenge(t *testing.T) {
+	room, _ := setupRoleTests(t)
+	peer := room.Peers[0].RIdentity
+
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+	assert.NoError(t, legacyChallenge(t, room, peer, challenge))
+
+	transcript := HandshakeTranscript(HandshakeClient, challenge, challenge, room.ID, room.Self.Fingerprint(), peer.Fingerprint())
+	assert.Error(t, legacyChallenge(t, room, peer, transcript))
+
+	//Once the peer authenticated itself, it can't fall back to the older handshake
+	room.SetPeerProtocol(peer.Fingerprint(), Protocol{Features: map[string]bool{FeatureMutualAuth: true}})
+	assert.Error(t, legacyChallenge(t, room, peer, challenge))
+}
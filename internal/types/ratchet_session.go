@@ -0,0 +1,296 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/craumix/onionmsg/pkg/ratchet"
+	"github.com/craumix/onionmsg/pkg/seal"
+)
+
+// Envelope carries a single message, encrypted with the double ratchet session of a two-party Room.
+// The session only protects messages in transit, envelopes that were recorded can't be decrypted with a later state.
+// Received messages are part of the history of the Room, which is only protected by the data file.
+type Envelope struct {
+	Header     ratchet.Header `json:"header"`
+	Ciphertext []byte         `json:"ciphertext"`
+}
+
+var (
+	errAwaitingSession = fmt.Errorf("waiting for the first message of the initiator of the ratchet session")
+)
+
+// envelopeBatch is sent instead of the plain list of messages when syncing over a ratchet session.
+// Since it is a JSON object instead of an array, the receiver can tell both formats apart.
+type envelopeBatch struct {
+	Envelopes []Envelope `json:"envelopes"`
+}
+
+// AnnounceRatchet tells the peers that Self supports double ratchet sessions, if it hasn't done so yet.
+// A session is only used once both members of a two-party Room announced their support.
+func (r *Room) AnnounceRatchet() {
+	r.msgUpdateMutex.Lock()
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+	_, announced := r.ratchetPeers[r.Self.Fingerprint()]
+	r.msgUpdateMutex.Unlock()
+
+	if !announced {
+		content, _ := NewCommandContent(RoomCommandRatchet, nil)
+		r.SendMessageToAllPeers(content)
+	}
+}
+
+// usesRatchet returns true if messages to mp are sent over a ratchet session,
+// which is the case if it's the only peer in the Room and both sides announced their support.
+func (mp *MessagingPeer) usesRatchet() bool {
+	r := mp.Room
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	if len(r.Peers) != 1 || r.Peers[0] != mp {
+		return false
+	}
+
+	_, selfAnnounced := r.ratchetPeers[r.Self.Fingerprint()]
+	_, peerAnnounced := r.ratchetPeers[mp.RIdentity.Fingerprint()]
+
+	return selfAnnounced && peerAnnounced
+}
+
+// isInitiator decides which side of the session sends the first message,
+// so that both peers agree on it without any further communication.
+func (mp *MessagingPeer) isInitiator() bool {
+	return mp.Room.Self.Fingerprint() < mp.RIdentity.Fingerprint()
+}
+
+// newSession bootstraps a ratchet session from the identities of Self and the peer
+func (mp *MessagingPeer) newSession() (*ratchet.Session, error) {
+	self := mp.Room.Self
+
+	selfPub, err := seal.PublicKeyToCurve25519(*self.Pub)
+	if err != nil {
+		return nil, err
+	}
+	selfKeys := ratchet.KeyPair{
+		Priv: *seal.PrivateKeyToCurve25519(*self.Priv),
+		Pub:  *selfPub,
+	}
+
+	remote, err := seal.PublicKeyToCurve25519(*mp.RIdentity.Pub)
+	if err != nil {
+		return nil, err
+	}
+
+	sk, err := ratchet.SharedSecret(&selfKeys.Priv, remote, append([]byte("onionmsg ratchet "), mp.Room.ID[:]...))
+	if err != nil {
+		return nil, err
+	}
+
+	if mp.isInitiator() {
+		return ratchet.NewInitiator(sk, remote)
+	}
+
+	return ratchet.NewResponder(sk, selfKeys), nil
+}
+
+// sealMessages returns what has to be sent to the peer for msgs, and the kind of frame it is sent in.
+// If a ratchet session is used, every message is encrypted with its own key,
+// otherwise the messages are returned as they are.
+// Once a session exists, the messages are never sent in plaintext, since the peer refuses them, see DecodeMessages.
+func (mp *MessagingPeer) sealMessages(msgs []Message) (FrameKind, interface{}, error) {
+	mp.sessionMutex.Lock()
+	established := mp.Session != nil && mp.Session.CanEncrypt()
+	mp.sessionMutex.Unlock()
+
+	if !established && !mp.usesRatchet() {
+		return FrameMessages, msgs, nil
+	}
+
+	mp.sessionMutex.Lock()
+	defer mp.sessionMutex.Unlock()
+
+	if mp.Session == nil {
+		session, err := mp.newSession()
+		if err != nil {
+			return 0, nil, err
+		}
+		mp.Session = session
+	}
+
+	//The responder has to wait for the first message of the initiator,
+	//which sends one with every sync until the responder answered
+	if !mp.Session.CanEncrypt() {
+		return 0, nil, errAwaitingSession
+	}
+
+	ad := mp.associatedData(mp.Room.Self.Fingerprint(), mp.RIdentity.Fingerprint())
+
+	batch := envelopeBatch{
+		Envelopes: make([]Envelope, 0, len(msgs)+1),
+	}
+
+	plaintexts := make([][]byte, 0, len(msgs)+1)
+	if mp.isInitiator() && mp.Session.CKr == nil {
+		//An empty envelope lets the responder start its sending chain, even if there are no messages
+		plaintexts = append(plaintexts, nil)
+	}
+	for _, msg := range msgs {
+		raw, err := json.Marshal(msg)
+		if err != nil {
+			return 0, nil, err
+		}
+		plaintexts = append(plaintexts, raw)
+	}
+
+	for _, raw := range plaintexts {
+		header, ciphertext, err := mp.Session.Encrypt(raw, ad)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		batch.Envelopes = append(batch.Envelopes, Envelope{
+			Header:     header,
+			Ciphertext: ciphertext,
+		})
+	}
+
+	return FrameEnvelopes, batch, nil
+}
+
+// needsBootstrap returns true if the initiator has to send an envelope to the peer,
+// even if there are no messages to sync, so that the peer can start its sending chain
+func (mp *MessagingPeer) needsBootstrap() bool {
+	if !mp.isInitiator() || !mp.usesRatchet() {
+		return false
+	}
+
+	mp.sessionMutex.Lock()
+	defer mp.sessionMutex.Unlock()
+
+	return mp.Session == nil || mp.Session.CKr == nil
+}
+
+// receivedEnvelopes returns true if the peer already sent messages over the ratchet session,
+// after which it must not send any in plaintext anymore
+func (mp *MessagingPeer) receivedEnvelopes() bool {
+	mp.sessionMutex.Lock()
+	defer mp.sessionMutex.Unlock()
+
+	return mp.Session != nil && mp.Session.CKr != nil
+}
+
+// resetSession discards the ratchet session,
+// e.g. after the peer was unable to decrypt messages because it lost its state.
+func (mp *MessagingPeer) resetSession() {
+	mp.sessionMutex.Lock()
+	defer mp.sessionMutex.Unlock()
+
+	mp.Session = nil
+}
+
+// openEnvelopes decrypts the messages the peer sent over the ratchet session
+func (mp *MessagingPeer) openEnvelopes(batch envelopeBatch) ([]Message, error) {
+	mp.sessionMutex.Lock()
+	defer mp.sessionMutex.Unlock()
+
+	if mp.Session == nil {
+		session, err := mp.newSession()
+		if err != nil {
+			return nil, err
+		}
+		mp.Session = session
+	}
+
+	msgs, err := mp.openWithSession(mp.Session, batch)
+	if err != nil && !mp.isInitiator() {
+		//The initiator might have started over with a new session
+		session, newErr := mp.newSession()
+		if newErr != nil {
+			return nil, newErr
+		}
+
+		msgs, newErr = mp.openWithSession(session, batch)
+		if newErr != nil {
+			return nil, err
+		}
+
+		log.WithField("peer", mp.RIdentity.Fingerprint()).Debug("ratchet session was restarted by the peer")
+		mp.Session = session
+		err = nil
+	}
+
+	return msgs, err
+}
+
+func (mp *MessagingPeer) openWithSession(session *ratchet.Session, batch envelopeBatch) ([]Message, error) {
+	ad := mp.associatedData(mp.RIdentity.Fingerprint(), mp.Room.Self.Fingerprint())
+
+	msgs := make([]Message, 0, len(batch.Envelopes))
+	for _, env := range batch.Envelopes {
+		raw, err := session.Decrypt(env.Header, env.Ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+
+		//Empty envelopes only start the session, see sealMessages
+		if len(raw) == 0 {
+			continue
+		}
+
+		msg := Message{}
+		err = json.Unmarshal(raw, &msg)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// associatedData binds every envelope to the Room, and the direction it was sent in
+func (mp *MessagingPeer) associatedData(sender, receiver string) []byte {
+	ad := append([]byte{}, mp.Room.ID[:]...)
+	ad = append(ad, sender...)
+	return append(ad, receiver...)
+}
+
+// DecodeMessages parses the messages that the peer with the specified fingerprint sent during a sync.
+// They are either sent as a plain list, or encrypted with the ratchet session of a two-party Room.
+func (r *Room) DecodeMessages(fingerprint string, frame Frame) ([]Message, error) {
+	switch frame.Kind {
+	case FrameMessages:
+		//Once the peer used the ratchet session, it must not fall back to plaintext
+		for _, peer := range r.peersCopy() {
+			if peer.RIdentity.Fingerprint() == fingerprint && peer.receivedEnvelopes() {
+				return nil, fmt.Errorf("peer %s sent messages in plaintext over a ratchet session", fingerprint)
+			}
+		}
+
+		msgs := make([]Message, 0)
+		err := frame.Decode(&msgs)
+		return msgs, err
+	case FrameEnvelopes:
+		batch := envelopeBatch{}
+		err := frame.Decode(&batch)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, peer := range r.peersCopy() {
+			if peer.RIdentity.Fingerprint() == fingerprint {
+				peer.Room = r
+				return peer.openEnvelopes(batch)
+			}
+		}
+
+		return nil, peerNotFoundError(fingerprint)
+	default:
+		return nil, fmt.Errorf("frame of kind %d doesn't contain messages", frame.Kind)
+	}
+}
@@ -0,0 +1,223 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"unicode"
+)
+
+//go:generate go run gen_pictographs.go
+
+const (
+	maxReactionSize = 64
+
+	zeroWidthJoiner   = '\u200d'
+	variationSelector = '\ufe0f'
+	combiningKeycap   = '\u20e3'
+	blackFlag         = '\U0001f3f4'
+	cancelTag         = '\U000e007f'
+)
+
+// NewReactionContent creates the content for a message that reacts with an emoji to the message with the specified id
+func NewReactionContent(id, emoji string) MessageContent {
+	return MessageContent{
+		Type:   ContentTypeReaction,
+		Target: id,
+		Data:   []byte(emoji),
+	}
+}
+
+// NewReactionRemoveContent creates the content for a message that removes a previous reaction
+func NewReactionRemoveContent(id, emoji string) MessageContent {
+	return MessageContent{
+		Type:   ContentTypeReactionRemove,
+		Target: id,
+		Data:   []byte(emoji),
+	}
+}
+
+// IsReaction returns true if the message adds or removes a reaction
+func (m *Message) IsReaction() bool {
+	return m.Content.Type == ContentTypeReaction || m.Content.Type == ContentTypeReactionRemove
+}
+
+// React sends a reaction with the emoji to the message with the specified id to all peers
+func (r *Room) React(id, emoji string) error {
+	return r.sendReaction(NewReactionContent(id, emoji))
+}
+
+// Unreact removes the reaction with the emoji from the message with the specified id
+func (r *Room) Unreact(id, emoji string) error {
+	return r.sendReaction(NewReactionRemoveContent(id, emoji))
+}
+
+func (r *Room) sendReaction(content MessageContent) error {
+	if !validReaction(string(content.Data)) {
+		return fmt.Errorf("invalid reaction \"%s\"", string(content.Data))
+	}
+
+	r.msgUpdateMutex.Lock()
+	target, _, found := r.messageByID(content.Target)
+	r.msgUpdateMutex.Unlock()
+
+	switch {
+	case !found:
+		return messageNotFoundError(content.Target)
+	case !target.IsChatMessage():
+		return fmt.Errorf("can't react to message %s", content.Target)
+	}
+
+	r.SendMessageToAllPeers(content)
+	return nil
+}
+
+// applyReaction records the newest reaction message of a sender for every emoji and target.
+// Since the sequence number decides which one is the newest,
+// the result doesn't depend on the order in which they were received.
+func (r *Room) applyReaction(msg Message) {
+	emoji, ok := r.reactionEmoji(msg)
+	if !ok || !validReaction(emoji) {
+		return
+	}
+
+	target := msg.Content.Target
+	if r.reactions[target] == nil {
+		r.reactions[target] = make(map[string]map[string]Message)
+	}
+	if r.reactions[target][msg.Meta.Sender] == nil {
+		r.reactions[target][msg.Meta.Sender] = make(map[string]Message)
+	}
+
+	if last, ok := r.reactions[target][msg.Meta.Sender][emoji]; !ok || msg.Meta.Seq > last.Meta.Seq {
+		r.reactions[target][msg.Meta.Sender][emoji] = msg
+	}
+}
+
+// reactionEmoji returns the emoji of a reaction message, which is decrypted with its room key.
+// If the key isn't known yet, the reaction is applied once it arrives, see applyRoomKey.
+func (r *Room) reactionEmoji(msg Message) (string, bool) {
+	if msg.Content.Key == "" {
+		return string(msg.Content.Data), true
+	}
+
+	key, ok := r.keys[msg.Content.Key]
+	if !ok {
+		r.pendingReacts[msg.Content.Key] = append(r.pendingReacts[msg.Content.Key], msg)
+		return "", false
+	}
+
+	emoji, ok := key.open(msg.Content.Data)
+	return string(emoji), ok
+}
+
+// Reactions returns the reactions to the messages with the specified ids,
+// grouped by emoji and listing the fingerprints of all reacting peers.
+func (r *Room) Reactions(ids ...string) map[string]map[string][]string {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	reactions := make(map[string]map[string][]string)
+	for _, id := range ids {
+		reactions[id] = r.reactionsFor(id)
+	}
+
+	return reactions
+}
+
+// reactionsFor has to be called with msgUpdateMutex held
+func (r *Room) reactionsFor(id string) map[string][]string {
+	grouped := make(map[string][]string)
+
+	for sender, emojis := range r.reactions[id] {
+		for emoji, msg := range emojis {
+			if msg.Content.Type == ContentTypeReaction {
+				grouped[emoji] = append(grouped[emoji], sender)
+			}
+		}
+	}
+
+	for _, senders := range grouped {
+		sort.Strings(senders)
+	}
+
+	return grouped
+}
+
+// validReaction returns true if emoji is a single emoji,
+// which may be a sequence of code points that is shown as one, e.g. a flag or a family
+func validReaction(emoji string) bool {
+	if emoji == "" || len(emoji) > maxReactionSize {
+		return false
+	}
+
+	runes := []rune(emoji)
+	for i := 0; ; i++ {
+		n := emojiElement(runes[i:])
+		if n == 0 {
+			return false
+		}
+
+		i += n
+		if i == len(runes) {
+			return true
+		} else if runes[i] != zeroWidthJoiner {
+			return false
+		}
+	}
+}
+
+// emojiElement returns the number of runes of the emoji at the start of runes,
+// which are joined by a zero width joiner to form a sequence, or 0 if it doesn't start with one
+func emojiElement(runes []rune) int {
+	switch {
+	case len(runes) == 0:
+		return 0
+	case isRegionalIndicator(runes[0]):
+		//Flags are pairs of regional indicators
+		if len(runes) >= 2 && isRegionalIndicator(runes[1]) {
+			return 2
+		}
+		return 0
+	case runes[0] == '#' || runes[0] == '*' || (runes[0] >= '0' && runes[0] <= '9'):
+		n := 1
+		if n < len(runes) && runes[n] == variationSelector {
+			n++
+		}
+		if n < len(runes) && runes[n] == combiningKeycap {
+			return n + 1
+		}
+		return 0
+	case !unicode.Is(pictographs, runes[0]):
+		return 0
+	}
+
+	n := 1
+	if n < len(runes) && (runes[n] == variationSelector || isSkinTone(runes[n])) {
+		n++
+	}
+
+	//Subdivision flags are a black flag followed by tags
+	if runes[0] == blackFlag && n < len(runes) && isTag(runes[n]) {
+		for n < len(runes) && isTag(runes[n]) {
+			n++
+		}
+		if n < len(runes) && runes[n] == cancelTag {
+			return n + 1
+		}
+		return 0
+	}
+
+	return n
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+func isSkinTone(r rune) bool {
+	return r >= 0x1f3fb && r <= 0x1f3ff
+}
+
+func isTag(r rune) bool {
+	return r >= 0xe0020 && r <= 0xe007e
+}
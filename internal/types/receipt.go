@@ -0,0 +1,205 @@
+package types
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type Receipt string
+
+const (
+	ReceiptDelivered Receipt = "delivered"
+	ReceiptRead      Receipt = "read"
+)
+
+// deliveryInterval is the time the ids of received messages are collected for,
+// so that all messages received during a sync window are confirmed with a single receipt
+var deliveryInterval = 5 * time.Second
+
+// deliveryBatch holds the ids of received messages that weren't confirmed yet, see deliveryInterval
+type deliveryBatch struct {
+	mutex sync.Mutex
+	ids   []string
+	timer *time.Timer
+}
+
+// NewReceiptContent creates the content for a receipt message,
+// which marks the messages with the specified ids as delivered or read.
+func NewReceiptContent(receipt Receipt, ids ...string) MessageContent {
+	data, _ := json.Marshal(ids)
+
+	cType := ContentTypeDelivered
+	if receipt == ReceiptRead {
+		cType = ContentTypeRead
+	}
+
+	return MessageContent{
+		Type: cType,
+		Data: data,
+	}
+}
+
+// ConfirmDelivery marks the messages with the specified ids as delivered.
+// Since every receipt is stored and synced like any other message, the ids are collected
+// for deliveryInterval and then sent to all peers in a single receipt.
+func (r *Room) ConfirmDelivery(ids ...string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	r.deliveries.mutex.Lock()
+	defer r.deliveries.mutex.Unlock()
+
+	r.deliveries.ids = append(r.deliveries.ids, ids...)
+	if r.deliveries.timer == nil {
+		r.deliveries.timer = time.AfterFunc(deliveryInterval, r.flushDeliveries)
+	}
+}
+
+// flushDeliveries sends the receipt for all messages collected by ConfirmDelivery
+func (r *Room) flushDeliveries() {
+	r.deliveries.mutex.Lock()
+	ids := r.deliveries.ids
+	r.deliveries.ids = nil
+	r.deliveries.timer = nil
+	r.deliveries.mutex.Unlock()
+
+	if r.Ctx != nil && r.Ctx.Err() != nil {
+		return
+	}
+
+	r.SendMessageToAllPeers(NewReceiptContent(ReceiptDelivered, ids...))
+}
+
+// IsReceipt returns true if the message is a delivered or read receipt
+func (m *Message) IsReceipt() bool {
+	return m.Content.Type == ContentTypeDelivered || m.Content.Type == ContentTypeRead
+}
+
+// ReceiptIDs returns the ids of the messages referenced by a receipt
+func (m *Message) ReceiptIDs() []string {
+	ids := make([]string, 0)
+	if !m.IsReceipt() {
+		return ids
+	}
+
+	json.Unmarshal(m.Content.Data, &ids)
+
+	return ids
+}
+
+func (m *Message) receipt() Receipt {
+	if m.Content.Type == ContentTypeRead {
+		return ReceiptRead
+	}
+
+	return ReceiptDelivered
+}
+
+// applyReceipt aggregates the receipt in msg per peer,
+// a read receipt always takes precedence over a delivered receipt.
+func (r *Room) applyReceipt(msg Message) {
+	if r.receipts == nil {
+		r.receipts = make(map[string]map[string]Receipt)
+	}
+
+	for _, id := range msg.ReceiptIDs() {
+		addReceipt(r.receipts, id, msg.Meta.Sender, msg.receipt())
+	}
+}
+
+func addReceipt(receipts map[string]map[string]Receipt, id, sender string, receipt Receipt) {
+	if receipts[id] == nil {
+		receipts[id] = make(map[string]Receipt)
+	}
+
+	if receipts[id][sender] != ReceiptRead {
+		receipts[id][sender] = receipt
+	}
+}
+
+// compactReceipts removes the receipt messages that all peers acknowledged from Messages,
+// and only keeps the receipts they contain in CompactedReceipts,
+// since they are never synced again and a receipt per message and peer is all that is shown.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) compactReceipts() {
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+
+	if len(r.Peers) == 0 {
+		return
+	}
+
+	kept := make([]Message, 0, len(r.Messages))
+	for _, msg := range r.Messages {
+		if !msg.IsReceipt() || !r.acknowledgedByPeers(msg) {
+			kept = append(kept, msg)
+			continue
+		}
+
+		if r.CompactedReceipts == nil {
+			r.CompactedReceipts = make(map[string]map[string]Receipt)
+		}
+		if r.CompactedSeqs == nil {
+			r.CompactedSeqs = make(SyncMap)
+		}
+
+		for _, id := range msg.ReceiptIDs() {
+			if _, deleted := r.Deleted[id]; !deleted {
+				addReceipt(r.CompactedReceipts, id, msg.Meta.Sender, msg.receipt())
+			}
+		}
+
+		if msg.Meta.Seq > r.CompactedSeqs[msg.Meta.Sender] {
+			r.CompactedSeqs[msg.Meta.Sender] = msg.Meta.Seq
+		}
+	}
+
+	r.Messages = kept
+}
+
+// acknowledgedByPeers returns true if msg and all earlier messages of its sender are known to Self and all peers,
+// so that the sequence numbers up to msg never have to be synced again.
+// Messages of older versions don't have a sequence number, and are never acknowledged.
+func (r *Room) acknowledgedByPeers(msg Message) bool {
+	if msg.Meta.Seq == 0 || msg.Meta.Seq > r.SyncState[msg.Meta.Sender] {
+		return false
+	}
+
+	for _, peer := range r.Peers {
+		if peer.LastSyncState[msg.Meta.Sender] < msg.Meta.Seq {
+			return false
+		}
+	}
+
+	return true
+}
+
+// receiptCompacted returns true if msg is a receipt that was already removed by compactReceipts
+func (r *Room) receiptCompacted(msg Message) bool {
+	return msg.IsReceipt() && msg.Meta.Seq != 0 && msg.Meta.Seq <= r.CompactedSeqs[msg.Meta.Sender]
+}
+
+// Receipts returns the receipts of all peers for the messages with the specified ids
+func (r *Room) Receipts(ids ...string) map[string]map[string]Receipt {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	receipts := make(map[string]map[string]Receipt)
+	for _, id := range ids {
+		receipts[id] = copyReceipts(r.receipts[id])
+	}
+
+	return receipts
+}
+
+func copyReceipts(m map[string]Receipt) map[string]Receipt {
+	cp := make(map[string]Receipt)
+	for k, v := range m {
+		cp[k] = v
+	}
+
+	return cp
+}
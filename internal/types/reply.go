@@ -0,0 +1,82 @@
+package types
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	//maxExcerptLength is the number of characters of the replied to message that are quoted
+	maxExcerptLength = 140
+)
+
+// ReplyRef references the message that is replied to by its id.
+// The excerpt lets frontends show the reply even if the message isn't known,
+// it is encrypted with the room key just like the data of the content.
+type ReplyRef struct {
+	ID      string `json:"id"`
+	Excerpt []byte `json:"excerpt,omitempty"`
+}
+
+// ReplyTargetError is returned if the message that is replied to is unknown or can't be replied to
+type ReplyTargetError struct {
+	ID     string
+	Reason string
+}
+
+func (e *ReplyTargetError) Error() string {
+	return fmt.Sprintf("can't reply to message %s: %s", e.ID, e.Reason)
+}
+
+// NewReplyRef creates a reference to the message with the specified id,
+// quoting the beginning of its text if it is known to the Room
+func (r *Room) NewReplyRef(id string) (*ReplyRef, error) {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	target, _, found := r.messageByID(id)
+	switch {
+	case !found:
+		return nil, &ReplyTargetError{ID: id, Reason: "not found"}
+	case !target.IsChatMessage():
+		return nil, &ReplyTargetError{ID: id, Reason: "not a chat message"}
+	}
+
+	content := target.Content
+	r.decryptContent(&content)
+
+	var excerpt string
+	switch {
+	case content.Type == ContentTypeText:
+		excerpt = string(content.Data)
+	case content.Blob != nil:
+		excerpt = content.Blob.Name
+	}
+
+	return &ReplyRef{
+		ID:      id,
+		Excerpt: []byte(truncateExcerpt(excerpt)),
+	}, nil
+}
+
+// ReplyID returns the id of the message that is replied to, or an empty string.
+// Messages from older versions contain the complete message they reply to.
+func (c *MessageContent) ReplyID() string {
+	switch {
+	case c.Reply != nil:
+		return c.Reply.ID
+	case c.ReplyTo != nil:
+		return c.ReplyTo.calculateID()
+	default:
+		return ""
+	}
+}
+
+func truncateExcerpt(excerpt string) string {
+	if utf8.RuneCountInString(excerpt) <= maxExcerptLength {
+		return excerpt
+	}
+
+	runes := []rune(excerpt)
+	return string(runes[:maxExcerptLength])
+}
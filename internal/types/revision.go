@@ -0,0 +1,192 @@
+package types
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/craumix/onionmsg/pkg/blobmngr"
+)
+
+// Tombstone records a deleted message, so that it isn't accepted again
+// and its sequence number is still accounted for when syncing.
+type Tombstone struct {
+	Sender    string `json:"sender"`
+	Seq       uint64 `json:"seq,omitempty"`
+	DeletedBy string `json:"deletedBy"`
+}
+
+// NewEditContent creates the content for a message that replaces the data of the message with the specified id
+func NewEditContent(id string, data []byte) MessageContent {
+	return MessageContent{
+		Type:   ContentTypeEdit,
+		Target: id,
+		Data:   data,
+	}
+}
+
+// NewDeleteContent creates the content for a message that deletes the message with the specified id
+func NewDeleteContent(id string) MessageContent {
+	return MessageContent{
+		Type:   ContentTypeDelete,
+		Target: id,
+	}
+}
+
+// EditMessage replaces the data of a message sent by Self, and sends the edit to all peers
+func (r *Room) EditMessage(id string, data []byte) error {
+	r.msgUpdateMutex.Lock()
+	target, _, found := r.messageByID(id)
+	r.msgUpdateMutex.Unlock()
+
+	switch {
+	case !found:
+		return messageNotFoundError(id)
+	case !target.IsChatMessage():
+		return fmt.Errorf("message %s can't be edited", id)
+	case !r.isSelf(target.Meta.Sender):
+		return fmt.Errorf("message %s was not sent by self", id)
+	}
+
+	r.SendMessageToAllPeers(NewEditContent(id, data))
+	return nil
+}
+
+// DeleteMessage deletes a message sent by Self, or any message if Self is an admin,
+// and sends the deletion to all peers
+func (r *Room) DeleteMessage(id string) error {
+	r.msgUpdateMutex.Lock()
+	target, _, found := r.messageByID(id)
+	r.msgUpdateMutex.Unlock()
+
+	switch {
+	case !found:
+		return messageNotFoundError(id)
+	case !target.IsChatMessage():
+		return fmt.Errorf("message %s can't be deleted", id)
+	case !r.mayDelete(r.Self.Fingerprint(), target):
+		return peerNotAdminError(r.Self.Fingerprint())
+	}
+
+	r.SendMessageToAllPeers(NewDeleteContent(id))
+	return nil
+}
+
+// DeletedIDs returns all of the specified ids that belong to deleted messages
+func (r *Room) DeletedIDs(ids ...string) []string {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	deleted := make([]string, 0)
+	for _, id := range ids {
+		if _, found := r.Deleted[id]; found {
+			deleted = append(deleted, id)
+		}
+	}
+
+	return deleted
+}
+
+// mayDelete returns true if the peer with the fingerprint is allowed to delete msg,
+// which is the case for the original sender and admins.
+func (r *Room) mayDelete(fingerprint string, msg Message) bool {
+	return fingerprint == msg.Meta.Sender || r.isAdmin(fingerprint)
+}
+
+// applyDelete removes the target of a delete message from the history,
+// if it is already known and the sender of the deletion is allowed to delete it.
+// Otherwise the deletion stays pending until the target arrives.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) applyDelete(del Message) {
+	target, i, found := r.messageByID(del.Content.Target)
+	if !found {
+		return
+	}
+
+	if !target.IsChatMessage() || !r.mayDelete(del.Meta.Sender, target) {
+		log.WithField("message", target.ID).Debugf("%s is not allowed to delete message", del.Meta.Sender)
+		return
+	}
+
+	r.Messages = append(r.Messages[:i], r.Messages[i+1:]...)
+	r.markDeleted(target, del.Meta.Sender)
+}
+
+// dropIfDeleted checks whether msg was already deleted by a pending deletion,
+// in which case it is recorded as deleted and true is returned.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) dropIfDeleted(msg Message) bool {
+	if !msg.IsChatMessage() {
+		return false
+	}
+
+	for _, del := range r.pendingDeletes[msg.ID] {
+		if r.mayDelete(del.Meta.Sender, msg) {
+			r.markDeleted(msg, del.Meta.Sender)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Room) markDeleted(msg Message, deletedBy string) {
+	if r.Deleted == nil {
+		r.Deleted = make(map[string]Tombstone)
+	}
+
+	r.Deleted[msg.ID] = Tombstone{
+		Sender:    msg.Meta.Sender,
+		Seq:       msg.Meta.Seq,
+		DeletedBy: deletedBy,
+	}
+	delete(r.pendingDeletes, msg.ID)
+	delete(r.CompactedReceipts, msg.ID)
+
+	r.trackTombstone(msg.ID, r.Deleted[msg.ID])
+
+	if msg.ContainsBlob() {
+		err := blobmngr.RemoveBlob(msg.Content.Blob.ID)
+		if err != nil {
+			log.WithError(err).Debug("unable to remove blob of deleted message")
+		}
+	}
+
+	lf := log.Fields{
+		"room":    r.ID.String(),
+		"message": msg.ID,
+	}
+	log.WithFields(lf).Debug("message deleted")
+}
+
+// trackTombstone records a deleted message in the message index and the SyncState of the Room
+func (r *Room) trackTombstone(id string, t Tombstone) {
+	r.msgIDs[id] = struct{}{}
+	r.trackSeq(t.Sender, t.Seq)
+}
+
+// latestEdit returns the newest edit of msg by its original sender.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) latestEdit(msg Message) (Message, bool) {
+	var (
+		latest Message
+		found  bool
+	)
+
+	for _, edit := range r.edits[msg.ID] {
+		if edit.Meta.Sender != msg.Meta.Sender {
+			continue
+		}
+
+		if !found || edit.Meta.Seq > latest.Meta.Seq {
+			latest = edit
+			found = true
+		}
+	}
+
+	return latest, found
+}
+
+func messageNotFoundError(id string) error {
+	return fmt.Errorf("message %s not found", id)
+}
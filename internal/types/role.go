@@ -0,0 +1,169 @@
+package types
+
+import (
+	"fmt"
+)
+
+// Role decides which commands a member of a Room may run, see commandPermissions
+type Role string
+
+const (
+	RoleReadOnly Role = "readonly"
+	RoleMember   Role = "member"
+	RoleAdmin    Role = "admin"
+	RoleOwner    Role = "owner"
+)
+
+var (
+	roleRanks = map[Role]int{
+		RoleReadOnly: 1,
+		RoleMember:   2,
+		RoleAdmin:    3,
+		RoleOwner:    4,
+	}
+
+	//commandPermissions is the lowest role that may run each command,
+	//commands that aren't listed require RoleAdmin
+	commandPermissions = map[Command]Role{
+		RoomCommandInvite:            RoleAdmin,
+		RoomCommandNameRoom:          RoleAdmin,
+		RoomCommandTopic:             RoleAdmin,
+		RoomCommandNick:              RoleMember,
+		RoomCommandPromote:           RoleAdmin,
+		RoomCommandDemote:            RoleAdmin,
+		RoomCommandSetRole:           RoleAdmin,
+		RoomCommandTransferOwnership: RoleOwner,
+		RoomCommandRemovePeer:        RoleAdmin,
+		RoomCommandBan:               RoleAdmin,
+		RoomCommandUnban:             RoleAdmin,
+		RoomCommandRoomKey:           RoleAdmin,
+		RoomCommandRatchet:           RoleReadOnly,
+		RoomCommandAccept:            RoleReadOnly,
+		RoomCommandLeave:             RoleReadOnly,
+	}
+)
+
+// Valid returns true for all known roles
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// AtLeast returns true if r has the same or more permissions than other
+func (r Role) AtLeast(other Role) bool {
+	return roleRanks[r] >= roleRanks[other]
+}
+
+// RequiredRole returns the lowest role that may run command
+func RequiredRole(command Command) Role {
+	if role, ok := commandPermissions[command]; ok {
+		return role
+	}
+
+	return RoleAdmin
+}
+
+// Role returns the role of the identity in its Room.
+// Identities from older versions only have the admin flag.
+func (i Identity) Role() Role {
+	switch {
+	case i.Meta == nil:
+		return RoleMember
+	case i.Meta.Role.Valid():
+		return i.Meta.Role
+	case i.Meta.Admin:
+		return RoleAdmin
+	default:
+		return RoleMember
+	}
+}
+
+// SetRole changes the role of the identity,
+// and keeps the admin flag up to date for older versions
+func (i Identity) SetRole(role Role) {
+	if i.Meta == nil {
+		return
+	}
+
+	i.Meta.Role = role
+	i.Meta.Admin = role.AtLeast(RoleAdmin)
+}
+
+// mayManage returns true if manager may change the role of target or remove it.
+// Nobody can manage the owner, and admins can't manage members with a higher role than their own.
+func mayManage(manager, target Identity) bool {
+	return target.Role() != RoleOwner && manager.Role().AtLeast(target.Role())
+}
+
+// CheckPermission returns an error if Self may not send content
+func (r *Room) CheckPermission(content MessageContent) error {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	return r.checkPermission(r.Self.Fingerprint(), r.Self.Role(), content)
+}
+
+// checkPermission returns an error if sender may not send content with role
+func (r *Room) checkPermission(sender string, role Role, content MessageContent) error {
+	switch {
+	case content.Type == ContentTypeCmd:
+		command := commandName(content.Data)
+		if !role.AtLeast(RequiredRole(command)) {
+			return fmt.Errorf("%s may not run command %s as %s", sender, command, role)
+		}
+	case !role.AtLeast(RoleMember) && (content.isEncryptable() || content.Type == ContentTypeDelete):
+		return fmt.Errorf("%s may not post messages as %s", sender, role)
+	}
+
+	return nil
+}
+
+// roleAt returns the role that the sender of msg had when creating it, according to the membership log.
+// An event applies to the messages of a member after the ones its sender knew, see CommandPayload.Seen,
+// and to the messages a member sent after its own events. Without sequence numbers the time is compared instead.
+// Before the membership log contains the sender, its current role is used.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) roleAt(msg Message) (Role, bool) {
+	history, ok := r.roleHistory[msg.Meta.Sender]
+	if !ok {
+		member, found := r.memberByFingerprint(msg.Meta.Sender)
+		return member.Role(), found
+	}
+
+	var role Role
+	for _, change := range history {
+		if change.appliesTo(msg) {
+			role = change.role
+		}
+	}
+
+	return role, role != ""
+}
+
+// appliesTo returns true if the role change happened before msg was created, as far as its sender is concerned
+func (change roleChange) appliesTo(msg Message) bool {
+	if change.event == nil {
+		return true
+	}
+	event := change.event
+
+	if msg.Meta.Seq > 0 {
+		switch {
+		case event.Meta.Sender == msg.Meta.Sender && event.Meta.Seq > 0:
+			return event.Meta.Seq < msg.Meta.Seq
+		case change.seen != nil:
+			return *change.seen < msg.Meta.Seq
+		}
+	}
+
+	return !msg.Meta.Time.Before(event.Meta.Time)
+}
+
+// memberByFingerprint returns the identity of Self or the peer with the specified fingerprint
+func (r *Room) memberByFingerprint(fingerprint string) (Identity, bool) {
+	if r.isSelf(fingerprint) {
+		return r.Self, true
+	}
+
+	return r.PeerByFingerprint(fingerprint)
+}
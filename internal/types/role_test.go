@@ -0,0 +1,135 @@
+package types_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+)
+
+func setupRoleTests(t *testing.T) (*Room, Identity) {
+	CleanCallbacks()
+	RegisterRoomCommands()
+	t.Cleanup(CleanCallbacks)
+
+	room, _ := NewRoom(context.Background())
+	t.Cleanup(room.StopQueues)
+
+	return room, inviteMember(t, room)
+}
+
+// inviteMember creates an identity that is invited to room by Self
+func inviteMember(t *testing.T, room *Room) Identity {
+	member, _ := NewIdentity(Self, "")
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandInvite, member.Fingerprint()))
+
+	return member
+}
+
+func commandMessage(t *testing.T, sender Identity, seq uint64, command Command, args string) Message {
+	content, err := NewTextCommandContent(command, args)
+	assert.NoError(t, err)
+
+	return NewMessage(content, sender, seq)
+}
+
+func TestNewRoomOwner(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+
+	assert.Equal(t, RoleOwner, room.Self.Role())
+	assert.True(t, room.Self.Admin())
+}
+
+func TestLegacyAdminRole(t *testing.T) {
+	id, _ := NewIdentity(Self, "")
+	id.Meta.Admin = true
+
+	assert.Equal(t, RoleAdmin, id.Role())
+}
+
+func TestCommandPermissionDenied(t *testing.T) {
+	room, member := setupRoleTests(t)
+
+	err := room.PushMessages(commandMessage(t, member, 1, RoomCommandNameRoom, "renamed"))
+
+	assert.Error(t, err)
+	assert.Empty(t, room.Name)
+}
+
+func TestPromoteAndDemote(t *testing.T) {
+	room, member := setupRoleTests(t)
+	peer := room.Peers[0].RIdentity
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, member.Fingerprint()))
+	assert.Equal(t, RoleAdmin, peer.Role())
+
+	//Admins can't demote the owner
+	err := room.PushMessages(commandMessage(t, member, 1, RoomCommandDemote, room.Self.Fingerprint()))
+	assert.NoError(t, err)
+	assert.Equal(t, RoleOwner, room.Self.Role())
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandDemote, member.Fingerprint()))
+	assert.Equal(t, RoleMember, peer.Role())
+}
+
+func TestSetRoleReadOnly(t *testing.T) {
+	room, member := setupRoleTests(t)
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandSetRole, member.Fingerprint()+" readonly"))
+	assert.Equal(t, RoleReadOnly, room.Peers[0].RIdentity.Role())
+
+	err := room.PushMessages(
+		NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, member, 1),
+		commandMessage(t, member, 2, RoomCommandNick, "nick"),
+	)
+
+	var rejected *RejectedError
+	assert.ErrorAs(t, err, &rejected)
+	assert.Len(t, rejected.Messages, 2)
+}
+
+func TestSetRoleOwnerDenied(t *testing.T) {
+	room, member := setupRoleTests(t)
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandSetRole, member.Fingerprint()+" owner"))
+
+	assert.Equal(t, RoleMember, room.Peers[0].RIdentity.Role())
+}
+
+func TestTransferOwnership(t *testing.T) {
+	room, member := setupRoleTests(t)
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandTransferOwnership, member.Fingerprint()))
+
+	assert.Equal(t, RoleOwner, room.Peers[0].RIdentity.Role())
+	assert.Equal(t, RoleAdmin, room.Self.Role())
+	assert.Error(t, room.CheckPermission(mustCommand(t, RoomCommandTransferOwnership, member.Fingerprint())))
+}
+
+func mustCommand(t *testing.T, command Command, args string) MessageContent {
+	content, err := NewTextCommandContent(command, args)
+	assert.NoError(t, err)
+
+	return content
+}
+
+func TestRoomGenesis(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	t.Cleanup(room.StopQueues)
+
+	founder, err := VerifyGenesis(room.ID, *room.Genesis)
+	assert.NoError(t, err)
+	assert.Equal(t, room.Self.Fingerprint(), founder)
+
+	//Someone else can't claim to have founded the room, even with the same nonce
+	other, _ := NewRoom(context.Background())
+	t.Cleanup(other.StopQueues)
+	forged := NewRoomMessage(room.Genesis.Content, other.Self, 0, room.ID)
+
+	_, err = VerifyGenesis(room.ID, forged)
+	assert.Error(t, err)
+	_, err = VerifyGenesis(other.ID, *room.Genesis)
+	assert.Error(t, err)
+}
@@ -1,13 +1,16 @@
 package types
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/craumix/onionmsg/pkg/blobmngr"
 	"github.com/craumix/onionmsg/pkg/sio/connection"
 
 	"github.com/google/uuid"
@@ -18,10 +21,51 @@ type Room struct {
 	Peers    []*MessagingPeer `json:"peers"`
 	ID       uuid.UUID        `json:"uuid"`
 	Name     string           `json:"name"`
+	Topic    string           `json:"topic,omitempty"`
 	Messages []Message        `json:"messages"`
-
-	SyncState      SyncMap `json:"lastMessage"`
+	//Founder is the owner with which the membership log starts, see rebuildRoster
+	Founder string `json:"founder,omitempty"`
+	//Genesis is the founding event, which proves who the Founder is, see VerifyGenesis.
+	//Rooms created by older versions have none.
+	Genesis *Message `json:"genesis,omitempty"`
+
+	//Deleted contains a Tombstone for every message that was removed from Messages
+	Deleted map[string]Tombstone `json:"deleted,omitempty"`
+	//CompactedReceipts contains the receipts of all receipt messages that were removed from Messages,
+	//CompactedSeqs the sequence number of the last of them for every sender, see compactReceipts
+	CompactedReceipts map[string]map[string]Receipt `json:"compactedReceipts,omitempty"`
+	CompactedSeqs     SyncMap                       `json:"compactedSeqs,omitempty"`
+	//Skipped contains the sequence numbers that peers reported as deleted or compacted for their own messages, see SkipSeqs
+	Skipped SkippedSeqs `json:"skipped,omitempty"`
+	//Leaving is set once Self left the Room, which is deleted as soon as a peer acknowledged it, see Leave
+	Leaving bool `json:"leaving,omitempty"`
+	//OwnKeys contains the room keys created by Self by their id, unencrypted like the identity of Self,
+	//so they don't protect the content stored in the same data file, see roomKey
+	OwnKeys map[string][]byte `json:"ownKeys,omitempty"`
+
+	SyncState      SyncMap `json:"syncState"`
 	msgUpdateMutex sync.Mutex
+	msgIDs         map[string]struct{}
+	blobIDs        map[uuid.UUID]struct{}
+	blobHashes     map[string]struct{}
+	seqsAhead      map[string]map[uint64]struct{}
+	receipts       map[string]map[string]Receipt
+	edits          map[string][]Message
+	reactions      map[string]map[string]map[string]Message
+	pendingDeletes map[string][]Message
+	pendingReacts  map[string][]Message
+	keys           map[string]*roomKey
+	ratchetPeers   map[string]struct{}
+	memberLog      *membershipLog
+	bans           banList
+	roleHistory    roleHistory
+	state          map[string]stateRegister
+	stateClock     uint64
+	pendingState   []Message
+	leaveSeq       uint64
+	syncWaiters    []syncWaiter
+	signals        signalThrottle
+	deliveries     deliveryBatch
 
 	Ctx  context.Context `json:"-"`
 	stop context.CancelFunc
@@ -32,8 +76,13 @@ type RoomInfo struct {
 	Peers  []string          `json:"peers"`
 	ID     uuid.UUID         `json:"uuid"`
 	Name   string            `json:"name,omitempty"`
+	Topic  string            `json:"topic,omitempty"`
 	Nicks  map[string]string `json:"nicks,omitempty"`
 	Admins map[string]bool   `json:"admins,omitempty"`
+	Roles  map[string]Role   `json:"roles,omitempty"`
+	Banned []string          `json:"banned,omitempty"`
+	//Leaving is set while the Room waits for a peer to acknowledge that Self left it
+	Leaving bool `json:"leaving,omitempty"`
 }
 
 func NewRoom(ctx context.Context, contactIdentities ...Identity) (*Room, error) {
@@ -42,10 +91,17 @@ func NewRoom(ctx context.Context, contactIdentities ...Identity) (*Room, error)
 		return nil, err
 	}
 
-	id.Meta.Admin = true
+	id.SetRole(RoleOwner)
+	genesis, roomID, err := newGenesis(id)
+	if err != nil {
+		return nil, err
+	}
+
 	room := &Room{
 		Self:      id,
-		ID:        uuid.New(),
+		ID:        roomID,
+		Founder:   id.Fingerprint(),
+		Genesis:   &genesis,
 		SyncState: make(SyncMap),
 	}
 
@@ -75,60 +131,96 @@ AddPeers adds a user to the Room, and if successful syncs the PeerLists.
 If not successful returns the error.
 */
 func (r *Room) AddPeers(contactIdentities ...Identity) error {
-	var newPeers []*MessagingPeer
+	if !r.Self.Role().AtLeast(RequiredRole(RoomCommandInvite)) {
+		return fmt.Errorf("%s may not invite peers as %s", r.Self.Fingerprint(), r.Self.Role())
+	}
+
+	var (
+		newPeers []*MessagingPeer
+		invites  []InviteArgs
+		protos   []Protocol
+	)
 	for _, identity := range contactIdentities {
-		newPeer, err := r.createPeerViaContactID(identity)
+		//Every invitation creates a new room identity, so bans are checked against the contact identity,
+		//before it is sent anything about the Room
+		if r.IsBanned(identity.Fingerprint()) {
+			return fmt.Errorf("%s is banned from room %s", identity.Fingerprint(), r.ID)
+		}
+
+		newPeer, invite, proto, err := r.createPeerViaContactID(identity)
 		if err != nil {
 			return err
 		}
 		newPeers = append(newPeers, newPeer)
+		invites = append(invites, invite)
+		protos = append(protos, proto)
 	}
 
+	r.msgUpdateMutex.Lock()
 	r.Peers = append(r.Peers, newPeers...)
+	r.msgUpdateMutex.Unlock()
+
+	//The contact handshake is done by the same daemon, so its Protocol applies until the first sync
+	for i, peer := range newPeers {
+		r.SetPeerProtocol(peer.RIdentity.Fingerprint(), protos[i])
+	}
 
 	for _, peer := range newPeers {
 		go peer.RunMessageQueue(r.Ctx, r)
 	}
 
-	r.syncPeerLists()
+	r.syncPeerLists(invites)
 
 	return nil
 }
 
-/*
-Syncs the user list for all peers.
-This only adds users, and can't remove users from peers.
-*/
-func (r *Room) syncPeerLists() {
-	for _, peer := range r.Peers {
-		r.SendMessageToAllPeers(MessageContent{
-			Type: ContentTypeCmd,
-			//TODO make it easier to create command messages
-			Data: []byte(string(RoomCommandInvite) + " " + peer.RIdentity.Fingerprint()),
-		})
+// syncPeerLists records the invitations of the new peers in the membership log,
+// from which every other peer rebuilds its member list.
+func (r *Room) syncPeerLists(invites []InviteArgs) {
+	for i := range invites {
+		content, err := NewCommandContent(RoomCommandInvite, &invites[i])
+		if err != nil {
+			log.WithError(err).WithField("room", r.ID.String()).Warn("unable to create invite")
+			continue
+		}
+		r.SendMessageToAllPeers(content)
 	}
 }
 
 /*
 This function tries to add a user with the contactID to the Room.
 This only adds the user, so the user lists are then out of sync.
-Call syncPeerLists() to sync them again.
+Call syncPeerLists() with the returned invite to record it in the membership log,
+it contains the signature of the contact identity, which proves whom the peer was invited through.
+The Protocol negotiated during the contact handshake is returned along with the peer.
 */
-func (r *Room) createPeerViaContactID(contactIdentity Identity) (*MessagingPeer, error) {
+func (r *Room) createPeerViaContactID(contactIdentity Identity) (*MessagingPeer, InviteArgs, Protocol, error) {
+	peers := r.peersCopy()
+	members := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		members = append(members, peer.RIdentity.Fingerprint())
+	}
+
 	dataConn, err := connection.GetConnFunc("tcp", contactIdentity.URL()+":"+strconv.Itoa(PubContPort))
 	if err != nil {
-		return nil, err
+		return nil, InviteArgs{}, Protocol{}, err
 	}
 	defer dataConn.Close()
 
+	LimitSession(dataConn)
+
+	hello := NewHello()
 	req := &ContactRequest{
 		RemoteFP: contactIdentity.Fingerprint(),
 		LocalFP:  r.Self.Fingerprint(),
 		ID:       r.ID,
+		Hello:    &hello,
+		Members:  members,
+		Genesis:  r.Genesis,
 	}
 	_, err = dataConn.WriteStruct(req)
 	if err != nil {
-		return nil, err
+		return nil, InviteArgs{}, Protocol{}, err
 	}
 
 	dataConn.Flush()
@@ -136,47 +228,123 @@ func (r *Room) createPeerViaContactID(contactIdentity Identity) (*MessagingPeer,
 	resp := &ContactResponse{}
 	err = dataConn.ReadStruct(resp)
 	if err != nil {
-		return nil, err
+		return nil, InviteArgs{}, Protocol{}, err
 	}
 
 	if ok, _ := contactIdentity.Verify(append([]byte(resp.ConvFP), r.ID[:]...), resp.Sig); !ok {
-		return nil, fmt.Errorf("invalid signature from contactIdentity %s", contactIdentity.URL())
+		return nil, InviteArgs{}, Protocol{}, fmt.Errorf("invalid signature from contactIdentity %s", contactIdentity.URL())
 	}
 
 	switch ok, err := contactIdentity.Verify(append([]byte(resp.ConvFP), r.ID[:]...), resp.Sig); {
 	case err != nil:
-		return nil, err
+		return nil, InviteArgs{}, Protocol{}, err
 	case !ok:
-		return nil, fmt.Errorf("invalid signature from contactIdentity %s", contactIdentity.URL())
+		return nil, InviteArgs{}, Protocol{}, fmt.Errorf("invalid signature from contactIdentity %s", contactIdentity.URL())
 	}
 
 	peerID, err := NewIdentity(Remote, resp.ConvFP)
 	if err != nil {
-		return nil, err
+		return nil, InviteArgs{}, Protocol{}, err
 	}
 
+	proto := Negotiate(hello, resp.Hello)
+
 	lf := log.Fields{
 		"contact-url":     contactIdentity.URL(),
 		"conversation-id": resp.ConvFP,
 		"peer":            peerID,
 		"room":            r.ID.String(),
+		"features":        proto.Features,
 	}
 	log.WithFields(lf).Debug("contact validated and turned into a peer")
 
+	invite := InviteArgs{
+		Fingerprint: resp.ConvFP,
+		Contact:     contactIdentity.Fingerprint(),
+		ContactSig:  resp.Sig,
+	}
+
 	peer := NewMessagingPeer(peerID)
-	return peer, nil
+	return peer, invite, proto, nil
 }
 
 func (r *Room) SendMessageToAllPeers(content MessageContent) {
-	msg := NewMessage(content, r.Self)
+	r.msgUpdateMutex.Lock()
+	r.sendMessage(content)
+	r.msgUpdateMutex.Unlock()
 
-	r.PushMessages(msg)
+	r.bumpQueues()
+}
 
-	for _, peer := range r.Peers {
+// sendMessage creates a message from Self with content, which is sent by the queues of the peers.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) sendMessage(content MessageContent) {
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+
+	//Membership commands carry their parents in both formats
+	if content.Type == ContentTypeCmd {
+		if _, ok := membershipCommands[commandName(content.Data)]; ok {
+			content.Data = r.withParents(content.Data)
+		}
+	}
+
+	//Commands are sent in the old format until every peer understands the structured one
+	if content.Type == ContentTypeCmd && r.peersSupport(FeatureCommandPayload) {
+		if _, ok := stateCommands[commandName(content.Data)]; ok {
+			content.Data = r.withClock(content.Data)
+		}
+	} else if content.Type == ContentTypeCmd {
+		data, err := legacyCommandData(content.Data)
+		if err != nil {
+			log.WithError(err).WithField("room", r.ID.String()).Warn("unable to convert command")
+			return
+		}
+		content.Data = data
+	}
+
+	//The key is only rotated once it's needed, so that a series of invitations causes a single rotation
+	if content.isEncryptable() && content.Key == "" && r.peersSupport(FeatureRoomKey) && r.needsKey() {
+		err := r.rotateKey()
+		if err != nil {
+			log.WithError(err).WithField("room", r.ID.String()).Warn("unable to rotate room key")
+			return
+		}
+	}
+
+	err := r.encryptContent(&content)
+	if err != nil {
+		log.WithError(err).WithField("room", r.ID.String()).Warn("unable to encrypt message")
+		return
+	}
+
+	var msg Message
+	if r.peersSupport(FeatureCanonicalSig) {
+		msg = NewRoomMessage(content, r.Self, r.nextSeq(), r.ID)
+	} else {
+		msg = NewMessage(content, r.Self, r.nextSeq())
+	}
+	r.pushMessages(msg)
+}
+
+// bumpQueues makes the queues of all peers sync right away
+func (r *Room) bumpQueues() {
+	for _, peer := range r.peersCopy() {
 		peer.BumpQueue()
 	}
 }
 
+// peersCopy returns a copy of the Peers, which can be used without holding msgUpdateMutex
+func (r *Room) peersCopy() []*MessagingPeer {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	peers := make([]*MessagingPeer, len(r.Peers))
+	copy(peers, r.Peers)
+	return peers
+}
+
 func (r *Room) RunMessageQueueForAllPeers() {
 	for _, peer := range r.Peers {
 		go peer.RunMessageQueue(r.Ctx, r)
@@ -199,61 +367,497 @@ func (r *Room) StopQueues() {
 	r.stop()
 }
 
+// PushMessages adds all messages that aren't already known to the Room.
+// Messages are identified by their ID, so neither their timestamps nor
+// the order in which they are received matter.
+// Messages whose sender isn't a member of the Room at their position are
+// left out and reported with a *RejectedError, all others are still added.
+// The same applies to messages that their sender may not send, see checkPermission.
 func (r *Room) PushMessages(msgs ...Message) error {
-	newSyncState := CopySyncMap(r.SyncState)
+	_, err := r.AddMessages(msgs...)
+	return err
+}
 
+// AddMessages is PushMessages, but also returns the messages that were added to the Room,
+// without those that were already known or rejected.
+func (r *Room) AddMessages(msgs ...Message) ([]Message, error) {
 	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	added, rejected := r.pushMessages(msgs...)
+	if len(rejected) > 0 {
+		return added, &RejectedError{Room: r.ID, Messages: rejected}
+	}
+
+	return added, nil
+}
+
+// pushMessages has to be called with msgUpdateMutex held.
+// It returns the messages that were added, and the IDs of all messages that were rejected because of their sender.
+// The membership log is replayed once for all membership events in msgs,
+// after which the messages of peers that were only invited by them are checked again.
+func (r *Room) pushMessages(msgs ...Message) ([]Message, []string) {
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+
+	var (
+		added   []Message
+		events  []Message
+		removed []string
+		pending = msgs
+	)
+
+	for {
+		accepted, rejected := r.applyMessages(pending)
+		added = append(added, accepted...)
+
+		var newEvents []Message
+		for _, msg := range accepted {
+			if msg.isMembershipEvent() {
+				newEvents = append(newEvents, msg)
+			}
+		}
+		if len(newEvents) == 0 {
+			pending = rejected
+			break
+		}
+		events = append(events, newEvents...)
+
+		removed = append(removed, r.rebuildRoster()...)
+
+		pending = rejected
+		if len(pending) == 0 {
+			break
+		}
+	}
+
+	//Removed peers must not be able to read any new messages,
+	//so the key is sealed for the members that remain after all messages were applied
+	if len(removed) > 0 && r.rotatesKeyAfter(events) && r.peersSupport(FeatureRoomKey) {
+		err := r.rotateKey()
+		if err != nil {
+			log.WithError(err).WithField("room", r.ID.String()).Warn("unable to rotate room key")
+		}
+	}
+
+	rejected := make([]string, len(pending))
+	for i, msg := range pending {
+		rejected[i] = msg.ID
+	}
+
+	return added, rejected
+}
+
+// applyMessages adds the new messages in msgs to the Room, if their senders were allowed to send them.
+// It returns the messages that were added, and those that were rejected because of their sender.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) applyMessages(msgs []Message) ([]Message, []Message) {
+	var added, rejected []Message
+
+	for i := range msgs {
+		//IDs of messages from older versions are filled in place,
+		//so that the caller can refer to them as well
+		if msgs[i].ID == "" {
+			msgs[i].ID = msgs[i].calculateID()
+		}
+		msg := msgs[i]
+
+		if _, known := r.msgIDs[msg.ID]; known {
+			r.restoreExtension(msg)
+			continue
+		}
+
+		if r.receiptCompacted(msg) {
+			continue
+		}
 
-	//Usually all messages that reach this point should be new to us,
-	//the if-statement is more of a failsafe
-	for _, msg := range msgs {
-		if last, ok := r.SyncState[msg.Meta.Sender]; !ok || msg.Meta.Time.After(last) {
-			newSyncState[msg.Meta.Sender] = msg.Meta.Time
-
-			if msg.Content.Type == ContentTypeCmd {
-				err := HandleCommand(&msg, r)
-				if err != nil {
-					log.WithError(err).Warn()
-				}
+		if !msg.BelongsTo(r.ID) {
+			log.WithField("room", r.ID.String()).Debugf("ignoring message %s from another room", msg.ID)
+			continue
+		}
+
+		if msg.isMembershipEvent() {
+			//Membership events are checked when the log is replayed in causal order,
+			//since concurrent events may arrive in a different order on every peer
+			if !r.inMembershipLog(msg.Meta.Sender) {
+				log.WithField("room", r.ID.String()).Debugf("rejecting message %s from %s, who is not a member", msg.ID, msg.Meta.Sender)
+				rejected = append(rejected, msg)
+				continue
+			}
+		} else {
+			//Other messages are checked against the role their sender had when creating them,
+			//so that messages of former members are accepted as well
+			role, member := r.roleAt(msg)
+			if !member {
+				log.WithField("room", r.ID.String()).Debugf("rejecting message %s from %s, who is not a member", msg.ID, msg.Meta.Sender)
+				rejected = append(rejected, msg)
+				continue
 			}
 
-			lf := log.Fields{
-				"room":    r.ID.String(),
-				"message": string(msg.Content.Data),
+			if err := r.checkPermission(msg.Meta.Sender, role, msg.Content); err != nil {
+				log.WithError(err).WithField("room", r.ID.String()).Debugf("rejecting message %s", msg.ID)
+				rejected = append(rejected, msg)
+				continue
+			}
+		}
+
+		if r.reusesBlob(msg) {
+			log.WithField("room", r.ID.String()).Debugf("rejecting message %s, whose blob belongs to another message", msg.ID)
+			rejected = append(rejected, msg)
+			continue
+		}
+
+		if r.dropIfDeleted(msg) {
+			continue
+		}
+
+		if msg.Content.Type == ContentTypeCmd {
+			err := HandleCommand(&msg, r)
+			if err != nil {
+				log.WithError(err).Warn()
 			}
-			log.WithFields(lf).Debug("new message")
-			r.Messages = append(r.Messages, msg)
+		}
+
+		lf := log.Fields{
+			"room":    r.ID.String(),
+			"message": string(msg.Content.Data),
+		}
+		log.WithFields(lf).Debug("new message")
+		r.Messages = append(r.Messages, msg)
+		r.trackMessage(msg)
+		added = append(added, msg)
+
+		if msg.Content.Type == ContentTypeDelete {
+			r.applyDelete(msg)
 		}
 	}
 
-	r.SyncState = newSyncState
+	return added, rejected
+}
 
-	r.msgUpdateMutex.Unlock()
+// nextSeq returns the sequence number for the next message sent by Self,
+// it has to be called with msgUpdateMutex held
+func (r *Room) nextSeq() uint64 {
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
 
-	return nil
+	return r.SyncState[r.Self.Fingerprint()] + 1
+}
+
+// restoreExtension replaces the stored copy of msg, if it was relayed by an older daemon,
+// which dropped the fields it doesn't know, see Message.ExtSig.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) restoreExtension(msg Message) {
+	if msg.ExtSig == nil {
+		return
+	}
+
+	for i := len(r.Messages) - 1; i >= 0; i-- {
+		if r.Messages[i].ID != msg.ID {
+			continue
+		}
+
+		if r.Messages[i].ExtSig == nil {
+			r.verifyRestoredBlob(r.Messages[i], msg)
+			r.Messages[i] = msg
+			r.trackSeq(msg.Meta.Sender, msg.Meta.Seq)
+		}
+		return
+	}
+}
+
+// KnowsBlob returns true if a message in the Room references the blob id, or content with the hash.
+// Only such blobs may be reported as present to a peer, which must not learn about the content of other rooms.
+func (r *Room) KnowsBlob(id uuid.UUID, hash []byte) bool {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+
+	if _, found := r.blobIDs[id]; found {
+		return true
+	}
+
+	_, found := r.blobHashes[string(hash)]
+	return hash != nil && found
+}
+
+// reusesBlob returns true if msg from a peer references a blob id that another message already references,
+// in this Room or any other, since the reference is removed together with either of them.
+// The blobs of messages from Self are referenced before they are sent.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) reusesBlob(msg Message) bool {
+	if !msg.ContainsBlob() || r.isSelf(msg.Meta.Sender) {
+		return false
+	}
+
+	if _, found := r.blobIDs[msg.Content.Blob.ID]; found {
+		return true
+	}
+
+	return blobmngr.IsReferenced(msg.Content.Blob.ID)
+}
+
+// verifyRestoredBlob checks the blob that was received for the stored copy of msg against the hash that msg restores.
+// Since the copy without the hash was accepted without verifying its blob,
+// a relay could have sent any content for it, which is removed if it doesn't match.
+func (r *Room) verifyRestoredBlob(stored, msg Message) {
+	if !msg.ContainsBlob() || msg.Content.Blob.Hash == nil || !stored.ContainsBlob() || stored.Content.Blob.Hash != nil {
+		return
+	}
+
+	id := msg.Content.Blob.ID
+	actual, err := blobmngr.HashFromID(id)
+	if err != nil || bytes.Equal(actual, msg.Content.Blob.Hash) {
+		return
+	}
+
+	log.WithField("message", msg.ID).Warnf("blob %s doesn't match the restored hash, removing it", id)
+	err = blobmngr.RemoveBlob(id)
+	if err != nil {
+		log.WithError(err).Debug("unable to remove blob of restored message")
+	}
+}
+
+// trackMessage records msg in the message index, the SyncState
+// and all other state of the Room that is derived from its messages
+func (r *Room) trackMessage(msg Message) {
+	r.msgIDs[msg.ID] = struct{}{}
+	r.trackSeq(msg.Meta.Sender, msg.Meta.Seq)
+	if msg.ContainsBlob() {
+		r.blobIDs[msg.Content.Blob.ID] = struct{}{}
+		if msg.Content.Blob.Hash != nil {
+			r.blobHashes[string(msg.Content.Blob.Hash)] = struct{}{}
+		}
+	}
+
+	switch msg.Content.Type {
+	case ContentTypeDelivered, ContentTypeRead:
+		r.applyReceipt(msg)
+	case ContentTypeEdit:
+		r.edits[msg.Content.Target] = append(r.edits[msg.Content.Target], msg)
+	case ContentTypeReaction, ContentTypeReactionRemove:
+		r.applyReaction(msg)
+	case ContentTypeDelete:
+		if _, deleted := r.Deleted[msg.Content.Target]; !deleted {
+			r.pendingDeletes[msg.Content.Target] = append(r.pendingDeletes[msg.Content.Target], msg)
+		}
+	case ContentTypeCmd:
+		if msg.isRoomKey() {
+			r.applyRoomKey(msg)
+		} else if msg.isRatchetAnnouncement() {
+			r.ratchetPeers[msg.Meta.Sender] = struct{}{}
+		} else if msg.isMembershipEvent() {
+			r.memberLog.add(msg)
+			if r.isSelf(msg.Meta.Sender) && commandName(msg.Content.Data) == RoomCommandLeave {
+				r.leaveSeq = msg.Meta.Seq
+			}
+		} else if msg.isStateCommand() {
+			r.applyStateCommand(msg)
+		}
+	}
+}
+
+func (r *Room) rebuildMessageIndex() {
+	r.msgIDs = make(map[string]struct{})
+	r.blobIDs = make(map[uuid.UUID]struct{})
+	r.blobHashes = make(map[string]struct{})
+	r.SyncState = make(SyncMap)
+	r.seqsAhead = make(map[string]map[uint64]struct{})
+	r.receipts = make(map[string]map[string]Receipt)
+	r.edits = make(map[string][]Message)
+	r.reactions = make(map[string]map[string]map[string]Message)
+	r.pendingDeletes = make(map[string][]Message)
+	r.pendingReacts = make(map[string][]Message)
+	r.keys = make(map[string]*roomKey)
+	r.ratchetPeers = make(map[string]struct{})
+	r.memberLog = newMembershipLog(r.ID)
+	r.bans = newBanList(r.ID)
+	r.roleHistory = nil
+	r.state = make(map[string]stateRegister)
+	r.stateClock = 0
+	r.pendingState = nil
+	r.leaveSeq = 0
+
+	//All messages up to a compacted receipt were known when it was compacted
+	for sender, seq := range r.CompactedSeqs {
+		r.SyncState[sender] = seq
+	}
+	for sender, ranges := range r.Skipped {
+		for _, sr := range ranges {
+			r.trackSkipped(sender, sr)
+		}
+	}
+	for id, receipts := range r.CompactedReceipts {
+		for sender, receipt := range receipts {
+			addReceipt(r.receipts, id, sender, receipt)
+		}
+	}
+
+	for id, t := range r.Deleted {
+		r.trackTombstone(id, t)
+	}
+
+	for i := range r.Messages {
+		if r.Messages[i].ID == "" {
+			r.Messages[i].ID = r.Messages[i].calculateID()
+		}
+		r.trackMessage(r.Messages[i])
+	}
+
+	r.rebuildRoster()
+}
+
+// RebuildState restores all state of the Room that is derived from its messages,
+// e.g. after loading it from a file written by an older version.
+func (r *Room) RebuildState() {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	r.rebuildMessageIndex()
+}
+
+// trackSeq advances the SyncState of sender, up to which all messages of sender are known.
+// Sequence numbers after a gap are remembered until the gap is filled,
+// so that the missing messages are synced again until they arrive.
+func (r *Room) trackSeq(sender string, seq uint64) {
+	last, ok := r.SyncState[sender]
+	if !ok {
+		r.SyncState[sender] = 0
+	}
+	if seq <= last {
+		return
+	}
+
+	ahead := r.seqsAhead[sender]
+	if ahead == nil {
+		ahead = make(map[uint64]struct{})
+		r.seqsAhead[sender] = ahead
+	}
+	ahead[seq] = struct{}{}
+
+	for {
+		if _, ok := ahead[last+1]; !ok {
+			break
+		}
+		delete(ahead, last+1)
+		last++
+	}
+	r.SyncState[sender] = last
+}
+
+// SyncStateCopy returns a copy of the SyncState, which may be used while messages are added
+func (r *Room) SyncStateCopy() SyncMap {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+
+	return CopySyncMap(r.SyncState)
 }
 
 func (r *Room) isSelf(fingerprint string) bool {
 	return fingerprint == r.Self.Fingerprint()
 }
 
+// SetPeerProtocol records the Protocol negotiated with the peer,
+// which determines e.g. the format in which new messages are signed.
+func (r *Room) SetPeerProtocol(fingerprint string, proto Protocol) {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	for _, peer := range r.Peers {
+		if peer.RIdentity.Fingerprint() == fingerprint {
+			peer.Protocol = &proto
+		}
+	}
+}
+
+// peerSupported returns true if the Protocol negotiated with the peer the last time supported the feature
+func (r *Room) peerSupported(fingerprint, feature string) bool {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	for _, peer := range r.Peers {
+		if peer.RIdentity.Fingerprint() == fingerprint {
+			return peer.Protocol != nil && peer.Protocol.Supports(feature)
+		}
+	}
+
+	return false
+}
+
+// peersSupport returns true if all peers are known to support the protocol feature,
+// e.g. to verify messages signed in the canonical format.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) peersSupport(feature string) bool {
+	if len(r.Peers) == 0 {
+		return false
+	}
+
+	for _, peer := range r.Peers {
+		if peer.Protocol == nil || !peer.Protocol.Supports(feature) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RejectedError lists the messages that were rejected by a Room,
+// because their senders weren't members of it or lacked the permission to send them
+type RejectedError struct {
+	Room     uuid.UUID
+	Messages []string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("rejected %d message(s) in room %s from senders that aren't members or lack permission: %s", len(e.Messages), e.Room, strings.Join(e.Messages, ", "))
+}
+
+func (r *Room) isMember(fingerprint string) bool {
+	_, found := r.PeerByFingerprint(fingerprint)
+	return found || r.isSelf(fingerprint)
+}
+
+func (r *Room) isAdmin(fingerprint string) bool {
+	if r.isSelf(fingerprint) {
+		return r.Self.Admin()
+	}
+
+	peer, found := r.PeerByFingerprint(fingerprint)
+	return found && peer.Admin()
+}
+
 // Info returns a struct with useful information about this Room
 func (r *Room) Info() *RoomInfo {
 	info := &RoomInfo{
-		Self:   r.Self.Fingerprint(),
-		ID:     r.ID,
-		Name:   r.Name,
-		Nicks:  map[string]string{},
-		Admins: map[string]bool{},
+		Self:    r.Self.Fingerprint(),
+		ID:      r.ID,
+		Name:    r.Name,
+		Topic:   r.Topic,
+		Nicks:   map[string]string{},
+		Admins:  map[string]bool{},
+		Roles:   map[string]Role{},
+		Banned:  r.bannedPeers(),
+		Leaving: r.Leaving,
 	}
 
 	info.Nicks[r.Self.Fingerprint()] = r.Self.Meta.Nick
-	info.Admins[r.Self.Fingerprint()] = r.Self.Meta.Admin
+	info.Admins[r.Self.Fingerprint()] = r.Self.Admin()
+	info.Roles[r.Self.Fingerprint()] = r.Self.Role()
 
 	for _, peer := range r.Peers {
 		info.Peers = append(info.Peers, peer.RIdentity.Fingerprint())
 		info.Nicks[peer.RIdentity.Fingerprint()] = peer.RIdentity.Meta.Nick
-		info.Admins[peer.RIdentity.Fingerprint()] = peer.RIdentity.Meta.Admin
+		info.Admins[peer.RIdentity.Fingerprint()] = peer.RIdentity.Admin()
+		info.Roles[peer.RIdentity.Fingerprint()] = peer.RIdentity.Role()
 	}
 
 	return info
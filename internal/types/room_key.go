@@ -0,0 +1,474 @@
+package types
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/craumix/onionmsg/pkg/blobmngr"
+	"github.com/craumix/onionmsg/pkg/seal"
+	"github.com/google/uuid"
+)
+
+const (
+	roomKeySize = 32
+	nonceSize   = 24
+)
+
+// roomKey is a symmetric key that is shared by all members of a Room,
+// and used to encrypt the content of messages and blobs.
+// This protects the content from peers that relay it, but not from anyone who can read the data file,
+// since the keys in OwnKeys and the identity of Self, which opens the copies of the other members, are stored in it as well.
+type roomKey struct {
+	key [roomKeySize]byte
+	id  string
+	//recipients are the fingerprints of all members that received the key, including its sender
+	recipients map[string]struct{}
+	//order is the position in which the key was received, since the time of a message is chosen by its sender
+	order int
+}
+
+// RotateKey creates a new room key, and distributes it to all current peers.
+// Every copy of the key is sealed for the identity of its recipient,
+// so that only members of the Room at this point can read messages encrypted with it.
+// Self keeps the key in OwnKeys, which is stored unencrypted, see roomKey.
+func (r *Room) RotateKey() error {
+	r.msgUpdateMutex.Lock()
+	err := r.rotateKey()
+	r.msgUpdateMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	r.bumpQueues()
+	return nil
+}
+
+// rotateKey is RotateKey for callers that hold msgUpdateMutex,
+// so that the recipients are exactly the peers at this point
+func (r *Room) rotateKey() error {
+	key := make([]byte, roomKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+
+	sealed := make(map[string][]byte)
+	for _, peer := range r.Peers {
+		sealed[peer.RIdentity.Fingerprint()], err = seal.SealFor(*peer.RIdentity.Pub, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	id := keyID(key)
+	if r.OwnKeys == nil {
+		r.OwnKeys = make(map[string][]byte)
+	}
+	r.OwnKeys[id] = key
+
+	content, err := NewCommandContent(RoomCommandRoomKey, &RoomKeyArgs{
+		ID:   id,
+		Keys: sealed,
+	})
+	if err != nil {
+		return err
+	}
+
+	r.sendMessage(content)
+
+	log.WithField("room", r.ID.String()).Debug("rotated room key")
+
+	return nil
+}
+
+// HasKey returns true if a room key is known, with which new messages are encrypted for all current members
+func (r *Room) HasKey() bool {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+
+	return !r.needsKey()
+}
+
+// currentKey returns the key new messages are encrypted with,
+// which is the last received key that is known to nobody but the current members.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) currentKey() *roomKey {
+	var current *roomKey
+	for _, key := range r.keys {
+		if (current == nil || key.order > current.order) && r.onlyMembersKnow(key) {
+			current = key
+		}
+	}
+
+	return current
+}
+
+// needsKey returns true if Self has to rotate the key before encrypting new messages,
+// because there is none or peers joined that don't know it.
+// Members that may not distribute keys keep using the current one, until someone else rotates it.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) needsKey() bool {
+	if !r.Self.Role().AtLeast(RequiredRole(RoomCommandRoomKey)) {
+		return false
+	}
+
+	key := r.currentKey()
+	return key == nil || len(key.recipients) != len(r.Peers)+1
+}
+
+func (r *Room) onlyMembersKnow(key *roomKey) bool {
+	members := map[string]struct{}{r.Self.Fingerprint(): {}}
+	for _, peer := range r.Peers {
+		members[peer.RIdentity.Fingerprint()] = struct{}{}
+	}
+
+	for fingerprint := range key.recipients {
+		if _, ok := members[fingerprint]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// applyRoomKey records the room key distributed by msg, if it was sealed for Self or created by Self.
+// All keys are kept to decrypt existing messages, see currentKey for the one used for new messages.
+func (r *Room) applyRoomKey(msg Message) {
+	args := &RoomKeyArgs{}
+	err := parseCommandArgs(&msg, RoomCommandRoomKey, args)
+	if err != nil {
+		return
+	}
+
+	//A key can only be distributed once, members that know it can't change its recipients by sending it again
+	if _, known := r.keys[args.ID]; known {
+		return
+	}
+
+	key, err := r.openRoomKey(msg.Meta.Sender, args)
+	if err != nil {
+		log.WithError(err).WithField("room", r.ID.String()).Debug("unable to open room key")
+		return
+	} else if keyID(key[:]) != args.ID {
+		log.WithField("room", r.ID.String()).Debugf("room key doesn't match its id %s", args.ID)
+		return
+	}
+
+	rk := &roomKey{
+		key:        *key,
+		id:         args.ID,
+		recipients: map[string]struct{}{msg.Meta.Sender: {}},
+		order:      len(r.keys),
+	}
+	for fingerprint := range args.Keys {
+		rk.recipients[fingerprint] = struct{}{}
+	}
+	r.keys[rk.id] = rk
+
+	//Reactions may arrive before the key they were encrypted with
+	for _, reaction := range r.pendingReacts[rk.id] {
+		r.applyReaction(reaction)
+	}
+	delete(r.pendingReacts, rk.id)
+}
+
+func (r *Room) openRoomKey(sender string, args *RoomKeyArgs) (*[roomKeySize]byte, error) {
+	var opened []byte
+	if own, ok := r.OwnKeys[args.ID]; ok && r.isSelf(sender) {
+		opened = own
+	} else if sealed, ok := args.Keys[r.Self.Fingerprint()]; ok {
+		//Keys created by Self used to be sealed for Self as well
+		var err error
+		opened, err = seal.Open(*r.Self.Priv, sealed)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("room key was not sealed for self")
+	}
+
+	if len(opened) != roomKeySize {
+		return nil, fmt.Errorf("invalid length for room key, %d instead of %d", len(opened), roomKeySize)
+	}
+
+	key := new([roomKeySize]byte)
+	copy(key[:], opened)
+
+	return key, nil
+}
+
+// encryptContent encrypts the data of content with the current room key.
+// Only the data written by users is encrypted, since the other content types
+// have to be evaluated by every member to keep the state of the Room consistent.
+// Content stays in plaintext until every peer supports FeatureRoomKey, since older versions couldn't show it.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) encryptContent(content *MessageContent) error {
+	if !content.isEncryptable() || (content.Key == "" && !r.peersSupport(FeatureRoomKey)) {
+		return nil
+	}
+
+	key := r.currentKey()
+	if content.Key != "" {
+		//The blob of the content is already encrypted with this key
+		key = r.keys[content.Key]
+	}
+
+	if key == nil {
+		if content.Key != "" {
+			return fmt.Errorf("unknown room key %s", content.Key)
+		}
+		//Rooms created by older versions don't have a key until it's rotated for the first time
+		return nil
+	}
+
+	var err error
+	content.Data, err = key.seal(content.Data)
+	if err != nil {
+		return err
+	}
+
+	//The reference is copied, so that the excerpt of the caller isn't replaced
+	if content.Reply != nil {
+		reply := *content.Reply
+		reply.Excerpt, err = key.seal(reply.Excerpt)
+		if err != nil {
+			return err
+		}
+		content.Reply = &reply
+	}
+	content.Key = key.id
+
+	return nil
+}
+
+// decryptContent replaces the data of content with its plaintext.
+// If the room key is unknown, the data is removed and the id of the key is kept,
+// so that frontends can tell that the content can't be shown.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) decryptContent(content *MessageContent) {
+	if content.ReplyTo != nil {
+		replyTo := *content.ReplyTo
+		r.decryptContent(&replyTo.Content)
+		content.ReplyTo = &replyTo
+	}
+
+	if content.Key == "" {
+		return
+	}
+
+	key, ok := r.keys[content.Key]
+	if !ok {
+		content.Data = nil
+		if content.Reply != nil {
+			content.Reply = &ReplyRef{ID: content.Reply.ID}
+		}
+		return
+	}
+
+	if content.Reply != nil {
+		reply := *content.Reply
+		reply.Excerpt, ok = key.open(reply.Excerpt)
+		if !ok {
+			log.WithField("room", r.ID.String()).Debug("unable to decrypt reply excerpt")
+		}
+		content.Reply = &reply
+	}
+
+	content.Data, ok = key.open(content.Data)
+	if !ok {
+		log.WithField("room", r.ID.String()).Debug("unable to decrypt message content")
+		return
+	}
+	content.Key = ""
+}
+
+// seal encrypts data with a random nonce, which is prepended to the result.
+// Empty data is left as it is.
+func (k *roomKey) seal(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	var nonce [nonceSize]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return secretbox.Seal(nonce[:], data, &nonce, &k.key), nil
+}
+
+// open decrypts data that was encrypted with seal.
+// If that fails, nil and false are returned.
+func (k *roomKey) open(data []byte) ([]byte, bool) {
+	if len(data) == 0 {
+		return data, true
+	}
+
+	if len(data) < nonceSize {
+		return nil, false
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], data)
+
+	return secretbox.Open(nil, data[nonceSize:], &nonce, &k.key)
+}
+
+// DecryptedMessages returns copies of msgs with their content decrypted,
+// which should only be done when they are handed to the frontend.
+func (r *Room) DecryptedMessages(msgs ...Message) []Message {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	decrypted := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		r.decryptContent(&msg.Content)
+		decrypted[i] = msg
+	}
+
+	return decrypted
+}
+
+// EncryptBlob encrypts the blob of meta with the current room key and returns the id of the key.
+// Since the blob is stored content-addressed, the encrypted copy gets a new id, which is written to meta.
+// The stream depends on that id, so in rooms with a room key the same file sent twice
+// is stored twice, instead of being deduplicated like the blobs of other rooms.
+// If peers joined since the key was rotated the last time, it is rotated first,
+// and if no room key is known or a peer doesn't support FeatureRoomKey,
+// the blob is left unencrypted and an empty id is returned.
+func (r *Room) EncryptBlob(meta *BlobMeta) (string, error) {
+	r.msgUpdateMutex.Lock()
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+	if !r.peersSupport(FeatureRoomKey) {
+		r.msgUpdateMutex.Unlock()
+		return "", nil
+	}
+	if r.needsKey() {
+		err := r.rotateKey()
+		if err != nil {
+			r.msgUpdateMutex.Unlock()
+			return "", err
+		}
+	}
+	key := r.currentKey()
+	r.msgUpdateMutex.Unlock()
+
+	if key == nil {
+		return "", nil
+	}
+
+	id, err := blobmngr.MakeBlob()
+	if err != nil {
+		return "", err
+	}
+
+	err = encryptBlobInto(key, meta.ID, id)
+	if err != nil {
+		if rmErr := blobmngr.RemoveBlob(id); rmErr != nil {
+			log.WithError(rmErr).Debug("unable to remove incomplete encrypted blob")
+		}
+		return "", err
+	}
+
+	err = blobmngr.RemoveBlob(meta.ID)
+	if err != nil {
+		log.WithError(err).Debug("unable to remove unencrypted blob")
+	}
+
+	meta.ID = id
+	return key.id, nil
+}
+
+// encryptBlobInto writes the blob with the id plain into the blob with the id encrypted, encrypted with key
+func encryptBlobInto(key *roomKey, plain, encrypted uuid.UUID) error {
+	stream, err := blobStream(key, encrypted)
+	if err != nil {
+		return err
+	}
+
+	from, err := blobmngr.FileFromID(plain)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := blobmngr.FileFromID(encrypted)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+
+	_, err = io.Copy(cipher.StreamWriter{S: stream, W: to}, from)
+	return err
+}
+
+// BlobStream returns the stream that decrypts the blob with the specified id.
+// found is false if no message in the Room references the blob,
+// and the stream is nil if the blob isn't encrypted.
+func (r *Room) BlobStream(id uuid.UUID) (stream cipher.Stream, found bool, err error) {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	for _, msg := range r.Messages {
+		if !msg.ContainsBlob() || msg.Content.Blob.ID != id {
+			continue
+		}
+
+		if msg.Content.Key == "" {
+			return nil, true, nil
+		}
+
+		key, ok := r.keys[msg.Content.Key]
+		if !ok {
+			return nil, true, fmt.Errorf("unknown room key %s for blob %s", msg.Content.Key, id)
+		}
+
+		stream, err = blobStream(key, id)
+		return stream, true, err
+	}
+
+	return nil, false, nil
+}
+
+// blobStream derives a separate key for every blob, so that the stream cipher can be used without a nonce.
+// The ciphertext isn't authenticated by the cipher, but by the hash in the signed BlobMeta.
+func blobStream(key *roomKey, id uuid.UUID) (cipher.Stream, error) {
+	mac := hmac.New(sha256.New, key.key[:])
+	mac.Write([]byte("blob"))
+	mac.Write(id[:])
+
+	return chacha20.NewUnauthenticatedCipher(mac.Sum(nil), make([]byte, chacha20.NonceSize))
+}
+
+// isEncryptable returns true for the content types whose data is written by users.
+// The emoji of reactions is encrypted as well, the reactions are decrypted once they are applied, see reactionEmoji.
+func (c *MessageContent) isEncryptable() bool {
+	switch c.Type {
+	case ContentTypeText, ContentTypeFile, ContentTypeSticker, ContentTypeEdit, ContentTypeReaction, ContentTypeReactionRemove:
+		return true
+	default:
+		return false
+	}
+}
+
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,213 @@
+package types
+
+import (
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	stateKeyName  = "name"
+	stateKeyTopic = "topic"
+	stateKeyNick  = "nick:"
+)
+
+var (
+	//stateCommands set a value of the room state, of which the last write wins.
+	//Roles and admin flags are part of the membership log instead, see rebuildRoster.
+	stateCommands = map[Command]struct{}{
+		RoomCommandNameRoom: {},
+		RoomCommandTopic:    {},
+		RoomCommandNick:     {},
+	}
+)
+
+// stateRegister is a last-writer-wins register for a single value of the room state.
+// Writes are ordered by the lamport clock of the command, then by time, sender and id,
+// so that every peer keeps the same value, regardless of the order in which they arrived.
+type stateRegister struct {
+	value  string
+	clock  uint64
+	time   time.Time
+	sender string
+	id     string
+}
+
+// before returns true if reg was written before other
+func (reg stateRegister) before(other stateRegister) bool {
+	switch {
+	case reg.clock != other.clock:
+		return reg.clock < other.clock
+	case !reg.time.Equal(other.time):
+		return reg.time.Before(other.time)
+	case reg.sender != other.sender:
+		return reg.sender < other.sender
+	default:
+		return reg.id < other.id
+	}
+}
+
+func (m *Message) isStateCommand() bool {
+	isCmd, cmd := m.isCommand()
+	if !isCmd {
+		return false
+	}
+
+	_, ok := stateCommands[Command(cmd)]
+	return ok
+}
+
+// withClock sets the lamport clock of the structured state command in data,
+// so that it is ordered after every state command that is already known.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) withClock(data []byte) []byte {
+	return updatePayload(data, func(payload *CommandPayload) {
+		payload.Clock = r.nextClock()
+	})
+}
+
+// nextClock returns the lamport clock that follows every state command that is already known
+func (r *Room) nextClock() uint64 {
+	if r.stateClock == math.MaxUint64 {
+		return r.stateClock
+	}
+
+	return r.stateClock + 1
+}
+
+// applyStateCommand writes the value set by msg to its register, if it is newer than the current one.
+// Since the clock of a command only follows the state commands known to its sender,
+// a command whose clock is ahead of the known ones waits until those arrived.
+// Otherwise a single command with a huge clock would win against every later write.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) applyStateCommand(msg Message) {
+	if commandClock(msg) > r.nextClock() {
+		r.pendingState = append(r.pendingState, msg)
+		return
+	}
+
+	if !r.writeState(msg) {
+		return
+	}
+
+	//The clock advanced, so some of the waiting commands may follow the known ones now
+	for i := 0; i < len(r.pendingState); i++ {
+		pending := r.pendingState[i]
+		if commandClock(pending) > r.nextClock() {
+			continue
+		}
+
+		r.pendingState = append(r.pendingState[:i], r.pendingState[i+1:]...)
+		r.writeState(pending)
+		i = -1
+	}
+}
+
+// writeState writes the value set by msg to its register and adopts its clock,
+// it returns false if the sender of msg wasn't allowed to run it.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) writeState(msg Message) bool {
+	key, value, err := stateValue(msg)
+	if err != nil {
+		log.WithError(err).WithField("room", r.ID.String()).Debugf("ignoring state command %s", msg.ID)
+		return false
+	}
+
+	reg := stateRegister{
+		value:  value,
+		clock:  commandClock(msg),
+		time:   msg.Meta.Time,
+		sender: msg.Meta.Sender,
+		id:     msg.ID,
+	}
+
+	//Only commands that their sender was allowed to run at their position are written,
+	//which doesn't depend on the order in which the membership events arrived
+	role, member := r.roleAt(msg)
+	if !member || r.checkPermission(msg.Meta.Sender, role, msg.Content) != nil {
+		log.WithField("room", r.ID.String()).Debugf("ignoring state command %s, which its sender wasn't allowed to run", msg.ID)
+		return false
+	}
+
+	if reg.clock > r.stateClock {
+		r.stateClock = reg.clock
+	}
+
+	if current, ok := r.state[key]; ok && !current.before(reg) {
+		return true
+	}
+	r.state[key] = reg
+
+	switch key {
+	case stateKeyName:
+		r.Name = value
+	case stateKeyTopic:
+		r.Topic = value
+	default:
+		if member, found := r.memberByFingerprint(msg.Meta.Sender); found && member.Meta != nil {
+			member.Meta.Nick = value
+		}
+	}
+
+	return true
+}
+
+// rebuildState writes all registers again, after the roles at the positions of the commands changed.
+// Has to be called with msgUpdateMutex held.
+func (r *Room) rebuildState() {
+	r.state = make(map[string]stateRegister)
+	r.stateClock = 0
+	r.pendingState = nil
+	r.Name = ""
+	r.Topic = ""
+
+	for _, msg := range r.Messages {
+		if msg.isStateCommand() {
+			r.applyStateCommand(msg)
+		}
+	}
+
+	if r.Self.Meta != nil {
+		r.Self.Meta.Nick = r.stateNick(r.Self.Fingerprint())
+	}
+	for _, peer := range r.Peers {
+		if peer.RIdentity.Meta != nil {
+			peer.RIdentity.Meta.Nick = r.stateNick(peer.RIdentity.Fingerprint())
+		}
+	}
+}
+
+// stateNick returns the nickname of the member with the specified fingerprint
+func (r *Room) stateNick(fingerprint string) string {
+	return r.state[stateKeyNick+fingerprint].value
+}
+
+// stateValue returns the key of the register written by msg and the new value
+func stateValue(msg Message) (string, string, error) {
+	switch commandName(msg.Content.Data) {
+	case RoomCommandNameRoom:
+		args := &NameRoomArgs{}
+		err := parseCommandArgs(&msg, RoomCommandNameRoom, args)
+		return stateKeyName, args.Name, err
+	case RoomCommandTopic:
+		args := &TopicArgs{}
+		err := parseCommandArgs(&msg, RoomCommandTopic, args)
+		return stateKeyTopic, args.Topic, err
+	default:
+		args := &NickArgs{}
+		err := parseCommandArgs(&msg, RoomCommandNick, args)
+		return stateKeyNick + msg.Meta.Sender, args.Nick, err
+	}
+}
+
+// commandClock returns the lamport clock of the command in msg.
+// Commands from older versions have none, and are ordered before all others.
+func commandClock(msg Message) uint64 {
+	payload, ok := structuredPayload(msg.Content.Data)
+	if !ok {
+		return 0
+	}
+
+	return payload.Clock
+}
@@ -0,0 +1,124 @@
+package types_test
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+)
+
+func stateMessage(t *testing.T, sender Identity, command Command, args interface{}, clock uint64) Message {
+	raw, _ := json.Marshal(args)
+	data, _ := json.Marshal(CommandPayload{
+		Version: CommandPayloadVersion,
+		Command: command,
+		Args:    raw,
+		Clock:   clock,
+	})
+
+	return NewMessage(MessageContent{Type: ContentTypeCmd, Data: data}, sender, 1)
+}
+
+func TestRoomStateConcurrentRenames(t *testing.T) {
+	room, x := setupRoleTests(t)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, x.Fingerprint()))
+
+	fromSelf := stateMessage(t, room.Self, RoomCommandNameRoom, NameRoomArgs{Name: "self"}, 1)
+	fromX := stateMessage(t, x, RoomCommandNameRoom, NameRoomArgs{Name: "x"}, 1)
+	nick := stateMessage(t, x, RoomCommandNick, NickArgs{Nick: "nick"}, 1)
+
+	first := replicate(t, room, fromSelf, fromX, nick)
+	second := replicate(t, room, nick, fromX, fromSelf)
+
+	assert.Equal(t, first.Info().Name, second.Info().Name)
+	assert.Equal(t, "nick", first.Info().Nicks[x.Fingerprint()])
+	assert.Equal(t, "nick", second.Info().Nicks[x.Fingerprint()])
+}
+
+func TestRoomStateClockBeforeTime(t *testing.T) {
+	room, _ := setupRoleTests(t)
+
+	later := stateMessage(t, room.Self, RoomCommandTopic, TopicArgs{Topic: "later"}, 1)
+	newer := stateMessage(t, room.Self, RoomCommandTopic, TopicArgs{Topic: "newer"}, 2)
+	newer.Meta.Time = later.Meta.Time.Add(-time.Hour)
+
+	replica := replicate(t, room, newer, later)
+
+	assert.Equal(t, "newer", replica.Info().Topic)
+}
+
+func TestRoomStateClockIncreases(t *testing.T) {
+	room, x := setupRoleTests(t)
+	room.SetPeerProtocol(x.Fingerprint(), Protocol{Features: map[string]bool{FeatureCommandPayload: true}})
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandTopic, "first"))
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandTopic, ""))
+
+	for i, msg := range room.Messages[len(room.Messages)-2:] {
+		payload := CommandPayload{}
+		assert.NoError(t, json.Unmarshal(msg.Content.Data, &payload))
+		assert.Equal(t, uint64(i+1), payload.Clock)
+	}
+	assert.Empty(t, room.Info().Topic)
+}
+
+func TestRoomStateRenameDuringDemotion(t *testing.T) {
+	room, x := setupRoleTests(t)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, x.Fingerprint()))
+
+	//x renames the room before the demotion reaches it, while its sender didn't know the rename
+	rename := stateMessage(t, x, RoomCommandNameRoom, NameRoomArgs{Name: "x"}, 1)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandDemote, x.Fingerprint()))
+	demote := room.Messages[len(room.Messages)-1]
+	room.Messages = room.Messages[:len(room.Messages)-1]
+
+	first := replicate(t, room, rename, demote)
+	second := replicate(t, room, demote, rename)
+
+	assert.Empty(t, first.Info().Name)
+	assert.Empty(t, second.Info().Name)
+}
+
+func TestRoomStateFormerMember(t *testing.T) {
+	room, x := setupRoleTests(t)
+	nick := stateMessage(t, x, RoomCommandNick, NickArgs{Nick: "former"}, 1)
+	assert.NoError(t, room.PushMessages(nick))
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandRemovePeer, x.Fingerprint()))
+
+	//A new member receives the messages of x only after its removal
+	history := &Room{Founder: room.Founder, Self: room.Self}
+	for _, msg := range room.Messages {
+		if msg.ID != nick.ID {
+			history.Messages = append(history.Messages, msg)
+		}
+	}
+	replica := replicate(t, history)
+
+	assert.NoError(t, replica.PushMessages(nick))
+	assert.Contains(t, replica.Messages, nick)
+}
+
+func TestRoomStateForgedClock(t *testing.T) {
+	room, x := setupRoleTests(t)
+	room.SetPeerProtocol(x.Fingerprint(), Protocol{Features: map[string]bool{FeatureCommandPayload: true}})
+
+	//A clock ahead of all known commands isn't applied, and a command that x wasn't allowed to run doesn't advance it
+	forged := stateMessage(t, x, RoomCommandNick, NickArgs{Nick: "forged"}, math.MaxUint64)
+	denied := stateMessage(t, x, RoomCommandNameRoom, NameRoomArgs{Name: "x"}, 1)
+	denied.Meta.Seq = 2
+	denied.Sign(*x.Priv)
+	room.PushMessages(forged, denied)
+
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandTopic, "topic"))
+
+	payload := CommandPayload{}
+	assert.NoError(t, json.Unmarshal(room.Messages[len(room.Messages)-1].Content.Data, &payload))
+	assert.Equal(t, uint64(1), payload.Clock)
+	assert.Equal(t, "topic", room.Info().Topic)
+	assert.Empty(t, room.Info().Name)
+	assert.Empty(t, room.Info().Nicks[x.Fingerprint()])
+}
@@ -1,9 +1,78 @@
 package types_test
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+	"github.com/craumix/onionmsg/pkg/blobmngr"
+	"github.com/craumix/onionmsg/pkg/ratchet"
+	"github.com/craumix/onionmsg/pkg/seal"
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+)
+
+var (
+	dials      = make(map[string]int)
+	servers    = make(map[string]func(connection.ConnWrapper))
+	dialsMutex sync.Mutex
 )
 
+// dialCount returns how often the address was dialed
+func dialCount(address string) int {
+	dialsMutex.Lock()
+	defer dialsMutex.Unlock()
+
+	return dials[address]
+}
+
+func TestMain(m *testing.M) {
+	//The message queues of peers that are added by the membership log fail instead of dialing,
+	//this is only set once, since the queues may still be running after their test is done
+	connection.GetConnFunc = func(network, address string) (connection.ConnWrapper, error) {
+		dialsMutex.Lock()
+		dials[address]++
+		serve, ok := servers[address]
+		dialsMutex.Unlock()
+
+		if !ok {
+			return nil, fmt.Errorf("no network in tests")
+		}
+
+		client, server := net.Pipe()
+		go serve(connection.WrapConnection(server))
+		return connection.WrapConnection(client), nil
+	}
+
+	os.Exit(m.Run())
+}
+
+// serveAddress makes the connections to address be handled by serve, instead of failing
+func serveAddress(t *testing.T, address string, serve func(connection.ConnWrapper)) {
+	dialsMutex.Lock()
+	servers[address] = serve
+	dialsMutex.Unlock()
+
+	t.Cleanup(func() {
+		dialsMutex.Lock()
+		delete(servers, address)
+		dialsMutex.Unlock()
+	})
+}
+
 func setupRoomTests() {
 
 }
@@ -11,3 +80,752 @@ func setupRoomTests() {
 func TestNewRoom(t *testing.T) {
 
 }
+
+// newMember creates an identity that is added to room as a peer
+func newMember(room *Room) Identity {
+	member, _ := NewIdentity(Self, "")
+	remote, _ := NewIdentity(Remote, member.Fingerprint())
+	room.Peers = append(room.Peers, NewMessagingPeer(remote))
+
+	return member
+}
+
+// supportRoomKey makes all peers of room support encrypted content
+func supportRoomKey(room *Room) {
+	for _, peer := range room.Peers {
+		room.SetPeerProtocol(peer.RIdentity.Fingerprint(), Protocol{Features: map[string]bool{FeatureRoomKey: true}})
+	}
+}
+
+func TestAddPeersStoresProtocol(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	t.Cleanup(room.StopQueues)
+	contact, _ := NewIdentity(Contact, "")
+	convID, _ := NewIdentity(Self, "")
+
+	serveAddress(t, contact.URL()+":"+strconv.Itoa(PubContPort), func(conn connection.ConnWrapper) {
+		defer conn.Close()
+
+		req := &ContactRequest{}
+		conn.ReadStruct(req)
+
+		hello := NewHello()
+		hello.Features = []string{FeatureSeqSync}
+		sig, _ := contact.Sign(append([]byte(convID.Fingerprint()), req.ID[:]...))
+		conn.WriteStruct(&ContactResponse{ConvFP: convID.Fingerprint(), Sig: sig, Hello: &hello})
+		conn.Flush()
+	})
+
+	assert.NoError(t, room.AddPeers(contact))
+
+	//The Protocol of the contact handshake is known before the first sync
+	if assert.Len(t, room.Peers, 1) && assert.NotNil(t, room.Peers[0].Protocol) {
+		assert.True(t, room.Peers[0].Protocol.Supports(FeatureSeqSync))
+		assert.False(t, room.Peers[0].Protocol.Supports(FeatureRatchet))
+	}
+}
+
+func TestPushMessagesSameTimestamp(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	msg1 := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("first")}, sender, 1)
+	msg2 := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("second")}, sender, 2)
+	msg2.Meta.Time = msg1.Meta.Time
+	msg2.Sign(*sender.Priv)
+
+	room.PushMessages(msg1, msg2)
+
+	assert.Len(t, room.Messages, 2)
+	assert.Equal(t, uint64(2), room.SyncState[sender.Fingerprint()])
+}
+
+func TestPushMessagesDuplicate(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1)
+
+	room.PushMessages(msg)
+	room.PushMessages(msg)
+
+	assert.Len(t, room.Messages, 1)
+}
+
+func TestPushMessagesOutOfOrder(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	msg1 := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("first")}, sender, 1)
+	msg2 := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("second")}, sender, 2)
+
+	room.PushMessages(msg2, msg1)
+
+	assert.Len(t, room.Messages, 2)
+	assert.Equal(t, uint64(2), room.SyncState[sender.Fingerprint()])
+}
+
+func TestPushMessagesGap(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	msg1 := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("first")}, sender, 1)
+	msg2 := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("second")}, sender, 2)
+	msg3 := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("third")}, sender, 3)
+
+	//The missing message is requested again with the next sync
+	room.PushMessages(msg1, msg3)
+	assert.Equal(t, uint64(1), room.SyncState[sender.Fingerprint()])
+
+	room.PushMessages(msg2, msg3)
+	assert.Len(t, room.Messages, 3)
+	assert.Equal(t, uint64(3), room.SyncState[sender.Fingerprint()])
+}
+
+func TestPushMessagesRelayedByOlderDaemon(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1)
+	relayed := msg
+	relayed.ID = ""
+	relayed.Meta.Seq = 0
+	relayed.ExtSig = nil
+
+	//The copy without the extension is replaced once the complete one arrives
+	room.PushMessages(relayed)
+	room.PushMessages(msg)
+	assert.Len(t, room.Messages, 1)
+	assert.Equal(t, uint64(1), room.Messages[0].Meta.Seq)
+	assert.Equal(t, uint64(1), room.SyncState[sender.Fingerprint()])
+}
+
+func TestPushMessagesRestoredBlobMismatch(t *testing.T) {
+	assert.NoError(t, blobmngr.InitializeDir(t.TempDir()))
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	//A relay dropped the hash and sent other content for the blob
+	id := uuid.New()
+	hash := sha256.Sum256([]byte("original"))
+
+	msg := NewMessage(MessageContent{Type: ContentTypeFile, Blob: &BlobMeta{ID: id, Size: 8, Hash: hash[:]}}, sender, 1)
+	relayed := msg
+	relayed.ID = ""
+	relayed.Meta.Seq = 0
+	relayed.ExtSig = nil
+	relayed.Content.Blob = &BlobMeta{ID: id, Size: 8}
+
+	file, err := blobmngr.PartialFileFromID(id)
+	assert.NoError(t, err)
+	file.Write([]byte("forged"))
+	file.Close()
+	room.PushMessages(relayed)
+	assert.NoError(t, blobmngr.AcceptBlob(id, nil))
+
+	room.PushMessages(msg)
+
+	assert.Equal(t, hash[:], room.Messages[0].Content.Blob.Hash)
+	_, err = blobmngr.StatFromID(id)
+	assert.Error(t, err)
+}
+
+func TestPushMessagesReusedBlob(t *testing.T) {
+	assert.NoError(t, blobmngr.InitializeDir(t.TempDir()))
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	//The blob of another message must not be referenced again, since it would be removed with either of them
+	stored, _ := blobmngr.SaveRessource([]byte("content"))
+	hash, err := blobmngr.CommitBlob(stored)
+	assert.NoError(t, err)
+
+	fresh := uuid.New()
+	first := NewMessage(MessageContent{Type: ContentTypeFile, Blob: &BlobMeta{ID: stored, Size: 7, Hash: hash}}, sender, 1)
+	second := NewMessage(MessageContent{Type: ContentTypeFile, Blob: &BlobMeta{ID: fresh, Size: 7, Hash: hash}}, sender, 2)
+	third := NewMessage(MessageContent{Type: ContentTypeFile, Blob: &BlobMeta{ID: fresh, Size: 7, Hash: hash}}, sender, 3)
+
+	added, err := room.AddMessages(first, second, third)
+
+	var rejected *RejectedError
+	assert.ErrorAs(t, err, &rejected)
+	assert.Equal(t, []string{first.ID, third.ID}, rejected.Messages)
+	assert.Equal(t, []Message{second}, added)
+}
+
+func TestKnowsBlobOnlyInSameRoom(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	other, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	hash := sha256.Sum256([]byte("content"))
+	msg := NewMessage(MessageContent{Type: ContentTypeFile, Blob: &BlobMeta{ID: uuid.New(), Size: 7, Hash: hash[:]}}, sender, 1)
+	room.PushMessages(msg)
+
+	assert.True(t, room.KnowsBlob(msg.Content.Blob.ID, nil))
+	assert.True(t, room.KnowsBlob(uuid.New(), hash[:]))
+	assert.False(t, room.KnowsBlob(uuid.New(), nil))
+	assert.False(t, other.KnowsBlob(msg.Content.Blob.ID, hash[:]))
+}
+
+func TestReceiptsAggregatedPerPeer(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	peer1 := newMember(room)
+	peer2 := newMember(room)
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("test")})
+	msgID := room.Messages[len(room.Messages)-1].ID
+
+	room.PushMessages(
+		NewMessage(NewReceiptContent(ReceiptRead, msgID), peer1, 1),
+		NewMessage(NewReceiptContent(ReceiptDelivered, msgID), peer1, 2),
+		NewMessage(NewReceiptContent(ReceiptDelivered, msgID), peer2, 1),
+	)
+
+	infos := room.MessageInfos()
+
+	assert.Len(t, infos, 1)
+	assert.Equal(t, ReceiptRead, infos[0].Receipts[peer1.Fingerprint()])
+	assert.Equal(t, ReceiptDelivered, infos[0].Receipts[peer2.Fingerprint()])
+}
+
+func TestConfirmDeliveryCoalesced(t *testing.T) {
+	defer func(interval time.Duration) { *DeliveryInterval = interval }(*DeliveryInterval)
+	*DeliveryInterval = 50 * time.Millisecond
+
+	room, _ := NewRoom(context.Background())
+	t.Cleanup(room.StopQueues)
+	newMember(room)
+	self := room.Self.Fingerprint()
+
+	room.ConfirmDelivery("first")
+	room.ConfirmDelivery()
+	room.ConfirmDelivery("second", "third")
+	assert.Equal(t, uint64(0), room.SyncStateCopy()[self])
+
+	//All ids are confirmed with a single receipt
+	assert.Eventually(t, func() bool { return room.SyncStateCopy()[self] == 1 }, time.Second, 10*time.Millisecond)
+	assert.Len(t, room.Messages, 1)
+	assert.Equal(t, []string{"first", "second", "third"}, room.Messages[0].ReceiptIDs())
+
+	time.Sleep(2 * *DeliveryInterval)
+	assert.Equal(t, uint64(1), room.SyncStateCopy()[self])
+}
+
+func TestAddMessagesOnlyNew(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("first")}, sender, 1)
+	room.PushMessages(msg)
+
+	next := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("second")}, sender, 2)
+	added, err := room.AddMessages(msg, next)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Message{next}, added)
+}
+
+func TestReceiptsCompacted(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	peer := newMember(room)
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("test")})
+	msgID := room.Messages[len(room.Messages)-1].ID
+
+	receipt := NewMessage(NewReceiptContent(ReceiptRead, msgID), peer, 1)
+	room.PushMessages(receipt)
+
+	//The receipt is kept until every peer knows it
+	room.SetPeerSyncState(peer.Fingerprint(), SyncMap{})
+	assert.Contains(t, room.Messages, receipt)
+
+	room.SetPeerSyncState(peer.Fingerprint(), room.SyncStateCopy())
+	assert.NotContains(t, room.Messages, receipt)
+
+	raw, err := json.Marshal(room)
+	assert.NoError(t, err)
+
+	reloaded := &Room{}
+	assert.NoError(t, json.Unmarshal(raw, reloaded))
+	reloaded.RebuildState()
+
+	added, err := reloaded.AddMessages(receipt)
+	assert.NoError(t, err)
+	assert.Empty(t, added)
+
+	assert.Equal(t, uint64(1), reloaded.SyncState[peer.Fingerprint()])
+	assert.Equal(t, ReceiptRead, reloaded.Receipts(msgID)[msgID][peer.Fingerprint()])
+}
+
+func TestEditMessage(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("test")})
+	msgID := room.Messages[len(room.Messages)-1].ID
+
+	err := room.EditMessage(msgID, []byte("edited"))
+	assert.NoError(t, err)
+
+	infos := room.MessageInfos()
+
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "edited", string(infos[0].Content.Data))
+	assert.NotNil(t, infos[0].Edited)
+}
+
+func TestEditMessageByOtherSender(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	other := newMember(room)
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("test")})
+	msgID := room.Messages[len(room.Messages)-1].ID
+
+	room.PushMessages(NewMessage(NewEditContent(msgID, []byte("edited")), other, 1))
+
+	infos := room.MessageInfos()
+
+	assert.Equal(t, "test", string(infos[0].Content.Data))
+	assert.Nil(t, infos[0].Edited)
+}
+
+func TestDeleteMessage(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("test")})
+	msgID := room.Messages[len(room.Messages)-1].ID
+
+	err := room.DeleteMessage(msgID)
+	assert.NoError(t, err)
+
+	assert.Empty(t, room.MessageInfos())
+	assert.Contains(t, room.Deleted, msgID)
+}
+
+func TestDeleteBeforeMessageArrives(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1)
+	del := NewMessage(NewDeleteContent(msg.ID), sender, 2)
+
+	room.PushMessages(del, msg)
+
+	assert.Empty(t, room.MessageInfos())
+	assert.Equal(t, uint64(2), room.SyncState[sender.Fingerprint()])
+}
+
+func TestDeleteByOtherSender(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+	other := newMember(room)
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1)
+	del := NewMessage(NewDeleteContent(msg.ID), other, 1)
+
+	room.PushMessages(msg, del)
+
+	assert.Len(t, room.MessageInfos(), 1)
+}
+
+func TestReactions(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	peer := newMember(room)
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("test")})
+	msgID := room.Messages[len(room.Messages)-1].ID
+
+	err := room.React(msgID, "👍")
+	assert.NoError(t, err)
+
+	room.PushMessages(
+		NewMessage(NewReactionRemoveContent(msgID, "👍"), peer, 2),
+		NewMessage(NewReactionContent(msgID, "👍"), peer, 1),
+		NewMessage(NewReactionContent(msgID, "🎉"), peer, 3),
+	)
+
+	infos := room.MessageInfos()
+
+	assert.Len(t, infos, 1)
+	assert.Equal(t, []string{room.Self.Fingerprint()}, infos[0].Reactions["👍"])
+	assert.Equal(t, []string{peer.Fingerprint()}, infos[0].Reactions["🎉"])
+}
+
+func TestReactionInvalid(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("test")})
+
+	assert.Error(t, room.React(room.Messages[len(room.Messages)-1].ID, ""))
+	assert.Error(t, room.React("unknown", "👍"))
+}
+
+func TestReactionEmoji(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("test")})
+	msgID := room.Messages[len(room.Messages)-1].ID
+
+	for _, emoji := range []string{"👍", "❤️", "👍🏽", "🇩🇪", "1️⃣", "👩‍👩‍👧", "🏴󠁧󠁢󠁳󠁣󠁴󠁿"} {
+		assert.NoError(t, room.React(msgID, emoji), emoji)
+	}
+
+	for _, emoji := range []string{"a", "1", "👍👍", "👍 ", "🇩", "👍\u200d", "\u200d👍", "🏴\U000e0067", "\U000e007f"} {
+		assert.Error(t, room.React(msgID, emoji), emoji)
+	}
+}
+
+func TestRoomKeyEncryptsContent(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	newMember(room)
+	supportRoomKey(room)
+	assert.NoError(t, room.RotateKey())
+	assert.True(t, room.HasKey())
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("secret")})
+
+	stored := room.Messages[len(room.Messages)-1]
+	assert.NotEmpty(t, stored.Content.Key)
+	assert.NotContains(t, string(stored.Content.Data), "secret")
+	assert.True(t, stored.SigIsValid())
+
+	infos := room.MessageInfos()
+
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "secret", string(infos[0].Content.Data))
+	assert.Empty(t, infos[0].Content.Key)
+}
+
+func TestRoomKeyUnknown(t *testing.T) {
+	sending, _ := NewRoom(context.Background())
+	newMember(sending)
+	supportRoomKey(sending)
+	sending.RotateKey()
+	sending.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("secret")})
+
+	receiving, _ := NewRoom(context.Background())
+	remote, _ := NewIdentity(Remote, sending.Self.Fingerprint())
+	receiving.Peers = append(receiving.Peers, NewMessagingPeer(remote))
+	receiving.PushMessages(sending.Messages[len(sending.Messages)-1])
+
+	infos := receiving.MessageInfos()
+
+	assert.Len(t, infos, 1)
+	assert.Nil(t, infos[0].Content.Data)
+	assert.NotEmpty(t, infos[0].Content.Key)
+}
+
+func TestRoomKeyOlderPeer(t *testing.T) {
+	room, peer := setupRoleTests(t)
+	inviteMember(t, room)
+	room.SetPeerProtocol(peer.Fingerprint(), Protocol{Features: map[string]bool{FeatureRoomKey: true}})
+
+	//The other peer couldn't read the content, so no key is distributed
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("plain")})
+
+	stored := room.Messages[len(room.Messages)-1]
+	assert.Empty(t, stored.Content.Key)
+	assert.Equal(t, "plain", string(stored.Content.Data))
+	assert.False(t, room.HasKey())
+}
+
+func TestRoomKeyEncryptsReactions(t *testing.T) {
+	room, peer := setupRoleTests(t)
+	supportRoomKey(room)
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("secret")})
+	msgID := room.Messages[len(room.Messages)-1].ID
+	assert.NoError(t, room.React(msgID, "👍"))
+
+	reaction := room.Messages[len(room.Messages)-1]
+	assert.NotEmpty(t, reaction.Content.Key)
+	assert.NotContains(t, string(reaction.Content.Data), "👍")
+	assert.Equal(t, map[string][]string{"👍": {room.Self.Fingerprint()}}, room.Reactions(msgID)[msgID])
+
+	//A reaction that arrives before its key is applied once the key is known
+	replica, _ := NewRoom(context.Background())
+	replica.Self = peer
+	replica.Founder = room.Founder
+	founder, _ := NewIdentity(Remote, room.Self.Fingerprint())
+	founder.SetRole(RoleOwner)
+	replica.Peers = append(replica.Peers, NewMessagingPeer(founder))
+
+	replica.PushMessages(reaction)
+	replica.PushMessages(room.Messages...)
+
+	assert.Equal(t, map[string][]string{"👍": {room.Self.Fingerprint()}}, replica.Reactions(msgID)[msgID])
+}
+
+func TestRoomKeyFromNonMember(t *testing.T) {
+	other, _ := NewRoom(context.Background())
+	other.RotateKey()
+
+	room, _ := NewRoom(context.Background())
+	room.PushMessages(other.Messages...)
+
+	assert.Empty(t, room.Messages)
+	assert.False(t, room.HasKey())
+}
+
+// peerRoomKey creates a room key distributed by sender, which is sealed for recipients
+func peerRoomKey(t *testing.T, sender Identity, seq uint64, recipients ...Identity) (Message, string) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	sum := sha256.Sum256(key)
+	id := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	sealed := make(map[string][]byte)
+	for _, recipient := range recipients {
+		sealed[recipient.Fingerprint()], _ = seal.SealFor(*recipient.Pub, key)
+	}
+
+	content, err := NewCommandContent(RoomCommandRoomKey, &RoomKeyArgs{ID: id, Keys: sealed})
+	assert.NoError(t, err)
+
+	return NewMessage(content, sender, seq), id
+}
+
+func TestRoomKeyRotatedForNewPeers(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	assert.NoError(t, room.RotateKey())
+
+	newMember(room)
+	newMember(room)
+	supportRoomKey(room)
+	assert.False(t, room.HasKey())
+
+	//A single key is created for all peers that joined since the last message
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("secret")})
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("secret")})
+
+	keys := 0
+	for _, msg := range room.Messages {
+		if msg.Content.Type == ContentTypeCmd {
+			keys++
+		}
+	}
+	assert.Equal(t, 2, keys)
+	assert.True(t, room.HasKey())
+}
+
+func TestRoomKeyOrderedByArrival(t *testing.T) {
+	room, peer := setupRoleTests(t)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, peer.Fingerprint()))
+	supportRoomKey(room)
+	assert.NoError(t, room.RotateKey())
+
+	//The time of a message is chosen by its sender, so a backdated key is still the newest
+	msg, id := peerRoomKey(t, peer, 1, room.Self)
+	msg.Meta.Time = msg.Meta.Time.AddDate(-1, 0, 0)
+	msg.Sign(*peer.Priv)
+	room.PushMessages(msg)
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("secret")})
+
+	assert.Equal(t, id, room.Messages[len(room.Messages)-1].Content.Key)
+}
+
+func TestRoomKeyMissingMember(t *testing.T) {
+	room, peer := setupRoleTests(t)
+	inviteMember(t, room)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, peer.Fingerprint()))
+	supportRoomKey(room)
+
+	//The key isn't used, since one of the members can't read it
+	msg, id := peerRoomKey(t, peer, 1, room.Self)
+	room.PushMessages(msg)
+	assert.False(t, room.HasKey())
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("secret")})
+
+	stored := room.Messages[len(room.Messages)-1]
+	assert.NotEmpty(t, stored.Content.Key)
+	assert.NotEqual(t, id, stored.Content.Key)
+}
+
+func TestRoomKeyReloaded(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("secret")})
+
+	raw, err := json.Marshal(room)
+	assert.NoError(t, err)
+
+	reloaded := &Room{}
+	assert.NoError(t, json.Unmarshal(raw, reloaded))
+	reloaded.RebuildState()
+
+	infos := reloaded.MessageInfos()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "secret", string(infos[0].Content.Data))
+}
+
+func TestDecodeMessagesPlain(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender, _ := NewIdentity(Self, "")
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1)
+	frame := sendFrame(t, LegacyProtocol(), FrameMessages, []Message{msg})
+
+	msgs, err := room.DecodeMessages(sender.Fingerprint(), frame)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Message{msg}, msgs)
+}
+
+func TestDecodeMessagesEnvelopesFromUnknownPeer(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender, _ := NewIdentity(Self, "")
+
+	frame := sendFrame(t, framed, FrameEnvelopes, map[string]interface{}{"envelopes": []interface{}{}})
+
+	_, err := room.DecodeMessages(sender.Fingerprint(), frame)
+
+	assert.Error(t, err)
+}
+
+// initiatorSession starts the ratchet session of member with room, in which member sends the first message
+func initiatorSession(t *testing.T, room *Room) (Identity, *ratchet.Session) {
+	member := newMember(room)
+	for member.Fingerprint() > room.Self.Fingerprint() {
+		room.Peers = room.Peers[:0]
+		member = newMember(room)
+	}
+
+	selfPub, err := seal.PublicKeyToCurve25519(*room.Self.Pub)
+	assert.NoError(t, err)
+
+	sk, err := ratchet.SharedSecret(seal.PrivateKeyToCurve25519(*member.Priv), selfPub, append([]byte("onionmsg ratchet "), room.ID[:]...))
+	assert.NoError(t, err)
+
+	session, err := ratchet.NewInitiator(sk, selfPub)
+	assert.NoError(t, err)
+
+	return member, session
+}
+
+func TestDecodeMessagesPlainAfterEnvelopes(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	member, session := initiatorSession(t, room)
+
+	//The initiator starts the session with an empty envelope
+	ad := append(append(append([]byte{}, room.ID[:]...), member.Fingerprint()...), room.Self.Fingerprint()...)
+	header, ciphertext, err := session.Encrypt(nil, ad)
+	assert.NoError(t, err)
+
+	envelopes := map[string]interface{}{"envelopes": []Envelope{{Header: header, Ciphertext: ciphertext}}}
+	msgs, err := room.DecodeMessages(member.Fingerprint(), sendFrame(t, framed, FrameEnvelopes, envelopes))
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	msg := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, member, 1)
+	_, err = room.DecodeMessages(member.Fingerprint(), sendFrame(t, framed, FrameMessages, []Message{msg}))
+	assert.Error(t, err)
+}
+
+func TestMarshalPeersDuringSession(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	member, session := initiatorSession(t, room)
+	ad := append(append(append([]byte{}, room.ID[:]...), member.Fingerprint()...), room.Self.Fingerprint()...)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 50; i++ {
+			header, ciphertext, err := session.Encrypt(nil, ad)
+			assert.NoError(t, err)
+
+			envelopes := map[string]interface{}{"envelopes": []Envelope{{Header: header, Ciphertext: ciphertext}}}
+			_, err = room.DecodeMessages(member.Fingerprint(), sendFrame(t, framed, FrameEnvelopes, envelopes))
+			assert.NoError(t, err)
+		}
+	}()
+
+	//Run with -race, the Session is saved while it is advanced
+	for {
+		select {
+		case <-done:
+			raw, err := json.Marshal(room.Peers)
+			assert.NoError(t, err)
+
+			peers := make([]*MessagingPeer, 0)
+			assert.NoError(t, json.Unmarshal(raw, &peers))
+			assert.Equal(t, uint32(50), peers[0].Session.Nr)
+			return
+		default:
+			_, err := json.Marshal(room.Peers)
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestPushMessageFromOtherRoom(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	sender := newMember(room)
+
+	msg := NewRoomMessage(MessageContent{Type: ContentTypeText, Data: []byte("test")}, sender, 1, uuid.New())
+	room.PushMessages(msg)
+
+	assert.Empty(t, room.Messages)
+}
+
+func TestPushMessagesFromNonMember(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	member := newMember(room)
+	stranger, _ := NewIdentity(Self, "")
+
+	accepted := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("hello")}, member, 1)
+	injected := NewMessage(MessageContent{Type: ContentTypeCmd, Data: []byte("name_room injected")}, stranger, 1)
+
+	err := room.PushMessages(accepted, injected)
+
+	var rejected *RejectedError
+	assert.ErrorAs(t, err, &rejected)
+	assert.Equal(t, []string{injected.ID}, rejected.Messages)
+	assert.Len(t, room.Messages, 1)
+	assert.Empty(t, room.Name)
+}
+
+func TestPushMessagesAfterInvite(t *testing.T) {
+	room, member := setupRoleTests(t)
+	room.SendMessageToAllPeers(mustCommand(t, RoomCommandPromote, member.Fingerprint()))
+	invited, _ := NewIdentity(Self, "")
+
+	early := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("too early")}, invited, 1)
+	invite := NewMessage(MessageContent{Type: ContentTypeCmd, Data: []byte("invite " + invited.Fingerprint())}, member, 1)
+	late := NewMessage(MessageContent{Type: ContentTypeText, Data: []byte("hello")}, invited, 2)
+
+	err := room.PushMessages(early, invite, late)
+
+	var rejected *RejectedError
+	assert.ErrorAs(t, err, &rejected)
+	assert.Equal(t, []string{early.ID}, rejected.Messages)
+	assert.Contains(t, room.Messages, late)
+}
+
+func TestReplyRef(t *testing.T) {
+	room, _ := NewRoom(context.Background())
+	newMember(room)
+	supportRoomKey(room)
+	assert.NoError(t, room.RotateKey())
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte(strings.Repeat("a", 200))})
+	msgID := room.Messages[len(room.Messages)-1].ID
+
+	reply, err := room.NewReplyRef(msgID)
+	assert.NoError(t, err)
+	assert.Equal(t, msgID, reply.ID)
+	assert.Equal(t, strings.Repeat("a", 140), string(reply.Excerpt))
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Reply: reply, Data: []byte("answer")})
+
+	stored := room.Messages[len(room.Messages)-1]
+	assert.NotContains(t, string(stored.Content.Reply.Excerpt), "aaaa")
+	assert.Equal(t, msgID, stored.Content.ReplyID())
+
+	infos := room.MessageInfos()
+	assert.Equal(t, reply, infos[len(infos)-1].Content.Reply)
+
+	_, err = room.NewReplyRef("unknown")
+	assert.Error(t, err)
+}
@@ -0,0 +1,144 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+)
+
+type SignalType string
+
+const (
+	SignalTyping        SignalType = "typing"
+	SignalStoppedTyping SignalType = "stopped_typing"
+	SignalOnline        SignalType = "online"
+	SignalAway          SignalType = "away"
+)
+
+// ErrUnknownSignal is returned if a Signal of an unknown type is sent
+var ErrUnknownSignal = errors.New("unknown signal type")
+
+// signalInterval is the shortest time between two signals of a Room,
+// the signals in between are coalesced into the last one
+var signalInterval = 3 * time.Second
+
+// Signal is an ephemeral hint between peers, e.g. that someone is typing.
+// Signals are sent directly to every peer on a best effort basis,
+// and are never stored in the Room or synced later on.
+type Signal struct {
+	Type   SignalType `json:"type"`
+	Sender string     `json:"sender"`
+	Time   time.Time  `json:"time"`
+}
+
+// signalThrottle holds back the signals of a Room that follow too quickly, see signalInterval
+type signalThrottle struct {
+	mutex   sync.Mutex
+	last    time.Time
+	pending SignalType
+	timer   *time.Timer
+}
+
+// IsValid returns true if the type of the Signal is known
+func (s Signal) IsValid() bool {
+	switch s.Type {
+	case SignalTyping, SignalStoppedTyping, SignalOnline, SignalAway:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendSignal sends a Signal of the specified type to all peers in the background.
+// Since every signal opens a connection to every peer, the signals within signalInterval after the last one
+// are coalesced, and only the last of them is sent once the interval is over.
+func (r *Room) SendSignal(sType SignalType) error {
+	if !(Signal{Type: sType}).IsValid() {
+		return fmt.Errorf("%w %s", ErrUnknownSignal, sType)
+	}
+
+	r.signals.mutex.Lock()
+	defer r.signals.mutex.Unlock()
+
+	wait := signalInterval - time.Since(r.signals.last)
+	if wait <= 0 {
+		r.signals.last = time.Now()
+		r.broadcastSignal(sType)
+		return nil
+	}
+
+	r.signals.pending = sType
+	if r.signals.timer == nil {
+		r.signals.timer = time.AfterFunc(wait, r.flushSignal)
+	}
+
+	return nil
+}
+
+// flushSignal sends the last signal that was held back
+func (r *Room) flushSignal() {
+	r.signals.mutex.Lock()
+	defer r.signals.mutex.Unlock()
+
+	r.signals.timer = nil
+	if r.Ctx != nil && r.Ctx.Err() != nil {
+		return
+	}
+
+	r.signals.last = time.Now()
+	r.broadcastSignal(r.signals.pending)
+}
+
+// broadcastSignal sends a Signal of the specified type to all peers in the background
+func (r *Room) broadcastSignal(sType SignalType) {
+	signal := Signal{
+		Type:   sType,
+		Sender: r.Self.Fingerprint(),
+		Time:   time.Now().UTC(),
+	}
+
+	for _, peer := range r.peersCopy() {
+		go func(peer *MessagingPeer) {
+			err := peer.sendSignal(r, signal)
+			if err != nil {
+				lf := log.Fields{
+					"room": r.ID,
+					"peer": peer.RIdentity.Fingerprint(),
+				}
+				log.WithError(err).WithFields(lf).Debug("unable to send signal")
+			}
+		}(peer)
+	}
+}
+
+func (mp *MessagingPeer) sendSignal(room *Room, signal Signal) error {
+	conn, err := connection.GetConnFunc("tcp", mp.RIdentity.URL()+":"+strconv.Itoa(PubSignalPort))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	LimitSession(conn)
+
+	_, ch, err := clientHandshake(conn, room, mp.RIdentity)
+	if err != nil {
+		return err
+	}
+
+	err = ch.Expect(FrameAuthOK, nil)
+	if err != nil {
+		return err
+	}
+
+	ch.SetTimeout(ConnTimeouts.Messages)
+	ch.Send(FrameSignal, signal)
+	ch.Flush()
+
+	return ch.Expect(FrameSignalOK, nil)
+}
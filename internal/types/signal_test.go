@@ -0,0 +1,38 @@
+package types_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+)
+
+func TestSendSignalCoalesced(t *testing.T) {
+	defer func(interval time.Duration) { *SignalInterval = interval }(*SignalInterval)
+	*SignalInterval = 200 * time.Millisecond
+
+	room, _ := NewRoom(context.Background())
+	t.Cleanup(room.StopQueues)
+	member := newMember(room)
+	address := member.URL() + ":" + strconv.Itoa(PubSignalPort)
+
+	assert.NoError(t, room.SendSignal(SignalTyping))
+	assert.Eventually(t, func() bool { return dialCount(address) == 1 }, time.Second, 10*time.Millisecond)
+
+	//The following signals are held back, and only the last one is sent
+	assert.NoError(t, room.SendSignal(SignalStoppedTyping))
+	assert.NoError(t, room.SendSignal(SignalTyping))
+	assert.NoError(t, room.SendSignal(SignalAway))
+	assert.Error(t, room.SendSignal("unknown"))
+
+	time.Sleep(*SignalInterval / 4)
+	assert.Equal(t, 1, dialCount(address))
+	assert.Eventually(t, func() bool { return dialCount(address) == 2 }, time.Second, 10*time.Millisecond)
+
+	time.Sleep(*SignalInterval / 2)
+	assert.Equal(t, 2, dialCount(address))
+}
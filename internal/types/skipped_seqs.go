@@ -0,0 +1,107 @@
+package types
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxSkippedSeqs limits how many skipped sequence numbers are accepted in a single sync,
+	// the remaining ones are offered again by the next sync
+	maxSkippedSeqs = 1 << 16
+)
+
+// SeqRange contains the sequence numbers from From to To, both included
+type SeqRange struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// SkippedSeqs contains the sequence numbers of every sender that are known, but whose messages are never synced,
+// because they were deleted or compacted. They are sent during the sync with FeatureSkippedSeqs,
+// so that the remote can fill the gaps in its SyncState, see Room.SkippedFor.
+// Since nothing proves that the messages of a sequence number are gone,
+// a peer only reports its own sequence numbers, and only those are accepted from it.
+type SkippedSeqs map[string][]SeqRange
+
+// SkippedFor returns the sequence numbers of Self the remote doesn't know yet, but that aren't synced anymore.
+// Since the SyncState of a sender only advances over known sequence numbers,
+// every sequence number up to it, that has no message, was deleted or compacted.
+func (r *Room) SkippedFor(remote SyncMap) SkippedSeqs {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+
+	self := r.Self.Fingerprint()
+	present := make(map[uint64]struct{})
+	for _, msg := range r.Messages {
+		if msg.Meta.Sender == self {
+			present[msg.Meta.Seq] = struct{}{}
+		}
+	}
+
+	skipped := make(SkippedSeqs)
+	for seq := remote[self] + 1; seq <= r.SyncState[self]; seq++ {
+		if _, ok := present[seq]; ok {
+			continue
+		}
+
+		ranges := skipped[self]
+		if n := len(ranges); n > 0 && ranges[n-1].To == seq-1 {
+			ranges[n-1].To = seq
+		} else {
+			skipped[self] = append(ranges, SeqRange{From: seq, To: seq})
+		}
+	}
+
+	return skipped
+}
+
+// SkipSeqs records the sequence numbers that the peer with the fingerprint reported as skipped, see SkippedFor.
+// Only the sequence numbers of its own messages are accepted, the ranges of other senders are ignored,
+// since they would let the peer hide the messages of others.
+// They are kept in Skipped, so that the SyncState still covers them after the Room was loaded again.
+func (r *Room) SkipSeqs(fingerprint string, skipped SkippedSeqs) {
+	r.msgUpdateMutex.Lock()
+	defer r.msgUpdateMutex.Unlock()
+
+	if r.msgIDs == nil {
+		r.rebuildMessageIndex()
+	}
+
+	for sender := range skipped {
+		if sender != fingerprint {
+			log.WithField("peer", fingerprint).Debugf("ignoring skipped sequence numbers of %s", sender)
+		}
+	}
+
+	budget := uint64(maxSkippedSeqs)
+	for _, sr := range skipped[fingerprint] {
+		if sr.From == 0 || sr.To < sr.From || sr.To-sr.From >= budget {
+			continue
+		}
+		budget -= sr.To - sr.From + 1
+
+		if sr.To <= r.SyncState[fingerprint] {
+			continue
+		}
+
+		if r.Skipped == nil {
+			r.Skipped = make(SkippedSeqs)
+		}
+		r.Skipped[fingerprint] = append(r.Skipped[fingerprint], sr)
+		r.trackSkipped(fingerprint, sr)
+	}
+}
+
+// trackSkipped records the range of skipped sequence numbers in the SyncState
+func (r *Room) trackSkipped(sender string, sr SeqRange) {
+	for seq := sr.From; ; seq++ {
+		r.trackSeq(sender, seq)
+		if seq == sr.To {
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package types_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/internal/types"
+)
+
+func TestSkippedSeqsForLaterPeer(t *testing.T) {
+	room, peer := setupRoleTests(t)
+
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("deleted")})
+	deleted := room.Messages[len(room.Messages)-1].ID
+	deletedSeq := room.Messages[len(room.Messages)-1].Meta.Seq
+	room.SendMessageToAllPeers(MessageContent{Type: ContentTypeText, Data: []byte("kept")})
+	assert.NoError(t, room.DeleteMessage(deleted))
+
+	//The receipt is compacted once the peer acknowledged it
+	room.PushMessages(NewMessage(NewReceiptContent(ReceiptRead, deleted), peer, 1))
+	room.SetPeerSyncState(peer.Fingerprint(), room.SyncStateCopy())
+
+	//A peer that joins later never receives the deleted message and the receipt
+	replica := replicate(t, room)
+	assert.Less(t, replica.SyncStateCopy()[room.Self.Fingerprint()], room.SyncStateCopy()[room.Self.Fingerprint()])
+	assert.Less(t, replica.SyncStateCopy()[peer.Fingerprint()], room.SyncStateCopy()[peer.Fingerprint()])
+
+	//Every sender only reports its own sequence numbers
+	skipped := room.SkippedFor(replica.SyncStateCopy())
+	assert.Equal(t, SkippedSeqs{
+		room.Self.Fingerprint(): {{From: deletedSeq, To: deletedSeq}},
+	}, skipped)
+
+	replica.SkipSeqs(room.Self.Fingerprint(), skipped)
+	replica.SkipSeqs(peer.Fingerprint(), SkippedSeqs{peer.Fingerprint(): {{From: 1, To: 1}}})
+
+	raw, err := json.Marshal(replica)
+	assert.NoError(t, err)
+	reloaded := &Room{}
+	assert.NoError(t, json.Unmarshal(raw, reloaded))
+	reloaded.RebuildState()
+
+	for _, r := range []*Room{replica, reloaded} {
+		state := r.SyncStateCopy()
+		for sender, seq := range room.SyncStateCopy() {
+			assert.Equal(t, seq, state[sender], sender)
+		}
+		assert.Empty(t, room.SkippedFor(state))
+	}
+}
+
+func TestSkipSeqsInvalid(t *testing.T) {
+	room, peer := setupRoleTests(t)
+
+	room.SkipSeqs(peer.Fingerprint(), SkippedSeqs{peer.Fingerprint(): {
+		{From: 0, To: 3},
+		{From: 5, To: 4},
+		{From: 1, To: 1 << 40},
+		{From: ^uint64(0) - 1, To: ^uint64(0)},
+	}})
+
+	assert.Equal(t, uint64(0), room.SyncStateCopy()[peer.Fingerprint()])
+}
+
+func TestSkipSeqsOfOtherSender(t *testing.T) {
+	room, peer := setupRoleTests(t)
+	other := newMember(room)
+
+	//A peer can't hide the messages of someone else
+	room.SkipSeqs(peer.Fingerprint(), SkippedSeqs{other.Fingerprint(): {{From: 1, To: 100}}})
+
+	assert.Equal(t, uint64(0), room.SyncStateCopy()[other.Fingerprint()])
+	assert.Empty(t, room.Skipped)
+}
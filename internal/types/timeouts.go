@@ -0,0 +1,65 @@
+package types
+
+import (
+	"time"
+
+	"github.com/craumix/onionmsg/pkg/sio/connection"
+)
+
+// Timeouts limit how long a single read or write on a connection to another daemon may take.
+// Every phase of an exchange has its own timeout, since e.g. a block of a blob
+// takes a lot longer to transfer over Tor than an acknowledgement.
+// Session limits the whole exchange, so that a peer can't keep it open by sending slowly.
+type Timeouts struct {
+	// Handshake covers the challenge, the authentication and the exchange of the sync state
+	Handshake time.Duration
+	// Messages covers sending and acknowledging batches of messages and signals
+	Messages time.Duration
+	// Blobs covers every block of a blob transfer
+	Blobs time.Duration
+	// Session covers the whole exchange, interrupted blob transfers are resumed by the next one
+	Session time.Duration
+}
+
+var (
+	// ConnTimeouts are used for all connections to other daemons
+	ConnTimeouts = DefaultTimeouts()
+)
+
+// DefaultTimeouts returns the timeouts that are used unless configured otherwise
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Handshake: time.Second * 30,
+		Messages:  time.Second * 60,
+		Blobs:     time.Second * 120,
+		Session:   time.Minute * 30,
+	}
+}
+
+// SetTimeouts configures the timeouts for all connections to other daemons.
+// Timeouts that aren't set keep their default.
+func SetTimeouts(t Timeouts) {
+	def := DefaultTimeouts()
+
+	if t.Handshake <= 0 {
+		t.Handshake = def.Handshake
+	}
+	if t.Messages <= 0 {
+		t.Messages = def.Messages
+	}
+	if t.Blobs <= 0 {
+		t.Blobs = def.Blobs
+	}
+	if t.Session <= 0 {
+		t.Session = def.Session
+	}
+
+	ConnTimeouts = t
+}
+
+// LimitSession starts an exchange with another daemon on conn,
+// which has to end before the session timeout and begins with the handshake
+func LimitSession(conn connection.ConnWrapper) {
+	conn.SetDeadline(time.Now().Add(ConnTimeouts.Session))
+	conn.SetTimeout(ConnTimeouts.Handshake)
+}
@@ -3,33 +3,45 @@ package types
 import (
 	"crypto/ed25519"
 	"encoding/base64"
-	"fmt"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/craumix/onionmsg/pkg/sio/connection"
 	"github.com/google/uuid"
 )
 
 const (
 	PubContPort = 10050
 	PubConvPort = 10051
+	//PubSignalPort is used for ephemeral signals, which aren't part of the message sync
+	PubSignalPort = 10052
 
-	blocksize = 1 << 19 // 512K
+	//BlockSize is the largest block of a blob that is transferred at once
+	BlockSize = 1 << 19 // 512K
 )
 
-type SyncMap map[string]time.Time
+// SyncMap is a compact summary of the known messages in a Room.
+// It maps the fingerprint of every known sender to the highest sequence number
+// up to which all messages of the sender are known, so that messages missing after a gap are synced again.
+type SyncMap map[string]uint64
 
 type ContactRequest struct {
 	RemoteFP string
 	LocalFP  string
 	ID       uuid.UUID
+	//Hello is omitted by older daemons
+	Hello *Hello `json:",omitempty"`
+	//Members are the other peers of the room, so that the
+	//new peer knows everyone who wrote the earlier messages
+	Members []string `json:",omitempty"`
+	//Genesis is the founding event of the room, see Room.Genesis
+	Genesis *Message `json:",omitempty"`
 }
 
 type ContactResponse struct {
 	ConvFP string
 	Sig    []byte
+	//Hello is only sent in response to a request containing one
+	Hello *Hello `json:",omitempty"`
 }
 
 func CopySyncMap(m SyncMap) SyncMap {
@@ -43,7 +55,7 @@ func CopySyncMap(m SyncMap) SyncMap {
 
 func SyncMapsEqual(map1, map2 SyncMap) bool {
 	for k, v := range map1 {
-		if t, ok := map2[k]; !ok || !t.Equal(v) {
+		if s, ok := map2[k]; !ok || s != v {
 			return false
 		}
 	}
@@ -63,33 +75,14 @@ func blobIDsFromMessages(msgs ...Message) []uuid.UUID {
 	return ids
 }
 
-func expectResponse(conn connection.ConnWrapper, expResp string) error {
-	resp, err := conn.ReadString()
-	if err != nil {
-		return err
-	} else if resp != expResp {
-		return fmt.Errorf("received response \"%s\" wanted \"%s\"", resp, expResp)
-	}
-
-	return nil
-}
-
-func fingerprintChallenge(conn connection.ConnWrapper, id Identity) error {
-	challenge, err := conn.ReadBytes()
-	if err != nil {
-		return err
+// BlockCount returns the number of blocks in which the remaining bytes of a blob are transferred
+func BlockCount(remaining int64) int {
+	count := int(remaining / BlockSize)
+	if remaining%BlockSize != 0 {
+		count++
 	}
 
-	signed, err := id.Sign(challenge)
-	if err != nil {
-		fmt.Print(err.Error())
-	}
-
-	conn.WriteString(id.Fingerprint())
-	conn.WriteBytes(signed)
-	conn.Flush()
-
-	return nil
+	return count
 }
 
 func Sign(key ed25519.PrivateKey, data []byte) []byte {
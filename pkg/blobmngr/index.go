@@ -0,0 +1,158 @@
+package blobmngr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	indexFile = "index.json"
+)
+
+var (
+	//refs maps the id of every blob reference to the hex encoded hash of its content
+	refs      = map[uuid.UUID]string{}
+	refCounts = map[string]int{}
+	refMutex  sync.Mutex
+)
+
+func loadIndex() error {
+	refMutex.Lock()
+	defer refMutex.Unlock()
+
+	refs = map[uuid.UUID]string{}
+	refCounts = map[string]int{}
+
+	raw, err := ioutil.ReadFile(indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(raw, &refs)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range refs {
+		refCounts[hash]++
+	}
+
+	return nil
+}
+
+//saveIndex writes the index to a temporary file, which replaces the old index at once,
+//so that a crash never leaves an incomplete index behind.
+//It has to be called with refMutex held.
+func saveIndex() error {
+	raw, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+
+	tmp := indexPath() + ".tmp"
+	err = ioutil.WriteFile(tmp, raw, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, indexPath())
+}
+
+func lookupRef(id uuid.UUID) (string, bool) {
+	refMutex.Lock()
+	defer refMutex.Unlock()
+
+	hash, ok := refs[id]
+	return hash, ok
+}
+
+func addRef(id uuid.UUID, hash string) error {
+	refMutex.Lock()
+	defer refMutex.Unlock()
+
+	//The content of an id never changes, since messages refer to it by the id
+	if old, ok := refs[id]; ok {
+		if old != hash {
+			return fmt.Errorf("blob %s already references other content", id)
+		}
+		return nil
+	}
+
+	refs[id] = hash
+	refCounts[hash]++
+
+	return saveIndex()
+}
+
+func removeRef(id uuid.UUID, hash string) error {
+	refMutex.Lock()
+	defer refMutex.Unlock()
+
+	delete(refs, id)
+	refCounts[hash]--
+
+	if refCounts[hash] <= 0 {
+		delete(refCounts, hash)
+		err := os.Remove(objectPath(hash))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return saveIndex()
+}
+
+//migrateBlobs moves all blobs that are still stored as <uuid>.blob
+//into the content-addressed storage, keeping their id as a reference.
+func migrateBlobs() error {
+	files, err := ioutil.ReadDir(blobdir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".blob") {
+			continue
+		}
+
+		id, err := uuid.Parse(strings.TrimSuffix(name, ".blob"))
+		if err != nil {
+			continue
+		}
+
+		//The reference was saved, but the process stopped before the file was removed
+		if _, ok := lookupRef(id); ok {
+			err = os.Remove(blobPath(id))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		hash, err := hashFile(filepath.Join(blobdir, name))
+		if err != nil {
+			return err
+		}
+
+		err = storeObject(id, blobPath(id), hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func indexPath() string {
+	return filepath.Join(blobdir, indexFile)
+}
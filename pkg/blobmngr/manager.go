@@ -1,6 +1,10 @@
 package blobmngr
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
@@ -15,10 +19,13 @@ var (
 	FileFromID    = fileFromID
 	WriteIntoFile = writeIntoFile
 	StatFromID    = statFromID
+	HashFromID    = hashFromID
 
 	blobdir = "./"
 )
 
+//InitializeDir sets the directory in which blobs are stored, loads the reference index
+//and migrates all blobs that are still stored by their id into the content-addressed storage.
 func InitializeDir(dir string) error {
 	err := os.Mkdir(dir, 0700)
 	if err != nil && !os.IsExist(err) {
@@ -26,11 +33,17 @@ func InitializeDir(dir string) error {
 	}
 
 	blobdir = dir
-	return nil
+
+	err = loadIndex()
+	if err != nil {
+		return err
+	}
+
+	return migrateBlobs()
 }
 
 func GetRessource(id uuid.UUID) ([]byte, error) {
-	return ioutil.ReadFile(blobPath(id))
+	return ioutil.ReadFile(pathFromID(id))
 }
 
 func streamTo(id uuid.UUID, w io.Writer) error {
@@ -45,12 +58,18 @@ func streamTo(id uuid.UUID, w io.Writer) error {
 	return nil
 }
 
+//fileFromID opens the blob for the id.
+//Content-addressed blobs are opened read-only, since they are shared and must never change.
 func fileFromID(id uuid.UUID) (*os.File, error) {
+	if hash, ok := lookupRef(id); ok {
+		return os.Open(objectPath(hash))
+	}
+
 	return os.OpenFile(blobPath(id), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
 }
 
 func statFromID(id uuid.UUID) (fs.FileInfo, error) {
-	return os.Stat(blobPath(id))
+	return os.Stat(pathFromID(id))
 }
 
 func writeIntoFile(from io.Reader, to *os.File) error {
@@ -80,10 +99,191 @@ func makeBlob() (uuid.UUID, error) {
 	return SaveRessource(make([]byte, 0))
 }
 
+//RemoveBlob removes the reference the id holds on its content.
+//The content itself is only deleted once it isn't referenced anymore.
 func RemoveBlob(id uuid.UUID) error {
+	if hash, ok := lookupRef(id); ok {
+		return removeRef(id, hash)
+	}
+
 	return os.Remove(blobPath(id))
 }
 
+func hashFromID(id uuid.UUID) ([]byte, error) {
+	if hash, ok := lookupRef(id); ok {
+		return hex.DecodeString(hash)
+	}
+
+	return hashFile(blobPath(id))
+}
+
+//CommitBlob moves the blob for the id into the content-addressed storage and returns its hash.
+//If the same content is already stored, the blob is deduplicated and only a reference is added.
+func CommitBlob(id uuid.UUID) ([]byte, error) {
+	if _, ok := lookupRef(id); ok {
+		return hashFromID(id)
+	}
+
+	hash, err := hashFile(blobPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	return hash, storeObject(id, blobPath(id), hash)
+}
+
+//HasContent returns the size of the stored content with the specified hash,
+//which a new reference can be added for without transferring it again.
+func HasContent(hash []byte) (int64, bool) {
+	stat, err := os.Stat(objectPath(hex.EncodeToString(hash)))
+	if err != nil {
+		return 0, false
+	}
+
+	return stat.Size(), true
+}
+
+//IsReferenced returns true if the id already references stored content.
+func IsReferenced(id uuid.UUID) bool {
+	_, ok := lookupRef(id)
+	return ok
+}
+
+//AcceptBlob adds the reference of the id to its content, once the message containing the blob was accepted.
+//The content is either the partial blob, which has to match the hash if one is provided, or already stored content with the hash.
+//An id that is already referenced is refused, since the reference belongs to another message.
+func AcceptBlob(id uuid.UUID, hash []byte) error {
+	if IsReferenced(id) {
+		return fmt.Errorf("blob %s is already referenced", id)
+	}
+
+	if _, err := os.Stat(partialPath(id)); err == nil {
+		return CompletePartial(id, hash)
+	}
+
+	if _, ok := HasContent(hash); hash == nil || !ok {
+		return fmt.Errorf("no content for blob %s", id)
+	}
+
+	return addRef(id, hex.EncodeToString(hash))
+}
+
+//PartialSize returns the number of bytes that have already been received for an incomplete blob.
+//Zero is returned if there is no partial blob for the id.
+func PartialSize(id uuid.UUID) int64 {
+	stat, err := os.Stat(partialPath(id))
+	if err != nil {
+		return 0
+	}
+
+	return stat.Size()
+}
+
+//PartialFileFromID opens the incomplete blob for the id, so that received data can be appended to it.
+func PartialFileFromID(id uuid.UUID) (*os.File, error) {
+	return os.OpenFile(partialPath(id), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+}
+
+//DiscardPartial removes the incomplete blob for the id, if there is one.
+func DiscardPartial(id uuid.UUID) error {
+	err := os.Remove(partialPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+//VerifyPartial checks that the SHA-256 digest of the incomplete blob for the id matches the hash,
+//otherwise the partial blob is removed and an error is returned.
+//The blob is kept as partial, until it is accepted, see AcceptBlob.
+func VerifyPartial(id uuid.UUID, hash []byte) error {
+	if hash == nil {
+		return nil
+	}
+
+	actual, err := hashFile(partialPath(id))
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(actual, hash) {
+		os.Remove(partialPath(id))
+		return fmt.Errorf("hash mismatch for blob %s", id)
+	}
+
+	return nil
+}
+
+//CompletePartial marks the incomplete blob for the id as complete, and commits it to the content-addressed storage.
+//If a hash is provided, the SHA-256 digest of the blob has to match it,
+//otherwise the partial blob is removed and an error is returned.
+func CompletePartial(id uuid.UUID, hash []byte) error {
+	actual, err := hashFile(partialPath(id))
+	if err != nil {
+		return err
+	}
+
+	if hash != nil && !bytes.Equal(actual, hash) {
+		os.Remove(partialPath(id))
+		return fmt.Errorf("hash mismatch for blob %s", id)
+	}
+
+	return storeObject(id, partialPath(id), actual)
+}
+
+//storeObject moves the file at path to the location for its hash and adds a reference for the id.
+//The file is linked to its new location and only removed once the reference is saved,
+//so that a crash in between leaves the file in place, which is stored again on the next start.
+//If the content is already stored, only the reference is added.
+func storeObject(id uuid.UUID, path string, hash []byte) error {
+	hexHash := hex.EncodeToString(hash)
+
+	err := os.Link(path, objectPath(hexHash))
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	err = addRef(id, hexHash)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+func pathFromID(id uuid.UUID) string {
+	if hash, ok := lookupRef(id); ok {
+		return objectPath(hash)
+	}
+
+	return blobPath(id)
+}
+
 func blobPath(id uuid.UUID) string {
 	return blobdir + "/" + id.String() + ".blob"
 }
+
+func objectPath(hash string) string {
+	return blobdir + "/" + hash + ".blob"
+}
+
+func partialPath(id uuid.UUID) string {
+	return blobPath(id) + ".part"
+}
@@ -0,0 +1,174 @@
+package blobmngr_test
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/pkg/blobmngr"
+)
+
+func setupBlobTests(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "blobs")
+	assert.NoError(t, InitializeDir(dir))
+
+	return dir
+}
+
+func saveBlob(t *testing.T, content string) uuid.UUID {
+	id, err := SaveRessource([]byte(content))
+	assert.NoError(t, err)
+
+	_, err = CommitBlob(id)
+	assert.NoError(t, err)
+
+	return id
+}
+
+func countObjects(t *testing.T, dir string) int {
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+
+	count := 0
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".blob" {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestBlobDeduplicated(t *testing.T) {
+	dir := setupBlobTests(t)
+
+	first := saveBlob(t, "content")
+	second := saveBlob(t, "content")
+
+	assert.Equal(t, 1, countObjects(t, dir))
+
+	raw, err := GetRessource(second)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(raw))
+
+	firstHash, _ := HashFromID(first)
+	secondHash, _ := HashFromID(second)
+	assert.Equal(t, firstHash, secondHash)
+}
+
+func TestBlobReferenceCount(t *testing.T) {
+	dir := setupBlobTests(t)
+
+	first := saveBlob(t, "content")
+	second := saveBlob(t, "content")
+
+	//The content is kept, until the last reference is removed
+	assert.NoError(t, RemoveBlob(first))
+	assert.Equal(t, 1, countObjects(t, dir))
+
+	assert.NoError(t, RemoveBlob(second))
+	assert.Equal(t, 0, countObjects(t, dir))
+}
+
+func TestBlobReferenceCountReloaded(t *testing.T) {
+	dir := setupBlobTests(t)
+
+	first := saveBlob(t, "content")
+	second := saveBlob(t, "content")
+
+	assert.NoError(t, InitializeDir(dir))
+
+	assert.NoError(t, RemoveBlob(first))
+	_, err := GetRessource(second)
+	assert.NoError(t, err)
+}
+
+func TestBlobMigration(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "blobs")
+	assert.NoError(t, os.Mkdir(dir, 0700))
+
+	//Older versions stored every blob by its id
+	id := uuid.New()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, id.String()+".blob"), []byte("content"), 0600))
+
+	assert.NoError(t, InitializeDir(dir))
+
+	raw, err := GetRessource(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(raw))
+
+	hash := sha256.Sum256([]byte("content"))
+	actual, _ := HashFromID(id)
+	assert.Equal(t, hash[:], actual)
+
+	_, err = os.Stat(filepath.Join(dir, id.String()+".blob"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAcceptBlob(t *testing.T) {
+	setupBlobTests(t)
+
+	stored := saveBlob(t, "content")
+	hash, _ := HashFromID(stored)
+
+	size, found := HasContent(hash)
+	assert.True(t, found)
+	assert.Equal(t, int64(len("content")), size)
+
+	//A received blob with known content only needs a reference
+	id := uuid.New()
+	assert.NoError(t, AcceptBlob(id, hash))
+
+	raw, err := GetRessource(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(raw))
+
+	//An id is only referenced once, and the content it refers to never changes
+	assert.Error(t, AcceptBlob(id, hash))
+	other := sha256.Sum256([]byte("other"))
+	assert.Error(t, AcceptBlob(id, other[:]))
+}
+
+func TestAcceptPartialBlob(t *testing.T) {
+	setupBlobTests(t)
+
+	id := uuid.New()
+	file, err := PartialFileFromID(id)
+	assert.NoError(t, err)
+	file.Write([]byte("content"))
+	file.Close()
+
+	hash := sha256.Sum256([]byte("content"))
+	assert.NoError(t, VerifyPartial(id, hash[:]))
+
+	//The partial blob isn't referenced before it is accepted
+	_, err = StatFromID(id)
+	assert.Error(t, err)
+
+	assert.NoError(t, AcceptBlob(id, hash[:]))
+	assert.Equal(t, int64(0), PartialSize(id))
+
+	raw, err := GetRessource(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(raw))
+}
+
+func TestBlobMigrationAfterCrash(t *testing.T) {
+	dir := setupBlobTests(t)
+
+	//The process stopped after the reference was saved, but before the file was removed
+	id := saveBlob(t, "content")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, id.String()+".blob"), []byte("content"), 0600))
+
+	assert.NoError(t, InitializeDir(dir))
+
+	assert.Equal(t, 1, countObjects(t, dir))
+	raw, err := GetRessource(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(raw))
+}
@@ -0,0 +1,371 @@
+package ratchet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	//MaxSkip is the maximum number of message keys that are kept for messages that haven't arrived yet
+	MaxSkip = 1000
+
+	nonceSize = 24
+)
+
+var (
+	rootInfo    = []byte("onionmsg ratchet root")
+	messageInfo = []byte("onionmsg ratchet message")
+)
+
+//KeyPair is a X25519 key pair
+type KeyPair struct {
+	Priv [32]byte `json:"priv"`
+	Pub  [32]byte `json:"pub"`
+}
+
+//Header is sent in plaintext together with every encrypted message,
+//so that the receiver can follow the ratchet of the sender.
+type Header struct {
+	DH [32]byte `json:"dh"`
+	PN uint32   `json:"pn"`
+	N  uint32   `json:"n"`
+}
+
+type skippedKey struct {
+	DH  [32]byte `json:"dh"`
+	N   uint32   `json:"n"`
+	Key []byte   `json:"key"`
+}
+
+//Session is the state of one side of a double ratchet.
+//Every message is encrypted with its own key, which is deleted once it was used,
+//and the keys are regularly mixed with new Diffie-Hellman outputs.
+//So neither past nor future messages can be decrypted with the current state alone.
+//A Session is not safe for concurrent use.
+type Session struct {
+	RootKey []byte    `json:"rk"`
+	DHs     KeyPair   `json:"dhs"`
+	DHr     *[32]byte `json:"dhr,omitempty"`
+	CKs     []byte    `json:"cks,omitempty"`
+	CKr     []byte    `json:"ckr,omitempty"`
+	Ns      uint32    `json:"ns"`
+	Nr      uint32    `json:"nr"`
+	PN      uint32    `json:"pn"`
+
+	Skipped []skippedKey `json:"skipped,omitempty"`
+}
+
+//GenerateKeyPair creates a new random X25519 key pair
+func GenerateKeyPair() (KeyPair, error) {
+	kp := KeyPair{}
+
+	_, err := io.ReadFull(rand.Reader, kp.Priv[:])
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	pub, err := curve25519.X25519(kp.Priv[:], curve25519.Basepoint)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	copy(kp.Pub[:], pub)
+
+	return kp, nil
+}
+
+//SharedSecret derives the secret both sides start their Sessions from.
+//info should bind the secret to the context it is used in.
+func SharedSecret(priv, remotePub *[32]byte, info []byte) ([]byte, error) {
+	dh, err := curve25519.X25519(priv[:], remotePub[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return expand(dh, nil, info, 32)
+}
+
+//NewInitiator creates the Session of the side that sends the first message.
+//remote is the initial ratchet key of the responder.
+func NewInitiator(sharedSecret []byte, remote *[32]byte) (*Session, error) {
+	dhs, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		DHs: dhs,
+		DHr: remote,
+	}
+
+	dh, err := curve25519.X25519(s.DHs.Priv[:], remote[:])
+	if err != nil {
+		return nil, err
+	}
+
+	s.RootKey, s.CKs, err = kdfRoot(sharedSecret, dh)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+//NewResponder creates the Session of the side that receives the first message.
+//It can't encrypt anything before it has received a message from the initiator.
+func NewResponder(sharedSecret []byte, own KeyPair) *Session {
+	return &Session{
+		RootKey: sharedSecret,
+		DHs:     own,
+	}
+}
+
+//CanEncrypt returns true if the Session has a sending chain
+func (s *Session) CanEncrypt() bool {
+	return s.CKs != nil
+}
+
+//Encrypt encrypts plaintext with the next message key of the sending chain.
+//ad is authenticated together with the header, but not encrypted.
+func (s *Session) Encrypt(plaintext, ad []byte) (Header, []byte, error) {
+	if !s.CanEncrypt() {
+		return Header{}, nil, fmt.Errorf("session has no sending chain yet")
+	}
+
+	var mk []byte
+	s.CKs, mk = kdfChain(s.CKs)
+
+	h := Header{
+		DH: s.DHs.Pub,
+		PN: s.PN,
+		N:  s.Ns,
+	}
+	s.Ns++
+
+	key, err := messageKey(mk, h, ad)
+	if err != nil {
+		return Header{}, nil, err
+	}
+
+	var nonce [nonceSize]byte
+	_, err = io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return Header{}, nil, err
+	}
+
+	return h, secretbox.Seal(nonce[:], plaintext, &nonce, key), nil
+}
+
+//Decrypt decrypts a message that was encrypted by the other side of the Session.
+//The Session is only changed if the message could be decrypted.
+func (s *Session) Decrypt(h Header, ciphertext, ad []byte) ([]byte, error) {
+	if i, found := s.findSkipped(h); found {
+		plaintext, err := open(s.Skipped[i].Key, h, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Skipped = append(s.Skipped[:i], s.Skipped[i+1:]...)
+		return plaintext, nil
+	}
+
+	next := s.clone()
+
+	if next.DHr == nil || h.DH != *next.DHr {
+		err := next.skipKeys(h.PN)
+		if err != nil {
+			return nil, err
+		}
+
+		err = next.dhRatchet(h)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := next.skipKeys(h.N)
+	if err != nil {
+		return nil, err
+	}
+
+	var mk []byte
+	next.CKr, mk = kdfChain(next.CKr)
+	next.Nr++
+
+	plaintext, err := open(mk, h, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	*s = *next
+	return plaintext, nil
+}
+
+func (s *Session) dhRatchet(h Header) error {
+	s.PN = s.Ns
+	s.Ns = 0
+	s.Nr = 0
+
+	remote := h.DH
+	s.DHr = &remote
+
+	dh, err := curve25519.X25519(s.DHs.Priv[:], s.DHr[:])
+	if err != nil {
+		return err
+	}
+
+	s.RootKey, s.CKr, err = kdfRoot(s.RootKey, dh)
+	if err != nil {
+		return err
+	}
+
+	s.DHs, err = GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+
+	dh, err = curve25519.X25519(s.DHs.Priv[:], s.DHr[:])
+	if err != nil {
+		return err
+	}
+
+	s.RootKey, s.CKs, err = kdfRoot(s.RootKey, dh)
+	return err
+}
+
+//skipKeys stores the keys of all messages in the receiving chain before until,
+//so that they can still be decrypted if they arrive later.
+func (s *Session) skipKeys(until uint32) error {
+	if s.CKr == nil {
+		return nil
+	}
+
+	if until > s.Nr+MaxSkip {
+		return fmt.Errorf("too many skipped messages")
+	}
+
+	for s.Nr < until {
+		var mk []byte
+		s.CKr, mk = kdfChain(s.CKr)
+
+		s.Skipped = append(s.Skipped, skippedKey{
+			DH:  *s.DHr,
+			N:   s.Nr,
+			Key: mk,
+		})
+		s.Nr++
+	}
+
+	//The oldest keys are dropped, they are the least likely to still be needed
+	if len(s.Skipped) > MaxSkip {
+		s.Skipped = s.Skipped[len(s.Skipped)-MaxSkip:]
+	}
+
+	return nil
+}
+
+func (s *Session) findSkipped(h Header) (int, bool) {
+	for i, sk := range s.Skipped {
+		if sk.DH == h.DH && sk.N == h.N {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+func (s *Session) clone() *Session {
+	c := *s
+
+	if s.DHr != nil {
+		dhr := *s.DHr
+		c.DHr = &dhr
+	}
+	c.Skipped = append([]skippedKey(nil), s.Skipped...)
+
+	return &c
+}
+
+//kdfRoot mixes a new Diffie-Hellman output into the root key,
+//and returns the new root key and the key of a new chain.
+func kdfRoot(rk, dh []byte) ([]byte, []byte, error) {
+	out, err := expand(dh, rk, rootInfo, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return out[:32], out[32:], nil
+}
+
+//kdfChain returns the next chain key and the message key for the current position in the chain
+func kdfChain(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x02})
+	next := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x01})
+
+	return next, mac.Sum(nil)
+}
+
+//messageKey binds the key used for encryption to the header and the associated data
+func messageKey(mk []byte, h Header, ad []byte) (*[32]byte, error) {
+	counters := make([]byte, 8)
+	binary.BigEndian.PutUint32(counters[:4], h.PN)
+	binary.BigEndian.PutUint32(counters[4:], h.N)
+
+	info := append([]byte{}, messageInfo...)
+	info = append(info, h.DH[:]...)
+	info = append(info, counters...)
+	info = append(info, ad...)
+
+	raw, err := expand(mk, nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	key := new([32]byte)
+	copy(key[:], raw)
+
+	return key, nil
+}
+
+func open(mk []byte, h Header, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("message too short")
+	}
+
+	key, err := messageKey(mk, h, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], ciphertext)
+
+	plaintext, ok := secretbox.Open(nil, ciphertext[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("unable to decrypt message %d of chain", h.N)
+	}
+
+	return plaintext, nil
+}
+
+func expand(secret, salt, info []byte, length int) ([]byte, error) {
+	out := make([]byte, length)
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
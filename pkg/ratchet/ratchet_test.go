@@ -0,0 +1,86 @@
+package ratchet_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/craumix/onionmsg/pkg/ratchet"
+)
+
+func newSessions(t *testing.T) (*Session, *Session) {
+	responderKeys, err := GenerateKeyPair()
+	assert.NoError(t, err)
+
+	sk := make([]byte, 32)
+
+	initiator, err := NewInitiator(sk, &responderKeys.Pub)
+	assert.NoError(t, err)
+
+	return initiator, NewResponder(sk, responderKeys)
+}
+
+func TestConversation(t *testing.T) {
+	alice, bob := newSessions(t)
+	assert.False(t, bob.CanEncrypt())
+
+	for i := 0; i < 3; i++ {
+		h, ct, err := alice.Encrypt([]byte("ping"), nil)
+		assert.NoError(t, err)
+
+		pt, err := bob.Decrypt(h, ct, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(pt))
+
+		h, ct, err = bob.Encrypt([]byte("pong"), nil)
+		assert.NoError(t, err)
+
+		pt, err = alice.Decrypt(h, ct, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(pt))
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	h1, ct1, _ := alice.Encrypt([]byte("first"), nil)
+	h2, ct2, _ := alice.Encrypt([]byte("second"), nil)
+
+	pt, err := bob.Decrypt(h2, ct2, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(pt))
+
+	pt, err = bob.Decrypt(h1, ct1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(pt))
+}
+
+func TestMessageKeysAreDeleted(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	h, ct, _ := alice.Encrypt([]byte("once"), nil)
+
+	_, err := bob.Decrypt(h, ct, nil)
+	assert.NoError(t, err)
+
+	_, err = bob.Decrypt(h, ct, nil)
+	assert.Error(t, err, "message could be decrypted twice")
+}
+
+func TestTamperedMessage(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	h, ct, _ := alice.Encrypt([]byte("test"), []byte("ad"))
+
+	_, err := bob.Decrypt(h, ct, []byte("other ad"))
+	assert.Error(t, err)
+
+	ct[len(ct)-1] ^= 1
+	_, err = bob.Decrypt(h, ct, []byte("ad"))
+	assert.Error(t, err)
+
+	ct[len(ct)-1] ^= 1
+	_, err = bob.Decrypt(h, ct, []byte("ad"))
+	assert.NoError(t, err, "failed decryption changed the session")
+}
@@ -0,0 +1,71 @@
+package seal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+//PublicKeyToCurve25519 converts an Ed25519 public key to the X25519 public key of the same key pair,
+//by mapping the point from the twisted Edwards curve to the birationally equivalent Montgomery curve.
+//Keys that aren't valid points, or points of small order, are rejected.
+func PublicKeyToCurve25519(pub ed25519.PublicKey) (*[32]byte, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid length for public key, %d instead of %d", len(pub), ed25519.PublicKeySize)
+	}
+
+	point, err := new(edwards25519.Point).SetBytes(pub)
+	if err != nil {
+		return nil, fmt.Errorf("public key is not on the curve")
+	}
+
+	if new(edwards25519.Point).MultByCofactor(point).Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, fmt.Errorf("public key has small order")
+	}
+
+	out := new([32]byte)
+	copy(out[:], point.BytesMontgomery())
+
+	return out, nil
+}
+
+//PrivateKeyToCurve25519 converts an Ed25519 private key to the X25519 private key of the same key pair.
+func PrivateKeyToCurve25519(priv ed25519.PrivateKey) *[32]byte {
+	h := sha512.Sum512(priv.Seed())
+
+	out := new([32]byte)
+	copy(out[:], h[:curve25519.ScalarSize])
+
+	return out
+}
+
+//SealFor encrypts msg, so that it can only be opened with the private key belonging to pub.
+//The sender stays anonymous, so the result should be part of something that is signed.
+func SealFor(pub ed25519.PublicKey, msg []byte) ([]byte, error) {
+	recipient, err := PublicKeyToCurve25519(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return box.SealAnonymous(nil, msg, recipient, rand.Reader)
+}
+
+//Open decrypts a message created by SealFor with the private key it was sealed for.
+func Open(priv ed25519.PrivateKey, sealed []byte) ([]byte, error) {
+	pub, err := PublicKeyToCurve25519(priv.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	msg, ok := box.OpenAnonymous(nil, sealed, pub, PrivateKeyToCurve25519(priv))
+	if !ok {
+		return nil, fmt.Errorf("unable to open sealed message")
+	}
+
+	return msg, nil
+}
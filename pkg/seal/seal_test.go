@@ -0,0 +1,66 @@
+package seal_test
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+
+	. "github.com/craumix/onionmsg/pkg/seal"
+)
+
+func TestPublicKeyToCurve25519Vector(t *testing.T) {
+	//crypto_sign_ed25519_pk_to_curve25519 of libsodium 1.0.18
+	pub, _ := hex.DecodeString("3bf918ffc2c955dc895bf145f566fb96623c1cadbe040091175764b5fde322c0")
+
+	converted, err := PublicKeyToCurve25519(pub)
+	assert.NoError(t, err)
+	assert.Equal(t, "efc6c9d0738e9ea18d738ad4a2653631558931b0f1fde4dd58c436d19686dc28", hex.EncodeToString(converted[:]))
+}
+
+func TestConvertedKeyPair(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		pub, priv, err := ed25519.GenerateKey(nil)
+		assert.NoError(t, err)
+
+		converted, err := PublicKeyToCurve25519(pub)
+		assert.NoError(t, err)
+
+		derived, err := curve25519.X25519(PrivateKeyToCurve25519(priv)[:], curve25519.Basepoint)
+		assert.NoError(t, err)
+		assert.Equal(t, derived, converted[:])
+	}
+}
+
+func TestPublicKeyToCurve25519Invalid(t *testing.T) {
+	//The identity and a point of order 8
+	for _, key := range []string{
+		"0100000000000000000000000000000000000000000000000000000000000000",
+		"26e8958fc2b227b045c3f489f2ef98f0d5dfac05d3c63339b13802886d53fc05",
+	} {
+		pub, _ := hex.DecodeString(key)
+
+		_, err := PublicKeyToCurve25519(pub)
+		assert.Error(t, err)
+	}
+
+	_, err := PublicKeyToCurve25519(make([]byte, 31))
+	assert.Error(t, err)
+}
+
+func TestSealFor(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	sealed, err := SealFor(pub, []byte("test"))
+	assert.NoError(t, err)
+
+	opened, err := Open(priv, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test"), opened)
+
+	_, err = Open(other, sealed)
+	assert.Error(t, err)
+}
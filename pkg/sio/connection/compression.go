@@ -0,0 +1,60 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	//maxDecompressedSize is the limit for the size of a single frame after decompression
+	maxDecompressedSize = 4 << 20
+	//compSample is the amount of data that is compressed to decide if the whole frame is compressible
+	compSample = 1 << 12
+	//compMinSaving is the percentage by which the sample has to shrink to compress the frame
+	compMinSaving = 3
+)
+
+//The encoder and decoder are shared by all connections.
+//Both are safe for concurrent use with EncodeAll and DecodeAll,
+//and keep a pool of internal state, so that it isn't allocated for every frame.
+var (
+	encoder, _ = zstd.NewWriter(nil)
+	decoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+)
+
+//compress returns the compressed msg, or nil if compressing it isn't worth it.
+//Data that is already compressed, e.g. media, is detected by compressing a small sample first.
+func compress(msg []byte) []byte {
+	if len(msg) < compThreshold {
+		return nil
+	}
+
+	if len(msg) > compSample {
+		sample := encoder.EncodeAll(msg[:compSample], make([]byte, 0, compSample))
+		if len(sample)*100 > compSample*(100-compMinSaving) {
+			return nil
+		}
+	}
+
+	comp := encoder.EncodeAll(msg, make([]byte, 0, len(msg)))
+	if len(comp) >= len(msg) {
+		return nil
+	}
+
+	return comp
+}
+
+//decompress decompresses a frame, which may not grow beyond maxDecompressedSize
+func decompress(comp []byte) ([]byte, error) {
+	msg, err := decoder.DecodeAll(comp, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed frame exceeds size limit of %d", maxDecompressedSize)
+	}
+
+	return msg, nil
+}
@@ -1,5 +1,10 @@
 package connection
 
+import (
+	"io"
+	"time"
+)
+
 type ConnWrapper interface {
 	WriteBytes(msg []byte) (int, error)
 	ReadBytes() ([]byte, error)
@@ -13,6 +18,12 @@ type ConnWrapper interface {
 	WriteStruct(msg interface{}) (int, error)
 	ReadStruct(target interface{}) error
 
+	WriteStream(r io.Reader) (int64, error)
+	ReadStream(w io.Writer, limit int64) (int64, error)
+
+	SetTimeout(timeout time.Duration) error
+	SetDeadline(t time.Time) error
+
 	Flush() error
 	Close() error
 	Buffered() int
@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"time"
 
-	"github.com/klauspost/compress/zstd"
 	"golang.org/x/net/proxy"
 )
 
@@ -16,6 +18,8 @@ const (
 	maxMsgSize = 1 << 20
 	//128 Byte
 	compThreshold = 1 << 7
+	//256 KByte
+	streamChunkSize = 1 << 18
 )
 
 var (
@@ -26,8 +30,10 @@ var (
 //Also tries to save bandwidth by using a manually flushed bufio.ReadWriter.
 //Has a artificial limit of 16K for message size.
 type DataConn struct {
-	buffer *bufio.ReadWriter
-	conn   net.Conn
+	buffer   *bufio.ReadWriter
+	conn     net.Conn
+	timeout  *time.Duration
+	deadline *time.Time
 }
 
 //DialDataConn creates a new connection that uses the, possibly set, proxy
@@ -53,8 +59,10 @@ func DialDataConn(network, address string) (ConnWrapper, error) {
 //WrapConnection creates a new DataConn from a net.Conn
 func WrapConnection(conn net.Conn) ConnWrapper {
 	return DataConn{
-		buffer: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
-		conn:   conn,
+		buffer:   bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		conn:     conn,
+		timeout:  new(time.Duration),
+		deadline: new(time.Time),
 	}
 }
 
@@ -62,29 +70,28 @@ func WrapConnection(conn net.Conn) ConnWrapper {
 //It returns the number of bytes written.
 //If n < len(msg), it also returns an error explaining why the write is short.
 func (d DataConn) WriteBytes(msg []byte) (int, error) {
-	compressed := false
-	if len(msg) >= compThreshold {
-		enc, _ := zstd.NewWriter(nil)
-		comp := enc.EncodeAll(msg, make([]byte, 0))
-
-		if len(comp) < len(msg) {
-			msg = comp
-			compressed = true
-		}
+	if len(msg) > maxDecompressedSize {
+		return 0, fmt.Errorf("data cannot be larger %d to be sent", maxDecompressedSize)
+	}
+
+	flag := byte(0x00)
+	if comp := compress(msg); comp != nil {
+		msg = comp
+		flag = 0x01
 	}
 
 	if len(msg) > maxMsgSize {
 		return 0, fmt.Errorf("data cannot be larger %d to be sent", maxMsgSize)
 	}
 
-	message := make([]byte, 0)
+	err := d.refreshDeadline()
+	if err != nil {
+		return 0, err
+	}
 
+	message := make([]byte, 0, len(msg)+5)
 	message = append(message, intToBytes(len(msg))...)
-	if compressed {
-		message = append(message, 0x01)
-	} else {
-		message = append(message, 0x00)
-	}
+	message = append(message, flag)
 	message = append(message, msg...)
 
 	return d.buffer.Write(message)
@@ -92,44 +99,93 @@ func (d DataConn) WriteBytes(msg []byte) (int, error) {
 
 //ReadBytes reads a byte slice from the underlying connection
 func (d DataConn) ReadBytes() ([]byte, error) {
-	l := make([]byte, 4)
-	_, err := d.buffer.Read(l)
+	err := d.refreshDeadline()
 	if err != nil {
 		return nil, err
 	}
 
-	bufSize := bytesToInt(l)
+	header := make([]byte, 5)
+	_, err = io.ReadFull(d.buffer, header)
+	if err != nil {
+		return nil, err
+	}
+
+	bufSize := bytesToInt(header[:4])
 	if bufSize > maxMsgSize {
 		return nil, fmt.Errorf("%d exceeds buffer size limit", bufSize)
 	}
+	compressed := header[4] == 0x01
 
-	c := make([]byte, 1)
-	_, err = d.buffer.Read(c)
+	total := make([]byte, bufSize)
+	_, err = io.ReadFull(d.buffer, total)
 	if err != nil {
 		return nil, err
 	}
-	compressed := c[0] == 0x01
 
-	var total []byte
-	for len(total) < bufSize {
-		tmp := make([]byte, bufSize-len(total))
-		n, err := d.buffer.Read(tmp)
-		if err != nil {
-			return nil, err
+	if compressed {
+		return decompress(total)
+	}
+
+	return total, nil
+}
+
+//WriteStream writes everything read from r to the connection, split into multiple frames.
+//It is meant for payloads that are too large to be sent with WriteBytes.
+//It returns the number of bytes read from r.
+func (d DataConn) WriteStream(r io.Reader) (int64, error) {
+	var (
+		total int64
+		buf   = make([]byte, streamChunkSize)
+	)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			_, werr := d.WriteBytes(buf[:n])
+			if werr != nil {
+				return total, werr
+			}
+			total += int64(n)
 		}
 
-		total = append(total, tmp[:n]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return total, err
+		}
 	}
 
-	if compressed {
-		dec, _ := zstd.NewReader(nil)
-		total, err = dec.DecodeAll(total, nil)
+	//An empty frame marks the end of the stream
+	_, err := d.WriteBytes(nil)
+	return total, err
+}
+
+//ReadStream reads a stream sent with WriteStream and writes it to w.
+//If limit is greater than 0, the stream is aborted once it exceeds limit bytes.
+//It returns the number of bytes written to w.
+func (d DataConn) ReadStream(w io.Writer, limit int64) (int64, error) {
+	var total int64
+
+	for {
+		chunk, err := d.ReadBytes()
 		if err != nil {
-			return nil, err
+			return total, err
 		}
-	}
 
-	return total, nil
+		if len(chunk) == 0 {
+			return total, nil
+		}
+
+		if limit > 0 && total+int64(len(chunk)) > limit {
+			return total, fmt.Errorf("stream exceeds size limit of %d", limit)
+		}
+
+		n, err := w.Write(chunk)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
 }
 
 //WriteString writes the specified string to the underlying connectrion
@@ -193,9 +249,56 @@ func (d DataConn) ReadStruct(target interface{}) error {
 //Flush writes any buffered data to the underlying io.Writer.
 func (d DataConn) Flush() error {
 	//log.Printf("Buffered %d bytes before flushing\n", d.Buffered())
+	err := d.refreshDeadline()
+	if err != nil {
+		return err
+	}
+
 	return d.buffer.Flush()
 }
 
+//SetTimeout sets the time that every following read, write or flush may take at most.
+//A timeout of 0 disables it.
+func (d DataConn) SetTimeout(timeout time.Duration) error {
+	*d.timeout = timeout
+	return d.applyDeadline()
+}
+
+//SetDeadline sets an absolute deadline for all following operations, see net.Conn.
+//The timeout of an operation never extends it, so it limits how long the whole connection may take.
+//A zero time removes it.
+func (d DataConn) SetDeadline(t time.Time) error {
+	*d.deadline = t
+	return d.applyDeadline()
+}
+
+func (d DataConn) refreshDeadline() error {
+	if *d.timeout == 0 {
+		return nil
+	}
+
+	return d.applyDeadline()
+}
+
+//applyDeadline sets the earlier of the deadline and the end of the timeout on the underlying connection
+func (d DataConn) applyDeadline() error {
+	deadline := *d.deadline
+	if *d.timeout != 0 {
+		next := time.Now().Add(*d.timeout)
+		if deadline.IsZero() || next.Before(deadline) {
+			deadline = next
+		}
+	}
+
+	return d.conn.SetDeadline(deadline)
+}
+
+//IsTimeout returns true if err was caused by an exceeded timeout or deadline
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 //Close closes the connection. Any blocked Read or Write operations will be unblocked and return errors.
 func (d DataConn) Close() error {
 	return d.conn.Close()
@@ -0,0 +1,135 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pipe() (DataConn, DataConn) {
+	a, b := net.Pipe()
+	return WrapConnection(a).(DataConn), WrapConnection(b).(DataConn)
+}
+
+func TestBytesRoundTrip(t *testing.T) {
+	sender, receiver := pipe()
+	msg := bytes.Repeat([]byte("onionmsg"), 1<<12)
+
+	go func() {
+		sender.WriteBytes(msg)
+		sender.Flush()
+	}()
+
+	received, err := receiver.ReadBytes()
+
+	assert.NoError(t, err)
+	assert.Equal(t, msg, received)
+}
+
+func TestCompressSkipsIncompressible(t *testing.T) {
+	random := make([]byte, 1<<16)
+	rand.Read(random)
+
+	assert.Nil(t, compress(random))
+	assert.NotNil(t, compress(bytes.Repeat([]byte("onionmsg"), 1<<12)))
+}
+
+func TestDecompressLimit(t *testing.T) {
+	sender, receiver := pipe()
+	bomb := encoder.EncodeAll(make([]byte, maxDecompressedSize+1), nil)
+
+	go func() {
+		frame := append(intToBytes(len(bomb)), 0x01)
+		sender.buffer.Write(append(frame, bomb...))
+		sender.Flush()
+	}()
+
+	_, err := receiver.ReadBytes()
+
+	assert.Error(t, err)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	sender, receiver := pipe()
+	payload := make([]byte, 3*streamChunkSize+42)
+	rand.Read(payload)
+
+	go func() {
+		sender.WriteStream(bytes.NewReader(payload))
+		sender.Flush()
+	}()
+
+	buf := &bytes.Buffer{}
+	n, err := receiver.ReadStream(buf, 0)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), n)
+	assert.Equal(t, payload, buf.Bytes())
+}
+
+func TestStreamLimit(t *testing.T) {
+	sender, receiver := pipe()
+	payload := make([]byte, 2*streamChunkSize)
+
+	go func() {
+		sender.WriteStream(bytes.NewReader(payload))
+		sender.Flush()
+	}()
+
+	_, err := receiver.ReadStream(&bytes.Buffer{}, streamChunkSize)
+
+	assert.Error(t, err)
+}
+
+func TestTimeout(t *testing.T) {
+	_, receiver := pipe()
+	receiver.SetTimeout(time.Millisecond * 10)
+
+	_, err := receiver.ReadBytes()
+
+	assert.True(t, IsTimeout(err))
+}
+
+func TestDeadlineNotExtended(t *testing.T) {
+	sender, receiver := pipe()
+	defer receiver.Close()
+	receiver.SetDeadline(time.Now().Add(time.Millisecond * 50))
+	receiver.SetTimeout(time.Second)
+
+	//Every message arrives within the timeout, but the deadline still ends the connection
+	go func() {
+		for i := 0; i < 20; i++ {
+			time.Sleep(time.Millisecond * 10)
+			sender.WriteString("trickle")
+			sender.Flush()
+		}
+	}()
+
+	var err error
+	for err == nil {
+		_, err = receiver.ReadString()
+	}
+
+	assert.True(t, IsTimeout(err))
+}
+
+func TestTimeoutDisabled(t *testing.T) {
+	sender, receiver := pipe()
+	receiver.SetTimeout(time.Millisecond * 10)
+	receiver.SetTimeout(0)
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		sender.WriteString("late")
+		sender.Flush()
+	}()
+
+	msg, err := receiver.ReadString()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "late", msg)
+}
@@ -1,10 +1,44 @@
 package sio
 
 import (
+	"errors"
 	"net"
 	"strconv"
+	"time"
 )
 
+const (
+	maxAcceptDelay = time.Second
+)
+
+//ConnLimit bounds the number of connections that are handled at the same time.
+//It can be shared by multiple servers to enforce a common limit.
+type ConnLimit chan struct{}
+
+//NewConnLimit creates a ConnLimit that allows n concurrent connections
+func NewConnLimit(n int) ConnLimit {
+	return make(ConnLimit, n)
+}
+
+func (l ConnLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l ConnLimit) release() {
+	if l != nil {
+		<-l
+	}
+}
+
 //StartLocalServer is a wrapper for StartServer which uses "localhost" as the hostname.
 //This makes the server only available for local connections.
 func StartLocalServer(port int, clientHandler func(net.Conn), connErrHook func(error)) error {
@@ -15,20 +49,63 @@ func StartLocalServer(port int, clientHandler func(net.Conn), connErrHook func(e
 //to the provided handler, which is the startet as a new goroutine.
 //The hostname can be omitted to listen on all interfaces.
 func StartServer(port int, hostname string, clientHandler func(net.Conn), connErrHook func(error)) error {
+	return StartLimitedServer(port, hostname, nil, clientHandler, nil, connErrHook)
+}
+
+//StartLimitedLocalServer is a wrapper for StartLimitedServer which uses "localhost" as the hostname.
+func StartLimitedLocalServer(port int, limit ConnLimit, clientHandler, rejectHandler func(net.Conn), connErrHook func(error)) error {
+	return StartLimitedServer(port, "localhost", limit, clientHandler, rejectHandler, connErrHook)
+}
+
+//StartLimitedServer works like StartServer, but only handles as many connections at once as the limit allows.
+//Connections beyond the limit are passed to the rejectHandler, which is called from the accept loop
+//and therefore must not block. The rejectHandler takes ownership of the connection and has to close it,
+//without a rejectHandler the connection is closed right away.
+//A nil limit allows any number of connections.
+func StartLimitedServer(port int, hostname string, limit ConnLimit, clientHandler, rejectHandler func(net.Conn), connErrHook func(error)) error {
 	server, err := net.Listen("tcp", hostname+":"+strconv.Itoa(port))
 	if err != nil {
 		return err
 	}
 	defer server.Close()
 
+	var delay time.Duration
 	for {
 		c, err := server.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
 			if connErrHook != nil {
 				connErrHook(err)
 			}
+
+			//Back off, e.g. when running out of file descriptors
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			time.Sleep(delay)
+
+			continue
+		}
+		delay = 0
+
+		if !limit.acquire() {
+			if rejectHandler != nil {
+				rejectHandler(c)
+			} else {
+				c.Close()
+			}
+
+			continue
 		}
 
-		go clientHandler(c)
+		go func() {
+			defer limit.release()
+			clientHandler(c)
+		}()
 	}
 }
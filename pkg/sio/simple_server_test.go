@@ -0,0 +1,47 @@
+package sio
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAddress = "localhost:10099"
+
+func TestLimitedServer(t *testing.T) {
+	limit := NewConnLimit(1)
+	release := make(chan struct{})
+	rejected := make(chan struct{}, 1)
+
+	go StartLimitedLocalServer(10099, limit, func(c net.Conn) {
+		assert.NotNil(t, c)
+		<-release
+		c.Close()
+	}, func(c net.Conn) {
+		c.Close()
+		rejected <- struct{}{}
+	}, nil)
+	time.Sleep(time.Millisecond * 50)
+
+	first, err := net.Dial("tcp", testAddress)
+	assert.NoError(t, err)
+	defer first.Close()
+	time.Sleep(time.Millisecond * 50)
+
+	second, err := net.Dial("tcp", testAddress)
+	assert.NoError(t, err)
+	defer second.Close()
+
+	select {
+	case <-rejected:
+	case <-time.After(time.Second):
+		t.Fatal("connection beyond the limit was not rejected")
+	}
+
+	close(release)
+	time.Sleep(time.Millisecond * 50)
+
+	assert.True(t, limit.acquire())
+}
@@ -127,12 +127,20 @@ func (i *Instance) runBinary() error {
 
 //RegisterService registers a new V3 Hidden Service, and proxies the requests to the specified local port.
 func (i *Instance) RegisterService(priv ed25519.PrivateKey, torPort, localPort int) error {
+	return i.RegisterServicePorts(priv, map[int]int{torPort: localPort})
+}
+
+//RegisterServicePorts registers a new V3 Hidden Service, and proxies the requests for every port
+//of the service to the local port it is mapped to.
+func (i *Instance) RegisterServicePorts(priv ed25519.PrivateKey, ports map[int]int) error {
 	s, err := torgo.OnionFromEd25519(priv)
 	if err != nil {
 		return err
 	}
 
-	s.Ports[torPort] = "127.0.0.1:" + strconv.Itoa(localPort)
+	for torPort, localPort := range ports {
+		s.Ports[torPort] = "127.0.0.1:" + strconv.Itoa(localPort)
+	}
 
 	err = i.controller.AddOnion(s)
 	if err != nil {
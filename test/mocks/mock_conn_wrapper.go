@@ -2,6 +2,9 @@ package mocks
 
 import (
 	"encoding/json"
+	"io"
+	"time"
+
 	"github.com/craumix/onionmsg/pkg/sio/connection"
 )
 
@@ -37,6 +40,16 @@ type MockConnWrapper struct {
 	ReadStructSourceStruct interface{}
 	ReadStructOutputError  error
 
+	WriteStreamInput       [][]byte
+	WriteStreamOutputInt   int64
+	WriteStreamOutputError error
+
+	ReadStreamOutputBytes []byte
+	ReadStreamOutputError error
+
+	SetTimeoutInput  []time.Duration
+	SetDeadlineInput []time.Time
+
 	CloseError  error
 	CloseCalled bool
 
@@ -91,6 +104,27 @@ func (m *MockConnWrapper) ReadStruct(target interface{}) error {
 	return m.ReadStructOutputError
 }
 
+func (m *MockConnWrapper) WriteStream(r io.Reader) (int64, error) {
+	raw, _ := io.ReadAll(r)
+	m.WriteStreamInput = append(m.WriteStreamInput, raw)
+	return m.WriteStreamOutputInt, m.WriteStreamOutputError
+}
+
+func (m *MockConnWrapper) ReadStream(w io.Writer, limit int64) (int64, error) {
+	n, _ := w.Write(m.ReadStreamOutputBytes)
+	return int64(n), m.ReadStreamOutputError
+}
+
+func (m *MockConnWrapper) SetTimeout(timeout time.Duration) error {
+	m.SetTimeoutInput = append(m.SetTimeoutInput, timeout)
+	return nil
+}
+
+func (m *MockConnWrapper) SetDeadline(t time.Time) error {
+	m.SetDeadlineInput = append(m.SetDeadlineInput, t)
+	return nil
+}
+
 func (m *MockConnWrapper) Flush() error {
 	m.FlushCalled = true
 	return m.FlushError
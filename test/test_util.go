@@ -11,3 +11,7 @@ func GetTestError() error {
 func GetValidUUID() string {
 	return "00000000-0000-0000-0000-000000000000"
 }
+
+func GetTestFingerprint() string {
+	return "5BhobbbQLnfkfQ8AYfIaZiw8OWJgTKZIbL5VXy2mRDg"
+}